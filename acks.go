@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errTooManyUnacked = errors.New("too many unacknowledged changes")
+
+// pendingAck is a change sent in at-least-once mode and not acknowledged yet
+type pendingAck struct {
+	message  PublicationMessage
+	rowKey   string
+	sentAt   time.Time
+	attempts int
+}
+
+// ackState is the at-least-once delivery state of a client, keyed by token (and client id) so it
+// survives reconnects of the same client
+type ackState struct {
+	mutex sync.Mutex
+
+	key        string
+	tenantName string
+	userID     int
+	session    *WebSocketSession // attached session, nil while disconnected
+	detachedAt time.Time
+
+	pending      map[uint64]*pendingAck
+	order        []uint64 // sent sequence numbers not yet covered by ackedThrough, oldest first
+	ackedThrough uint64   // highest sequence such that every change sent up to it was acked
+	lastSentSeq  uint64
+	lastAckAt    time.Time
+	retransmits  int64
+}
+
+// ackTables returns the tables delivered at-least-once to clients in ack mode
+func ackTables() map[string]bool {
+	tables := make(map[string]bool)
+	for _, table := range getEnvList(config.AckTables) {
+		tables[table] = true
+	}
+	return tables
+}
+
+// attachAckState attaches a session to the delivery state of its client, creating it on first connect
+func (e *RealtimeEngine) attachAckState(wsSession *WebSocketSession, authSession *AuthenticatedSession, clientID string) *ackState {
+	key := fmt.Sprintf("%s:%d:%s", authSession.TenantName, authSession.TokenID, clientID)
+
+	e.ackMutex.Lock()
+	state, exists := e.ackStates[key]
+	if !exists {
+		state = &ackState{
+			key:        key,
+			tenantName: authSession.TenantName,
+			userID:     authSession.UserID,
+			pending:    make(map[uint64]*pendingAck),
+			// Nothing before the connection is owed to the client
+			ackedThrough: e.historyFor(authSession.TenantName).lastSeq(),
+		}
+		e.ackStates[key] = state
+	}
+	e.ackMutex.Unlock()
+
+	state.mutex.Lock()
+	previous := state.session
+	state.session = wsSession
+	state.mutex.Unlock()
+
+	if previous != nil && previous != wsSession {
+		log.Printf("🔀 Ack state %s moved from session %s to %s", key, previous.ID, wsSession.ID)
+	}
+	return state
+}
+
+// detachAckState marks a client's delivery state as disconnected
+func (e *RealtimeEngine) detachAckState(wsSession *WebSocketSession) {
+	state := wsSession.ackState
+	if state == nil {
+		return
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.session == wsSession {
+		state.session = nil
+		state.detachedAt = time.Now()
+	}
+}
+
+// trackDelivery registers a change sent to a session in ack mode and marks it as requiring an ack
+func (state *ackState) trackDelivery(message *PublicationMessage, rowKey string) error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if _, exists := state.pending[message.Seq]; exists {
+		message.AckRequired = true
+		return nil
+	}
+	if message.Seq <= state.ackedThrough {
+		return nil
+	}
+	if len(state.pending) >= getIntEnv(config.AckMaxPending, 1000) {
+		return errTooManyUnacked
+	}
+
+	message.AckRequired = true
+	state.pending[message.Seq] = &pendingAck{message: *message, rowKey: rowKey, sentAt: time.Now(), attempts: 1}
+	state.order = append(state.order, message.Seq)
+	if message.Seq > state.lastSentSeq {
+		state.lastSentSeq = message.Seq
+	}
+	return nil
+}
+
+// reset forgets every unacknowledged change after the client was told to resync
+func (state *ackState) reset() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	state.pending = make(map[uint64]*pendingAck)
+	state.order = nil
+	state.ackedThrough = state.lastSentSeq
+}
+
+// ack records acknowledged sequence numbers: a single seq and/or everything up to through
+func (state *ackState) ack(seq, through uint64) int {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	acked := 0
+	if seq > 0 {
+		if _, exists := state.pending[seq]; exists {
+			delete(state.pending, seq)
+			acked++
+		}
+	}
+	if through > 0 {
+		for pendingSeq := range state.pending {
+			if pendingSeq <= through {
+				delete(state.pending, pendingSeq)
+				acked++
+			}
+		}
+	}
+
+	// Advance the contiguous watermark past every acked change
+	advanced := 0
+	for advanced < len(state.order) {
+		if _, stillPending := state.pending[state.order[advanced]]; stillPending {
+			break
+		}
+		if state.order[advanced] > state.ackedThrough {
+			state.ackedThrough = state.order[advanced]
+		}
+		advanced++
+	}
+	state.order = state.order[advanced:]
+	if len(state.pending) == 0 && state.lastSentSeq > state.ackedThrough {
+		state.ackedThrough = state.lastSentSeq
+	}
+	if acked > 0 {
+		state.lastAckAt = time.Now()
+	}
+	return acked
+}
+
+// handleAck processes an ack message from a client in ack mode
+func (e *RealtimeEngine) handleAck(wsSession *WebSocketSession, message ClientMessage) {
+	if wsSession.ackState == nil {
+		e.sendClientError(wsSession, message.RequestID, "ack_mode_disabled", "Connect with ack=true to acknowledge changes")
+		return
+	}
+	if message.Seq == 0 && message.Through == 0 {
+		e.sendClientError(wsSession, message.RequestID, "invalid_ack", "An ack needs seq or through")
+		return
+	}
+	wsSession.ackState.ack(message.Seq, message.Through)
+}
+
+// retransmitPending re-queues unacknowledged changes older than minAge to the attached session
+func (e *RealtimeEngine) retransmitPending(state *ackState, minAge time.Duration) {
+	state.mutex.Lock()
+	wsSession := state.session
+	if wsSession == nil {
+		state.mutex.Unlock()
+		return
+	}
+	var due []*pendingAck
+	now := time.Now()
+	for _, seq := range state.order {
+		if pending, exists := state.pending[seq]; exists && now.Sub(pending.sentAt) >= minAge {
+			pending.sentAt = now
+			pending.attempts++
+			due = append(due, pending)
+		}
+	}
+	state.retransmits += int64(len(due))
+	state.mutex.Unlock()
+
+	for _, pending := range due {
+		data, err := wsSession.format.encode(pending.message)
+		if err != nil {
+			log.Printf("❌ Failed to encode %s message for session %s: %v", wsSession.format.protocol, wsSession.ID, err)
+			return
+		}
+		frame := outboundFrame{messageType: wsSession.format.messageType, data: data, rowKey: pending.rowKey, operation: pending.message.Operation}
+		if err := e.queueOutbound(wsSession, frame); err != nil {
+			return
+		}
+	}
+	if len(due) > 0 {
+		log.Printf("🔁 Retransmitted %d unacknowledged change(s) to session %s", len(due), wsSession.ID)
+	}
+}
+
+// checkAckStates retransmits timed-out changes and forgets the state of clients gone for too long
+func (e *RealtimeEngine) checkAckStates() {
+	timeout := getDurationEnv(config.AckTimeout, 10*time.Second)
+	ttl := getDurationEnv(config.AckStateTTL, 10*time.Minute)
+
+	e.ackMutex.Lock()
+	states := make([]*ackState, 0, len(e.ackStates))
+	for key, state := range e.ackStates {
+		state.mutex.Lock()
+		expired := state.session == nil && time.Since(state.detachedAt) > ttl
+		state.mutex.Unlock()
+		if expired {
+			delete(e.ackStates, key)
+			log.Printf("🧹 Dropped ack state %s after %v without reconnect", key, ttl)
+			continue
+		}
+		states = append(states, state)
+	}
+	e.ackMutex.Unlock()
+
+	for _, state := range states {
+		e.retransmitPending(state, timeout)
+	}
+}
+
+// GetSessions returns the connected sessions with their queue and acknowledgement progress (implements RealtimeEngineInterface)
+func (e *RealtimeEngine) GetSessions() []map[string]interface{} {
+	e.mutex.RLock()
+	sessions := make([]*WebSocketSession, 0, len(e.sessions))
+	for _, wsSession := range e.sessions {
+		sessions = append(sessions, wsSession)
+	}
+	e.mutex.RUnlock()
+
+	result := make([]map[string]interface{}, 0, len(sessions))
+	for _, wsSession := range sessions {
+		depth, _, dropped, coalesced, forcedDisconnects := wsSession.queue.stats()
+
+		wsSession.mutex.Lock()
+		subscriptions := len(wsSession.subscriptions)
+		lastPing := wsSession.LastPing
+		wsSession.mutex.Unlock()
+
+		info := map[string]interface{}{
+			"session_id":         wsSession.ID,
+			"tenant":             wsSession.Tenant,
+			"user_id":            wsSession.UserID,
+			"subscriptions":      subscriptions,
+			"queue_depth":        depth,
+			"dropped":            dropped,
+			"coalesced":          coalesced,
+			"forced_disconnects": forcedDisconnects,
+			"last_pong_at":       lastPing.Format(time.RFC3339),
+			"ack_mode":           wsSession.ackState != nil,
+			"updates":            updatesMode(wsSession.compactUpdates),
+			"transactions":       wsSession.transactionEnvelopes,
+			"protocol":           wsSession.format.protocol,
+			"compression":        wsSession.compression,
+			"tenant_seq":         e.historyFor(wsSession.Tenant).lastSeq(),
+		}
+
+		if state := wsSession.ackState; state != nil {
+			state.mutex.Lock()
+			info["acked_through"] = state.ackedThrough
+			info["last_sent_seq"] = state.lastSentSeq
+			info["pending_acks"] = len(state.pending)
+			info["retransmits"] = state.retransmits
+			// Distance in tenant sequence numbers between the last change sent and the last one acked contiguously
+			info["seq_lag"] = uint64(0)
+			if state.lastSentSeq > state.ackedThrough {
+				info["seq_lag"] = state.lastSentSeq - state.ackedThrough
+			}
+			if len(state.order) > 0 {
+				if oldest, exists := state.pending[state.order[0]]; exists {
+					info["oldest_unacked_seq"] = state.order[0]
+					info["oldest_unacked_attempts"] = oldest.attempts
+				}
+			}
+			if !state.lastAckAt.IsZero() {
+				info["last_ack_at"] = state.lastAckAt.Format(time.RFC3339)
+			}
+			state.mutex.Unlock()
+		}
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["session_id"].(string) < result[j]["session_id"].(string)
+	})
+	return result
+}
@@ -20,6 +20,7 @@ func (e *RealtimeEngine) authenticateTokenForDomain(bearerToken, domain string)
 		return &AuthenticatedSession{
 			TenantName: cachedAuth.TenantName,
 			UserID:     cachedAuth.UserID,
+			UserType:   cachedAuth.UserType,
 			TokenID:    cachedAuth.TokenID,
 			Abilities:  cachedAuth.Abilities,
 			ExpiresAt:  cachedAuth.ExpiresAt,
@@ -175,6 +176,7 @@ func (e *RealtimeEngine) validateTokenInTenant(tenantName string, db *sql.DB, to
 	return &AuthenticatedSession{
 		TenantName: tenantName,
 		UserID:     token.TokenableID,
+		UserType:   token.TokenableType,
 		TokenID:    token.ID,
 		Abilities:  abilities,
 		ExpiresAt:  token.ExpiresAt,
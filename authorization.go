@@ -0,0 +1,438 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Authorization modes selectable through AUTHORIZATION_MODE
+const (
+	authorizationModeTenant      = "tenant"      // every user of a tenant sees every change (legacy)
+	authorizationModePermissions = "permissions" // table and row rules based on roles, permissions and teams
+)
+
+// grantRefreshDelay debounces grant reloads while permission tables are being bulk edited
+const grantRefreshDelay = 2 * time.Second
+
+// grantTables are the tenant tables whose changes invalidate loaded user grants
+var grantTables = map[string]bool{
+	"roles":                 true,
+	"permissions":           true,
+	"model_has_roles":       true,
+	"model_has_permissions": true,
+	"role_has_permissions":  true,
+	"wh_roles":              true,
+	"wh_permissions":        true,
+	"wh_role_permission":    true,
+	"wh_user_team":          true,
+}
+
+// defaultAuthorizationRules apply when AUTHORIZATION_RULES_FILE is not set
+var defaultAuthorizationRules = []AuthorizationRule{
+	{Table: "wh_session_logs", AdminOnly: true},
+	{Table: "wh_config_logs", AdminOnly: true},
+	{Table: "wh_messages", UserColumns: []string{"user_id", "sender_id", "recipient_id"}},
+}
+
+// UserGrants are the roles, permissions and team memberships of a connected user
+type UserGrants struct {
+	UserID      int
+	Admin       bool
+	Roles       map[string]bool
+	Permissions map[string]bool
+	Teams       map[string]bool // team ids, formatted like row values
+	LoadedAt    time.Time
+}
+
+// fingerprint identifies a grant set so refreshes can tell whether anything changed
+func (g *UserGrants) fingerprint() string {
+	var parts []string
+	for role := range g.Roles {
+		parts = append(parts, "r:"+role)
+	}
+	for permission := range g.Permissions {
+		parts = append(parts, "p:"+permission)
+	}
+	for team := range g.Teams {
+		parts = append(parts, "t:"+team)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// AuthorizationRule restricts the changes of the tables matching a glob pattern.
+// Table-level: the user needs any of Roles or Permissions (when set), or admin for AdminOnly.
+// Row-level: the row must reference the user in a UserColumns or one of their teams in a TeamColumns.
+// The first matching rule applies; tables without a rule are readable by every user of the tenant.
+type AuthorizationRule struct {
+	Table       string   `json:"table"`
+	AdminOnly   bool     `json:"admin_only,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	UserColumns []string `json:"user_columns,omitempty"`
+	TeamColumns []string `json:"team_columns,omitempty"`
+}
+
+// ChangeAuthorizer decides which change events a user may receive
+type ChangeAuthorizer interface {
+	Name() string
+	LoadGrants(db *sql.DB, auth *AuthenticatedSession) (*UserGrants, error)
+	CanReadTable(grants *UserGrants, table string) bool
+	CanReadRow(grants *UserGrants, table string, row map[string]interface{}) bool
+	CanReadAllRows(grants *UserGrants, table string) bool
+}
+
+// newChangeAuthorizer builds the authorizer selected by AUTHORIZATION_MODE
+func newChangeAuthorizer() (ChangeAuthorizer, error) {
+	switch mode := config.AuthorizationMode; mode {
+	case authorizationModeTenant:
+		return tenantAuthorizer{}, nil
+	case authorizationModePermissions, "":
+		rules, err := loadAuthorizationRules(config.AuthorizationRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		adminRoles := make(map[string]bool)
+		for _, role := range getEnvList(config.AuthorizationAdminRoles) {
+			adminRoles[role] = true
+		}
+		return &permissionAuthorizer{rules: rules, adminRoles: adminRoles}, nil
+	default:
+		return nil, fmt.Errorf("unknown authorization mode %q (expected %s or %s)",
+			mode, authorizationModeTenant, authorizationModePermissions)
+	}
+}
+
+// loadAuthorizationRules reads the rule list from a JSON file, or returns the defaults when no file is set
+func loadAuthorizationRules(filename string) ([]AuthorizationRule, error) {
+	if filename == "" {
+		return defaultAuthorizationRules, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorization rules: %w", err)
+	}
+
+	var rules []AuthorizationRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse authorization rules %s: %w", filename, err)
+	}
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Table, ""); err != nil || rule.Table == "" {
+			return nil, fmt.Errorf("invalid table pattern %q in %s", rule.Table, filename)
+		}
+	}
+
+	log.Printf("✅ Loaded %d authorization rules from %s", len(rules), filename)
+	return rules, nil
+}
+
+// tenantAuthorizer keeps the legacy behavior: tenant isolation only
+type tenantAuthorizer struct{}
+
+func (tenantAuthorizer) Name() string { return authorizationModeTenant }
+
+func (tenantAuthorizer) LoadGrants(db *sql.DB, auth *AuthenticatedSession) (*UserGrants, error) {
+	return &UserGrants{UserID: auth.UserID, LoadedAt: time.Now()}, nil
+}
+
+func (tenantAuthorizer) CanReadTable(grants *UserGrants, table string) bool { return true }
+
+func (tenantAuthorizer) CanReadRow(grants *UserGrants, table string, row map[string]interface{}) bool {
+	return true
+}
+
+func (tenantAuthorizer) CanReadAllRows(grants *UserGrants, table string) bool { return true }
+
+// permissionAuthorizer applies AuthorizationRules using Spatie roles/permissions,
+// wh_role_permission and wh_user_team memberships
+type permissionAuthorizer struct {
+	rules      []AuthorizationRule
+	adminRoles map[string]bool
+}
+
+// Grant queries. Sources whose tables do not exist in a tenant are skipped.
+const (
+	grantRolesQuery = `
+		SELECT r.name FROM roles r
+		JOIN model_has_roles mr ON mr.role_id = r.id
+		WHERE mr.model_type = $1 AND mr.model_id = $2`
+
+	grantPermissionsQuery = `
+		SELECT p.name FROM permissions p
+		JOIN model_has_permissions mp ON mp.permission_id = p.id
+		WHERE mp.model_type = $1 AND mp.model_id = $2
+		UNION
+		SELECT p.name FROM permissions p
+		JOIN role_has_permissions rp ON rp.permission_id = p.id
+		JOIN model_has_roles mr ON mr.role_id = rp.role_id
+		WHERE mr.model_type = $1 AND mr.model_id = $2`
+
+	grantRolePermissionsQuery = `
+		SELECT p.name FROM wh_permissions p
+		JOIN wh_role_permission rp ON rp.permission_id = p.id
+		JOIN wh_roles r ON r.id = rp.role_id
+		WHERE r.name = ANY($1)`
+
+	grantTeamsQuery = `SELECT team_id::text FROM wh_user_team WHERE user_id = $1`
+)
+
+// missingGrantSources remembers grant sources reported missing so the warning is logged once
+var missingGrantSources sync.Map
+
+func (a *permissionAuthorizer) Name() string { return authorizationModePermissions }
+
+// LoadGrants reads the user's roles, permissions and teams from the tenant database
+func (a *permissionAuthorizer) LoadGrants(db *sql.DB, auth *AuthenticatedSession) (*UserGrants, error) {
+	grants := &UserGrants{
+		UserID:      auth.UserID,
+		Roles:       make(map[string]bool),
+		Permissions: make(map[string]bool),
+		Teams:       make(map[string]bool),
+		LoadedAt:    time.Now(),
+	}
+
+	userType := auth.UserType
+	if userType == "" {
+		userType = `App\Models\User`
+	}
+
+	if err := queryGrantNames(db, auth.TenantName, "roles", grants.Roles, grantRolesQuery, userType, auth.UserID); err != nil {
+		return nil, err
+	}
+	if err := queryGrantNames(db, auth.TenantName, "permissions", grants.Permissions, grantPermissionsQuery, userType, auth.UserID); err != nil {
+		return nil, err
+	}
+
+	roles := make([]string, 0, len(grants.Roles))
+	for role := range grants.Roles {
+		roles = append(roles, role)
+	}
+	if err := queryGrantNames(db, auth.TenantName, "wh_role_permission", grants.Permissions, grantRolePermissionsQuery, pq.Array(roles)); err != nil {
+		return nil, err
+	}
+	if err := queryGrantNames(db, auth.TenantName, "wh_user_team", grants.Teams, grantTeamsQuery, auth.UserID); err != nil {
+		return nil, err
+	}
+
+	for role := range grants.Roles {
+		if a.adminRoles[role] {
+			grants.Admin = true
+		}
+	}
+	return grants, nil
+}
+
+// queryGrantNames adds the single text column returned by a grant query to a set
+func queryGrantNames(db *sql.DB, tenantName, source string, into map[string]bool, query string, args ...interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code == "42P01" || pqErr.Code == "42703") {
+			if _, warned := missingGrantSources.LoadOrStore(tenantName+"/"+source, true); !warned {
+				log.Printf("⚠️  Grant source %s unavailable in tenant %s: %v", source, tenantName, pqErr.Message)
+			}
+			return nil
+		}
+		return fmt.Errorf("failed to load %s grants: %w", source, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("failed to scan %s grant: %w", source, err)
+		}
+		into[name] = true
+	}
+	return rows.Err()
+}
+
+// ruleFor returns the first rule matching a table
+func (a *permissionAuthorizer) ruleFor(table string) *AuthorizationRule {
+	for i := range a.rules {
+		if matched, _ := path.Match(a.rules[i].Table, table); matched {
+			return &a.rules[i]
+		}
+	}
+	return nil
+}
+
+// CanReadTable applies the table-level part of the matching rule
+func (a *permissionAuthorizer) CanReadTable(grants *UserGrants, table string) bool {
+	rule := a.ruleFor(table)
+	if rule == nil || grants.Admin {
+		return true
+	}
+	if rule.AdminOnly {
+		return false
+	}
+	if len(rule.Roles) == 0 && len(rule.Permissions) == 0 {
+		return true
+	}
+	for _, role := range rule.Roles {
+		if grants.Roles[role] {
+			return true
+		}
+	}
+	for _, permission := range rule.Permissions {
+		if grants.Permissions[permission] {
+			return true
+		}
+	}
+	return false
+}
+
+// CanReadRow applies the row-level part of the matching rule. Images that carry none of the
+// rule's columns (e.g. key-only DELETE images) cannot be judged and are denied.
+func (a *permissionAuthorizer) CanReadRow(grants *UserGrants, table string, row map[string]interface{}) bool {
+	rule := a.ruleFor(table)
+	if rule == nil || grants.Admin || (len(rule.UserColumns) == 0 && len(rule.TeamColumns) == 0) {
+		return true
+	}
+
+	userID := fmt.Sprint(grants.UserID)
+	for _, column := range rule.UserColumns {
+		if value := row[column]; value != nil && fmt.Sprint(value) == userID {
+			return true
+		}
+	}
+	for _, column := range rule.TeamColumns {
+		if value := row[column]; value != nil && grants.Teams[fmt.Sprint(value)] {
+			return true
+		}
+	}
+	return false
+}
+
+// CanReadAllRows reports whether CanReadRow allows every row of a table, i.e. no row-level part applies
+func (a *permissionAuthorizer) CanReadAllRows(grants *UserGrants, table string) bool {
+	rule := a.ruleFor(table)
+	return rule == nil || grants.Admin || (len(rule.UserColumns) == 0 && len(rule.TeamColumns) == 0)
+}
+
+// loadSessionGrants loads the grants of a user at connect time. Failures fall back to empty grants,
+// which keeps rule-protected tables closed while unrestricted tables keep flowing, and schedule a
+// refresh of the tenant that replaces them and asks the session to resync.
+func (e *RealtimeEngine) loadSessionGrants(authSession *AuthenticatedSession) *UserGrants {
+	grants, err := e.loadGrants(authSession)
+	if err != nil {
+		log.Printf("❌ Failed to load grants for user %d (tenant: %s), retrying shortly: %v", authSession.UserID, authSession.TenantName, err)
+		e.scheduleGrantRefresh(authSession.TenantName)
+		return &UserGrants{
+			UserID:      authSession.UserID,
+			Roles:       make(map[string]bool),
+			Permissions: make(map[string]bool),
+			Teams:       make(map[string]bool),
+			LoadedAt:    time.Now(),
+		}
+	}
+	return grants
+}
+
+// loadGrants loads the grants of a user from the tenant database
+func (e *RealtimeEngine) loadGrants(authSession *AuthenticatedSession) (*UserGrants, error) {
+	e.mutex.RLock()
+	tenantDB, exists := e.tenantDBs[authSession.TenantName]
+	e.mutex.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("tenant database connection not found for %s", authSession.TenantName)
+	}
+	return e.authorizer.LoadGrants(tenantDB, authSession)
+}
+
+// scheduleGrantRefresh reloads the grants of a tenant's sessions shortly after a permission table changed
+func (e *RealtimeEngine) scheduleGrantRefresh(tenantName string) {
+	e.grantMutex.Lock()
+	defer e.grantMutex.Unlock()
+
+	if _, pending := e.grantRefreshTimers[tenantName]; pending {
+		return
+	}
+	e.grantRefreshTimers[tenantName] = time.AfterFunc(grantRefreshDelay, func() {
+		e.grantMutex.Lock()
+		delete(e.grantRefreshTimers, tenantName)
+		e.grantMutex.Unlock()
+
+		e.refreshSessionGrants(tenantName)
+	})
+}
+
+// refreshSessionGrants reloads grants for the sessions of a tenant (all tenants when empty).
+// Sessions whose grants changed are asked to resync, since rows they may no longer see stay cached.
+// Sessions whose grants fail to load keep their previous grants and their tenant is refreshed again.
+func (e *RealtimeEngine) refreshSessionGrants(tenantName string) {
+	e.mutex.RLock()
+	type target struct {
+		wsSession   *WebSocketSession
+		authSession *AuthenticatedSession
+	}
+	var targets []target
+	for sessionID, wsSession := range e.sessions {
+		authSession, exists := e.authenticatedSessions[sessionID]
+		if !exists || (tenantName != "" && authSession.TenantName != tenantName) {
+			continue
+		}
+		targets = append(targets, target{wsSession, authSession})
+	}
+	e.mutex.RUnlock()
+
+	changed, failures := 0, 0
+	failed := make(map[string]bool)
+	for _, t := range targets {
+		grants, err := e.loadGrants(t.authSession)
+		if err != nil {
+			log.Printf("❌ Failed to refresh grants for user %d (tenant: %s), keeping the previous ones: %v",
+				t.authSession.UserID, t.authSession.TenantName, err)
+			failed[t.authSession.TenantName] = true
+			failures++
+			continue
+		}
+
+		t.wsSession.mutex.Lock()
+		previous := t.wsSession.grants
+		t.wsSession.grants = grants
+		t.wsSession.mutex.Unlock()
+
+		if previous == nil || previous.fingerprint() == grants.fingerprint() {
+			continue
+		}
+		changed++
+		e.sendMessage(t.wsSession, SystemMessage{
+			Type:      "system",
+			Operation: "resync_required",
+			Message:   "Your permissions changed - reload data from the server",
+			Data: map[string]interface{}{
+				"tenant_name": t.authSession.TenantName,
+				"reason":      "permissions_changed",
+			},
+			Timestamp: time.Now().Format(time.RFC3339),
+			SessionId: t.wsSession.ID,
+		})
+	}
+
+	if len(targets) > 0 {
+		log.Printf("🔐 Refreshed grants for %d session(s), %d changed, %d failed (tenant: %s)", len(targets), changed, failures, tenantName)
+	}
+	for failedTenant := range failed {
+		e.scheduleGrantRefresh(failedTenant)
+	}
+}
+
+// sessionGrants returns the grants currently attached to a session
+func (wsSession *WebSocketSession) sessionGrants() *UserGrants {
+	wsSession.mutex.Lock()
+	defer wsSession.mutex.Unlock()
+	return wsSession.grants
+}
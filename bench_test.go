@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// Fan-out benchmark shape: sessions served, and the transaction broadcast after each single change
+const (
+	benchSessions        = 10000
+	benchTransactionSize = 5
+	benchTenant          = "bench"
+)
+
+// BenchmarkFanout broadcasts a change and a transaction to in-process sessions using JSON, MessagePack
+// and CBOR (every 4th with compact updates). "shared" is the engine's fan-out, encoding each distinct
+// frame once; "per-session" encodes every frame again for each session, as before frames were shared.
+// No database or network is involved.
+func BenchmarkFanout(b *testing.B) {
+	// Per-session log lines would dominate the measurement
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	e, sessions := newBenchEngine(b, benchSessions)
+
+	for _, mode := range []struct {
+		name   string
+		fanout func(e *RealtimeEngine, change PublicationMessage, transaction []PublicationMessage)
+	}{{"per-session", perSessionFanout}, {"shared", sharedFanout}} {
+		b.Run(mode.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			frames := 0
+			seq := uint64(0)
+			for i := 0; i < b.N; i++ {
+				seq++
+				change := benchMessage(seq, 0)
+				transaction := make([]PublicationMessage, benchTransactionSize)
+				for j := range transaction {
+					seq++
+					transaction[j] = benchMessage(seq, uint64(i+1))
+				}
+				mode.fanout(e, change, transaction)
+
+				b.StopTimer()
+				frames += drainBenchSessions(sessions)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(frames)/b.Elapsed().Seconds(), "frames/s")
+		})
+	}
+}
+
+// sharedFanout delivers through the engine's broadcast functions
+func sharedFanout(e *RealtimeEngine, change PublicationMessage, transaction []PublicationMessage) {
+	e.broadcastChange(change, &changeImages{message: &change})
+	e.broadcastGroup(benchDeliveries(e, transaction), transactionEnvelope)
+}
+
+// perSessionFanout delivers each session's frames without sharing their encoding with other sessions
+func perSessionFanout(e *RealtimeEngine, change PublicationMessage, transaction []PublicationMessage) {
+	delivery := e.newChangeDelivery(change, &changeImages{message: &change})
+	deliveries := benchDeliveries(e, transaction)
+
+	for sessionID, wsSession := range e.sessions {
+		for _, d := range append([]*changeDelivery{delivery}, deliveries...) {
+			d.frames = make(map[frameKey]*sharedFrame)
+			d.shapes = make(map[frameKey]int)
+		}
+
+		authSession := e.authenticatedSessions[sessionID]
+		if _, err := e.deliverToSession(delivery, wsSession, authSession, nil); err != nil {
+			log.Printf("❌ Failed to queue publication for session %s: %v", sessionID, err)
+		}
+		if _, err := e.deliverGroup(deliveries, wsSession, authSession, nil, transactionEnvelope, nil); err != nil {
+			log.Printf("❌ Failed to queue grouped changes for session %s: %v", sessionID, err)
+		}
+	}
+}
+
+// benchDeliveries prepares the changes of a transaction for delivery
+func benchDeliveries(e *RealtimeEngine, transaction []PublicationMessage) []*changeDelivery {
+	deliveries := make([]*changeDelivery, len(transaction))
+	for i := range transaction {
+		deliveries[i] = e.newChangeDelivery(transaction[i], &changeImages{message: &transaction[i]})
+	}
+	return deliveries
+}
+
+// newBenchEngine builds an engine with authenticated admin sessions subscribed to every table
+func newBenchEngine(b *testing.B, sessionCount int) (*RealtimeEngine, []*WebSocketSession) {
+	b.Helper()
+
+	authorizer, err := newChangeAuthorizer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	e := &RealtimeEngine{
+		tenantDBs:             make(map[string]*sql.DB),
+		sessions:              make(map[string]*WebSocketSession),
+		authenticatedSessions: make(map[string]*AuthenticatedSession),
+		deliveryStats:         make(map[string]*tenantDeliveryStats),
+		histories:             make(map[string]*tenantHistory),
+		ackStates:             make(map[string]*ackState),
+		authorizer:            authorizer,
+	}
+
+	formats := []*wireFormat{jsonWire, msgpackWire, cborWire}
+	sessions := make([]*WebSocketSession, 0, sessionCount)
+	for i := 0; i < sessionCount; i++ {
+		sessionID := fmt.Sprintf("bench-%d", i)
+		wsSession := &WebSocketSession{
+			ID:       sessionID,
+			Tenant:   benchTenant,
+			UserID:   i + 1,
+			LastPing: time.Now(),
+			subscriptions: map[string]*Subscription{
+				"all": {ID: "all", Tables: map[string]bool{subscribeAllTables: true}, CreatedAt: time.Now()},
+			},
+			grants: &UserGrants{UserID: i + 1, Admin: true, LoadedAt: time.Now()},
+
+			compactUpdates:       i%4 == 0,
+			transactionEnvelopes: true,
+			format:               formats[i%len(formats)],
+		}
+		wsSession.newSessionQueue()
+		sessions = append(sessions, wsSession)
+
+		e.sessions[sessionID] = wsSession
+		e.authenticatedSessions[sessionID] = &AuthenticatedSession{
+			SessionID: sessionID, TenantName: benchTenant, UserID: i + 1, LastUsedAt: time.Now(),
+		}
+	}
+	return e, sessions
+}
+
+// drainBenchSessions empties the send queues the way writePump would and returns the frames sent
+func drainBenchSessions(sessions []*WebSocketSession) int {
+	frames := 0
+	for _, wsSession := range sessions {
+		for {
+			if _, ok := wsSession.queue.pop(); !ok {
+				break
+			}
+			frames++
+		}
+	}
+	return frames
+}
+
+// benchMessage builds a task UPDATE shaped like the ones bulk reordering produces
+func benchMessage(seq, txID uint64) PublicationMessage {
+	row := map[string]interface{}{
+		"id":           1000 + seq,
+		"name":         fmt.Sprintf("Inspect unit %d", seq),
+		"description":  "Check the fire extinguishers on every floor and report missing seals",
+		"workspace_id": 3,
+		"team_id":      7,
+		"status_id":    2,
+		"priority_id":  1,
+		"user_ids":     []int{12, 15},
+		"position":     seq,
+		"due_date":     "2024-06-12 17:00:00",
+		"created_at":   "2024-06-10 08:15:00.123",
+		"updated_at":   "2024-06-10 09:30:00.456",
+		"deleted_at":   nil,
+	}
+	newData, _ := json.Marshal(row)
+	row["position"] = seq + 1
+	row["updated_at"] = "2024-06-10 09:29:00.000"
+	oldData, _ := json.Marshal(row)
+
+	return PublicationMessage{
+		Type:        "database",
+		TenantName:  benchTenant,
+		Table:       "wh_tasks",
+		Operation:   "UPDATE",
+		NewData:     newData,
+		OldData:     oldData,
+		Message:     changeText("UPDATE", benchTenant, "wh_tasks"),
+		DBTimestamp: float64(time.Now().Unix()),
+		ClientTime:  time.Now().Format(time.RFC3339),
+		Seq:         seq,
+		TxID:        txID,
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// changeSourceNotify uses per-table triggers calling pg_notify on whagons_<table>_changes channels
+	changeSourceNotify = "notify"
+
+	// changeSourceReplication consumes a logical replication slot (pgoutput) per tenant database
+	changeSourceReplication = "replication"
+
+	// changeSourceOutbox drains the whagons_rte_outbox table written by tenant triggers
+	changeSourceOutbox = "outbox"
+
+	// listenerPingInterval is how often the notify listener pings its connection
+	listenerPingInterval = 90 * time.Second
+
+	// transactionIdleTimeout is how long the notify listener waits for more changes of an open transaction
+	transactionIdleTimeout = 50 * time.Millisecond
+)
+
+// ChangeSource streams row changes from a single tenant database into the publication pipeline.
+// Every implementation hands its changes to publishChange so downstream delivery is identical.
+type ChangeSource interface {
+	// Name returns the configuration name of the source (notify, replication, ...)
+	Name() string
+
+	// Run blocks while changes are streamed and returns when the source fails or stop is closed
+	Run(stop <-chan struct{}) error
+
+	// Resumable reports whether the source replays changes emitted while it was not running
+	Resumable() bool
+}
+
+// newChangeSource builds the change source configured for a tenant
+func (e *RealtimeEngine) newChangeSource(tenantName, dbName string) (ChangeSource, error) {
+	switch source := changeSourceForTenant(tenantName); source {
+	case changeSourceNotify:
+		return &notifyChangeSource{engine: e, tenantName: tenantName, dbName: dbName}, nil
+	case changeSourceReplication:
+		return &replicationChangeSource{engine: e, tenantName: tenantName, dbName: dbName}, nil
+	case changeSourceOutbox:
+		return &outboxChangeSource{engine: e, tenantName: tenantName, dbName: dbName}, nil
+	default:
+		return nil, fmt.Errorf("unknown change source %q for tenant %s", source, tenantName)
+	}
+}
+
+// notifyChangeSource listens to the whagons_<table>_changes channels fed by tenant triggers
+type notifyChangeSource struct {
+	engine     *RealtimeEngine
+	tenantName string
+	dbName     string
+	channels   map[string]bool // channels currently LISTENed to
+}
+
+// Name implements ChangeSource
+func (s *notifyChangeSource) Name() string {
+	return changeSourceNotify
+}
+
+// Resumable implements ChangeSource - pg_notify does not queue notifications for absent listeners
+func (s *notifyChangeSource) Resumable() bool {
+	return false
+}
+
+// Run implements ChangeSource
+func (s *notifyChangeSource) Run(stop <-chan struct{}) error {
+	e := s.engine
+	tenantName := s.tenantName
+
+	listener := pq.NewListener(
+		postgresConnString(s.dbName),
+		10*time.Second,
+		time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("❌ PostgreSQL listener error for %s: %v", tenantName, err)
+			}
+			if ev == pq.ListenerEventReconnected {
+				// Notifications sent while pq was reconnecting are gone
+				e.requestTenantResync(tenantName, "listener_reconnected")
+			}
+		})
+
+	defer listener.Close()
+
+	// Get a connection to the tenant database to query triggers
+	e.mutex.RLock()
+	tenantDB, exists := e.tenantDBs[tenantName]
+	e.mutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("tenant database connection not found for %s", tenantName)
+	}
+
+	// DDL changes (new wh_* tables, added or dropped triggers) arrive on a dedicated channel
+	if err := listener.Listen(ddlChannel); err != nil {
+		log.Printf("⚠️  Failed to listen to channel %s for tenant %s: %v", ddlChannel, tenantName, err)
+	}
+
+	s.channels = make(map[string]bool)
+	if err := s.refreshChannels(listener, tenantDB, false); err != nil {
+		return err
+	}
+
+	// Catalog diff for databases where the DDL event trigger could not be installed
+	refresh := time.NewTicker(getDurationEnv(config.ChannelRefreshInterval, time.Minute))
+	defer refresh.Stop()
+
+	// Ping to keep the connection alive, independent of how busy the other cases are
+	ping := time.NewTicker(listenerPingInterval)
+	defer ping.Stop()
+
+	// The notifications of one transaction can span batches, so the collected transaction is only
+	// delivered once a change of another transaction arrives or the listener goes quiet
+	idle := time.NewTimer(transactionIdleTimeout)
+	idle.Stop()
+	defer idle.Stop()
+	defer e.flushTransaction(tenantName)
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case notification := <-listener.Notify:
+			if notification == nil {
+				continue
+			}
+
+			// Drain whatever is already queued so reference payloads are resolved in one query per table
+			batch := []*pq.Notification{notification}
+		drain:
+			for len(batch) < notifyBatchSize {
+				select {
+				case next := <-listener.Notify:
+					if next != nil {
+						batch = append(batch, next)
+					}
+				default:
+					break drain
+				}
+			}
+
+			changes := batch[:0]
+			ddlChanged := false
+			for _, n := range batch {
+				if n.Channel == ddlChannel {
+					ddlChanged = true
+					continue
+				}
+				changes = append(changes, n)
+			}
+			if len(changes) > 0 {
+				e.handlePublicationNotifications(tenantName, tenantDB, changes)
+				idle.Reset(transactionIdleTimeout)
+			}
+			if ddlChanged {
+				if err := s.refreshChannels(listener, tenantDB, true); err != nil {
+					log.Printf("⚠️  Failed to refresh channels for tenant %s: %v", tenantName, err)
+				}
+			}
+		case <-idle.C:
+			e.flushTransaction(tenantName)
+		case <-refresh.C:
+			if err := s.refreshChannels(listener, tenantDB, false); err != nil {
+				log.Printf("⚠️  Failed to refresh channels for tenant %s: %v", tenantName, err)
+			}
+		case <-ping.C:
+			if err := listener.Ping(); err != nil {
+				return fmt.Errorf("ping failed for tenant %s: %w", tenantName, err)
+			}
+		}
+	}
+}
+
+// refreshChannels diffs the discovered change channels against the current LISTEN set and
+// subscribes or unsubscribes on the fly. After DDL, new tables get their trigger installed first.
+func (s *notifyChangeSource) refreshChannels(listener *pq.Listener, tenantDB *sql.DB, afterDDL bool) error {
+	if afterDDL && getBoolEnv(config.TriggerAutoInstall, true) {
+		if _, err := s.engine.syncTenantTriggers(s.tenantName, tenantDB, true); err != nil {
+			log.Printf("⚠️  Failed to sync change triggers for tenant %s: %v", s.tenantName, err)
+		}
+		if err := s.engine.installMissingRowHashes(s.tenantName, tenantDB); err != nil {
+			log.Printf("⚠️  Failed to sync row hashes for tenant %s: %v", s.tenantName, err)
+		}
+		if err := s.engine.installMissingTombstones(s.tenantName, tenantDB); err != nil {
+			log.Printf("⚠️  Failed to sync tombstone triggers for tenant %s: %v", s.tenantName, err)
+		}
+	}
+
+	channels, err := discoverNotifyChannels(tenantDB)
+	if err != nil {
+		return fmt.Errorf("failed to query triggers for tenant %s: %w", s.tenantName, err)
+	}
+
+	wanted := make(map[string]bool, len(channels))
+	for _, channelName := range channels {
+		wanted[channelName] = true
+		if s.channels[channelName] {
+			continue
+		}
+		if err := listener.Listen(channelName); err != nil {
+			log.Printf("⚠️  Failed to listen to channel %s for tenant %s: %v", channelName, s.tenantName, err)
+			continue
+		}
+		s.channels[channelName] = true
+		log.Printf("✅ Listening to channel '%s' for tenant: %s", channelName, s.tenantName)
+	}
+
+	for channelName := range s.channels {
+		if wanted[channelName] {
+			continue
+		}
+		if err := listener.Unlisten(channelName); err != nil {
+			log.Printf("⚠️  Failed to unlisten channel %s for tenant %s: %v", channelName, s.tenantName, err)
+			continue
+		}
+		delete(s.channels, channelName)
+		log.Printf("🔕 Stopped listening to channel '%s' for tenant: %s", channelName, s.tenantName)
+	}
+
+	if len(s.channels) == 0 {
+		log.Printf("⚠️  No triggers found for tenant %s - waiting for change triggers to be added", s.tenantName)
+	}
+
+	current := make([]string, 0, len(s.channels))
+	for channelName := range s.channels {
+		current = append(current, channelName)
+	}
+	sort.Strings(current)
+	s.engine.recordListenerChannels(s.tenantName, current)
+	return nil
+}
+
+// discoverNotifyChannels returns the whagons_<table>_changes channels of every *_changes_trigger.
+// This dynamically finds all tables (wh_* and Spatie permission tables) with triggers
+func discoverNotifyChannels(db *sql.DB) ([]string, error) {
+	query := `
+		SELECT DISTINCT
+			REPLACE(tgname, '_changes_trigger', '') as table_name
+		FROM pg_trigger
+		WHERE tgname LIKE '%_changes_trigger'
+		AND tgisinternal = false
+		ORDER BY table_name
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []string
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			log.Printf("⚠️  Error scanning trigger row: %v", err)
+			continue
+		}
+		channels = append(channels, fmt.Sprintf("whagons_%s_changes", tableName))
+	}
+	return channels, rows.Err()
+}
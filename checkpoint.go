@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// setupCheckpointStore creates the landlord table holding the last delivered position of each tenant change source
+func (e *RealtimeEngine) setupCheckpointStore() error {
+	createTableSQL := `
+		CREATE TABLE IF NOT EXISTS whagons_rte_checkpoints (
+			tenant_name TEXT NOT NULL,
+			source      TEXT NOT NULL,
+			position    TEXT NOT NULL,
+			updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (tenant_name, source)
+		);`
+
+	if _, err := e.landlordDB.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("failed to create checkpoint table: %w", err)
+	}
+
+	log.Println("✅ Checkpoint store ready")
+	return nil
+}
+
+// loadCheckpoint returns the last persisted position for a tenant change source ("" when none)
+func (e *RealtimeEngine) loadCheckpoint(tenantName, source string) (string, error) {
+	if e.landlordDB == nil {
+		return "", fmt.Errorf("landlord database not connected")
+	}
+
+	var position string
+	err := e.landlordDB.QueryRow(
+		`SELECT position FROM whagons_rte_checkpoints WHERE tenant_name = $1 AND source = $2`,
+		tenantName, source).Scan(&position)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load checkpoint for tenant %s: %w", tenantName, err)
+	}
+	return position, nil
+}
+
+// saveCheckpoint persists the last delivered position for a tenant change source
+func (e *RealtimeEngine) saveCheckpoint(tenantName, source, position string) error {
+	if e.landlordDB == nil {
+		return fmt.Errorf("landlord database not connected")
+	}
+
+	_, err := e.landlordDB.Exec(`
+		INSERT INTO whagons_rte_checkpoints (tenant_name, source, position, updated_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (tenant_name, source)
+		DO UPDATE SET position = EXCLUDED.position, updated_at = EXCLUDED.updated_at`,
+		tenantName, source, position)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint for tenant %s: %w", tenantName, err)
+	}
+
+	e.recordListenerPosition(tenantName, position)
+	return nil
+}
+
+// parseLSN converts a PostgreSQL LSN in X/Y text form to a comparable integer
+func parseLSN(lsn string) (uint64, error) {
+	high, low, found := strings.Cut(lsn, "/")
+	if !found {
+		return 0, fmt.Errorf("invalid LSN %q", lsn)
+	}
+	hi, err := strconv.ParseUint(high, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", lsn, err)
+	}
+	lo, err := strconv.ParseUint(low, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", lsn, err)
+	}
+	return hi<<32 | lo, nil
+}
+
+// formatLSN converts an integer LSN back to the PostgreSQL X/Y text form
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn))
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// maxChecksumBuckets caps the number of buckets returned by a single checksum request
+const maxChecksumBuckets = 10000
+
+// Where a checksum was computed from
+const (
+	checksumSourceRows    = "rows"    // every visible row hashed under the snapshot
+	checksumSourceBuckets = "buckets" // rolling bucket hashes kept by the row hash triggers
+)
+
+// rowDigest is the MD5 hash of a row. Digests of a set of rows are combined with XOR, which does not
+// depend on row order and lets a bucket be updated in place when one of its rows changes.
+type rowDigest [md5.Size]byte
+
+// xor folds another digest into d
+func (d *rowDigest) xor(other rowDigest) {
+	for i := range d {
+		d[i] ^= other[i]
+	}
+}
+
+// String returns the digest in hex
+func (d rowDigest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// hashRow returns the digest of a decoded row: the MD5 of its PostgreSQL jsonb text form
+// (to_jsonb(row)::text), which clients reproduce from the rows they received
+func hashRow(row map[string]interface{}) rowDigest {
+	var buf bytes.Buffer
+	writeJSONBText(&buf, row)
+	return md5.Sum(buf.Bytes())
+}
+
+// writeJSONBText writes a decoded JSON value the way PostgreSQL prints jsonb: object keys ordered by
+// length then bytes, ", " and ": " separators, numbers as received and non-ASCII text unescaped
+func writeJSONBText(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if v {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case json.Number:
+		buf.WriteString(v.String())
+	case float64:
+		buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case string:
+		writeJSONBString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeJSONBText(buf, item)
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeJSONBString(buf, key)
+			buf.WriteString(": ")
+			writeJSONBText(buf, v[key])
+		}
+		buf.WriteByte('}')
+	}
+}
+
+// writeJSONBString writes a string with the escapes of PostgreSQL's escape_json
+func writeJSONBString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		switch {
+		case r == '"':
+			buf.WriteString(`\"`)
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < 0x20:
+			fmt.Fprintf(buf, `\u%04x`, r)
+		default:
+			buf.WriteString(s[:size])
+		}
+		s = s[size:]
+	}
+	buf.WriteByte('"')
+}
+
+// ChecksumRequest asks for the checksum of a table, optionally split into id-range buckets
+type ChecksumRequest struct {
+	RequestID  string `json:"request_id,omitempty"`
+	Table      string `json:"table"`
+	Filter     string `json:"filter,omitempty"`
+	BucketSize int64  `json:"bucket_size,omitempty"`
+	FromID     *int64 `json:"from_id,omitempty"`
+	ToID       *int64 `json:"to_id,omitempty"` // exclusive
+}
+
+// BucketChecksum is the checksum of the rows whose id is in [FromID, ToID)
+type BucketChecksum struct {
+	Bucket   int64  `json:"bucket"`
+	FromID   int64  `json:"from_id"`
+	ToID     int64  `json:"to_id"`
+	Count    int    `json:"count"`
+	Checksum string `json:"checksum"`
+}
+
+// ChecksumResult is the checksum of the rows of a table visible to the caller, read from one snapshot
+type ChecksumResult struct {
+	RequestID   string           `json:"request_id,omitempty"`
+	Table       string           `json:"table"`
+	Source      string           `json:"source"`
+	Count       int              `json:"count"`
+	Checksum    string           `json:"checksum"`
+	Buckets     []BucketChecksum `json:"buckets,omitempty"`
+	LastRowID   string           `json:"last_row_id,omitempty"`
+	LastUpdated string           `json:"last_updated,omitempty"`
+	Seq         uint64           `json:"seq"`
+	Cursor      string           `json:"snapshot_cursor"`
+	LSN         string           `json:"lsn,omitempty"`
+}
+
+// floorDiv divides rounding towards negative infinity so negative ids fall into their own buckets
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// tableChecksum hashes every row of a table visible to the caller under a REPEATABLE READ snapshot.
+// Rows go through the same authorization, redaction and filter as snapshots, so the checksum matches
+// what the client was sent.
+func (e *RealtimeEngine) tableChecksum(authSession *AuthenticatedSession, grants *UserGrants, request ChecksumRequest) (*ChecksumResult, error) {
+	filter, _, err := e.checkSyncTable(grants, request.Table, request.Filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	if request.BucketSize < 0 {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_request", "bucket_size must be positive")
+	}
+
+	syncTx, err := e.beginSyncTransaction(authSession.TenantName)
+	if err != nil {
+		return nil, err
+	}
+	defer syncTx.tx.Rollback()
+
+	started := time.Now()
+	result, err := e.checksumInTx(syncTx, authSession, grants, filter, request)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("🧮 Checksum of %s.%s for user %d from %s: %d rows, %d buckets in %v",
+		authSession.TenantName, request.Table, authSession.UserID, result.Source, result.Count, len(result.Buckets), time.Since(started).Round(time.Millisecond))
+	return result, nil
+}
+
+// checksumInTx computes a checksum inside an open sync transaction
+func (e *RealtimeEngine) checksumInTx(syncTx *syncTransaction, authSession *AuthenticatedSession, grants *UserGrants, filter *rowFilter, request ChecksumRequest) (*ChecksumResult, error) {
+	redaction := e.redactionFor(request.Table)
+	result := &ChecksumResult{
+		RequestID: request.RequestID,
+		Table:     request.Table,
+		Source:    checksumSourceRows,
+		Seq:       syncTx.seq,
+		Cursor:    syncTx.cursor(),
+		LSN:       syncTx.lsn,
+	}
+
+	// Callers seeing whole rows are answered from the bucket hashes kept by the row hash triggers
+	if e.rowHashesCover(grants, request, redaction) {
+		found, err := checksumFromBuckets(syncTx.tx, request, result)
+		if syncErr, ok := err.(*syncError); ok {
+			return nil, syncErr
+		} else if err != nil {
+			return nil, newSyncError(http.StatusInternalServerError, "checksum_failed", "Failed to read row hashes of %s: %v", request.Table, err)
+		}
+		if found {
+			result.Source = checksumSourceBuckets
+			return result, nil
+		}
+	}
+
+	// PostgreSQL hashes the jsonb text of the row as the caller receives it: hidden columns removed, masked ones replaced
+	hidden, masked := []string{}, []string{} // a NULL array would null every hash
+	if redaction != nil {
+		hidden = append(hidden, redaction.hiddenColumns(authSession)...)
+		for column := range redaction.drop {
+			hidden = append(hidden, column)
+		}
+		for column := range redaction.mask {
+			masked = append(masked, column)
+		}
+	}
+	args := []interface{}{pq.Array(hidden), pq.Array(masked), redactionMaskValue}
+	query := fmt.Sprintf(`
+		SELECT row_to_json(t)::text, t.id::text,
+			md5((v.image || (
+				SELECT COALESCE(jsonb_object_agg(m.key, to_jsonb($3::text)), '{}'::jsonb)
+				FROM jsonb_each(v.image) m
+				WHERE m.key = ANY($2::text[]) AND m.value <> 'null'::jsonb
+			))::text)
+		FROM %s t, LATERAL (SELECT to_jsonb(t) - $1::text[] AS image) v`, pq.QuoteIdentifier(request.Table))
+	var conditions []string
+	if request.FromID != nil {
+		args = append(args, *request.FromID)
+		conditions = append(conditions, fmt.Sprintf("t.id >= $%d", len(args)))
+	}
+	if request.ToID != nil {
+		args = append(args, *request.ToID)
+		conditions = append(conditions, fmt.Sprintf("t.id < $%d", len(args)))
+	}
+	for i, condition := range conditions {
+		if i == 0 {
+			query += " WHERE " + condition
+		} else {
+			query += " AND " + condition
+		}
+	}
+
+	rows, err := syncTx.tx.Query(query, args...)
+	if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code == "42P01" || pqErr.Code == "42703" || pqErr.Code == "42883") {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_table", "Table %s does not exist or has no comparable id column", request.Table)
+	} else if err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "checksum_failed", "Failed to read %s: %v", request.Table, err)
+	}
+	defer rows.Close()
+
+	var total rowDigest
+	buckets := make(map[int64]*BucketChecksum)
+	bucketDigests := make(map[int64]*rowDigest)
+
+	for rows.Next() {
+		var raw, id, hash string
+		if err := rows.Scan(&raw, &id, &hash); err != nil {
+			return nil, newSyncError(http.StatusInternalServerError, "checksum_failed", "Failed to read %s: %v", request.Table, err)
+		}
+		visibleRow, visible := e.syncRowForSession(authSession, grants, request.Table, redaction, filter, json.RawMessage(raw))
+		if !visible {
+			continue
+		}
+		var digest rowDigest
+		if _, err := hex.Decode(digest[:], []byte(hash)); err != nil {
+			return nil, newSyncError(http.StatusInternalServerError, "checksum_failed", "Invalid row hash %q in %s: %v", hash, request.Table, err)
+		}
+		total.xor(digest)
+		result.Count++
+
+		row := decodeRowImage(visibleRow)
+		if updatedAt, ok := row["updated_at"].(string); ok && (updatedAt > result.LastUpdated || (updatedAt == result.LastUpdated && rowIDAfter(id, result.LastRowID))) {
+			result.LastUpdated, result.LastRowID = updatedAt, id
+		}
+
+		if request.BucketSize == 0 {
+			continue
+		}
+		numericID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, newSyncError(http.StatusBadRequest, "invalid_request", "Buckets need integer ids, %s has id %q", request.Table, id)
+		}
+		index := floorDiv(numericID, request.BucketSize)
+		bucket, exists := buckets[index]
+		if !exists {
+			if len(buckets) >= maxChecksumBuckets {
+				return nil, newSyncError(http.StatusBadRequest, "too_many_buckets", "More than %d buckets - use a larger bucket_size or an id range", maxChecksumBuckets)
+			}
+			bucket = &BucketChecksum{Bucket: index, FromID: index * request.BucketSize, ToID: (index + 1) * request.BucketSize}
+			buckets[index] = bucket
+			bucketDigests[index] = &rowDigest{}
+		}
+		bucket.Count++
+		bucketDigests[index].xor(digest)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "checksum_failed", "Failed to read %s: %v", request.Table, err)
+	}
+
+	result.Checksum = total.String()
+	result.Buckets = collectBuckets(request.BucketSize, buckets, bucketDigests)
+	return result, nil
+}
+
+// rowIDAfter reports whether a row id sorts after another, numerically when both are integers
+func rowIDAfter(id, other string) bool {
+	numericID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return id > other
+	}
+	numericOther, err := strconv.ParseInt(other, 10, 64)
+	if err != nil {
+		return id > other
+	}
+	return numericID > numericOther
+}
+
+// collectBuckets returns the buckets in id order with their checksums filled in, or nil without bucketing
+func collectBuckets(bucketSize int64, buckets map[int64]*BucketChecksum, digests map[int64]*rowDigest) []BucketChecksum {
+	if bucketSize == 0 {
+		return nil
+	}
+	result := make([]BucketChecksum, 0, len(buckets))
+	for index, bucket := range buckets {
+		bucket.Checksum = digests[index].String()
+		result = append(result, *bucket)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Bucket < result[j].Bucket })
+	return result
+}
+
+// rowHashesCover reports whether the stored row hashes describe exactly what the caller sees: whole,
+// unredacted rows without a filter, in ranges aligned to the stored buckets
+func (e *RealtimeEngine) rowHashesCover(grants *UserGrants, request ChecksumRequest, redaction *tableRedaction) bool {
+	if !getBoolEnv(config.RowHashes, false) || request.Filter != "" || redaction != nil {
+		return false
+	}
+	if !e.authorizer.CanReadAllRows(grants, request.Table) {
+		return false
+	}
+	if request.BucketSize%rowHashBucketSize != 0 {
+		return false
+	}
+	for _, id := range []*int64{request.FromID, request.ToID} {
+		if id != nil && *id%rowHashBucketSize != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SyncChecksum serves a table checksum over HTTP (implements SyncEngineInterface)
+func (e *RealtimeEngine) SyncChecksum(authorization, token, domain string, body []byte) (interface{}, error) {
+	var request ChecksumRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_request", "Invalid JSON request body")
+	}
+
+	authSession, grants, err := e.authenticateSyncRequest(authorization, token, domain)
+	if err != nil {
+		return nil, err
+	}
+	return e.tableChecksum(authSession, grants, request)
+}
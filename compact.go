@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Values of the updates connection parameter
+const (
+	updatesFull    = "full"    // UPDATEs carry new_data and old_data (default)
+	updatesCompact = "compact" // UPDATEs carry the id and the changed columns in new_data
+)
+
+// updatesMode names the UPDATE format of a session
+func updatesMode(compact bool) string {
+	if compact {
+		return updatesCompact
+	}
+	return updatesFull
+}
+
+// compactUpdate returns the id and changed columns of the variant's UPDATE, computed once per variant
+func (variant *messageVariant) compactUpdate() json.RawMessage {
+	if !variant.compacted {
+		variant.compacted = true
+		variant.compactNew = diffRowImages(variant.message.NewData, variant.message.OldData)
+	}
+	return variant.compactNew
+}
+
+// diffRowImages returns the id and the columns of newImage whose value differs from oldImage. Images
+// without an old row (e.g. REPLICA IDENTITY DEFAULT) or an id cannot be compared and return nil.
+func diffRowImages(newImage, oldImage json.RawMessage) json.RawMessage {
+	if len(newImage) == 0 || len(oldImage) == 0 || string(oldImage) == "null" {
+		return nil
+	}
+
+	var newRow, oldRow map[string]json.RawMessage
+	if err := json.Unmarshal(newImage, &newRow); err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(oldImage, &oldRow); err != nil {
+		return nil
+	}
+	id, exists := newRow["id"]
+	if !exists {
+		return nil
+	}
+
+	changed := map[string]json.RawMessage{"id": id}
+	for column, value := range newRow {
+		if previous, existed := oldRow[column]; !existed || !bytes.Equal(previous, value) {
+			changed[column] = value
+		}
+	}
+
+	diff, err := json.Marshal(changed)
+	if err != nil {
+		return nil
+	}
+	return diff
+}
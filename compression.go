@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultCompressionMinBytes is the frame size below which deflating costs more than it saves
+const defaultCompressionMinBytes = 512
+
+// compressionMinBytesForTenant returns the size from which frames to a tenant's sessions are deflated.
+// TENANT_COMPRESSION_MIN_BYTES overrides COMPRESSION_MIN_BYTES with tenant=bytes pairs.
+func compressionMinBytesForTenant(tenantName string) int {
+	value := config.CompressionMinBytes
+	if override, found := tenantOverride(config.TenantCompressionMinBytes, tenantName); found {
+		value = override
+	}
+	if value == "" {
+		return defaultCompressionMinBytes
+	}
+	minBytes, err := strconv.Atoi(value)
+	if err != nil || minBytes < 0 {
+		log.Printf("⚠️  Invalid compression threshold %q for tenant %s, using %d", value, tenantName, defaultCompressionMinBytes)
+		return defaultCompressionMinBytes
+	}
+	return minBytes
+}
+
+// offersDeflate reports whether a client offered permessage-deflate in its handshake
+func offersDeflate(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sharedFrame is an encoded frame written to several sessions. prepared lets them share the deflated bytes.
+type sharedFrame struct {
+	data     []byte
+	prepared *websocket.PreparedMessage
+}
+
+// newSharedFrame prepares an encoded frame for writing to several sessions
+func newSharedFrame(messageType int, data []byte) *sharedFrame {
+	frame := &sharedFrame{data: data}
+	if getBoolEnv(config.SharedCompression, true) {
+		prepared, err := websocket.NewPreparedMessage(messageType, data)
+		if err != nil {
+			log.Printf("⚠️  Failed to prepare shared frame, writing it per session: %v", err)
+		} else {
+			frame.prepared = prepared
+		}
+	}
+	return frame
+}
+
+// countingConn counts the bytes written to a session's connection, after compression.
+// The upgrade handshake and then writePump write to it, except for the close reply gorilla sends
+// from readPump, which may be counted towards the frame being written at the time.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter hands the WebSocket upgrader a connection that counts written bytes
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	netConn, readWriter, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &countingConn{Conn: netConn}
+	return w.conn, readWriter, nil
+}
+
+// writeFrame writes a queued frame, deflating data frames from the session's size threshold on
+func (wsSession *WebSocketSession) writeFrame(frame outboundFrame) error {
+	if frame.messageType == websocket.CloseMessage {
+		return wsSession.Conn.WriteMessage(frame.messageType, frame.data)
+	}
+
+	compress := wsSession.compression && len(frame.data) >= wsSession.compressMin
+	wsSession.Conn.EnableWriteCompression(compress)
+
+	var before int64
+	if wsSession.wire != nil {
+		before = wsSession.wire.written.Load()
+	}
+
+	var err error
+	if frame.prepared != nil {
+		err = wsSession.Conn.WritePreparedMessage(frame.prepared)
+	} else {
+		err = wsSession.Conn.WriteMessage(frame.messageType, frame.data)
+	}
+	if err != nil {
+		return err
+	}
+
+	wsSession.frameBytes.Add(int64(len(frame.data)))
+	if wsSession.wire != nil {
+		wsSession.wireBytes.Add(wsSession.wire.written.Load() - before)
+	}
+	if compress {
+		wsSession.compressedFrames.Add(1)
+	}
+	return nil
+}
+
+// recordCompressionStats moves the byte counters of a finished session into its tenant's totals
+func (e *RealtimeEngine) recordCompressionStats(wsSession *WebSocketSession) {
+	frameBytes := wsSession.frameBytes.Swap(0)
+	wireBytes := wsSession.wireBytes.Swap(0)
+	compressedFrames := wsSession.compressedFrames.Swap(0)
+	e.recordDeliveryEvent(wsSession.Tenant, func(stats *tenantDeliveryStats) {
+		stats.frameBytes += frameBytes
+		stats.wireBytes += wireBytes
+		stats.compressedFrames += compressedFrames
+	})
+}
+
+// compressionRatio is the share of frame bytes left after compression, 1 when nothing was sent
+func compressionRatio(frameBytes, wireBytes int64) float64 {
+	if frameBytes == 0 {
+		return 1
+	}
+	return float64(wireBytes) / float64(frameBytes)
+}
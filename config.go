@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -20,6 +22,79 @@ type Config struct {
 	DBPassword string `json:"db_password"`
 	DBLandlord string `json:"db_landlord"`
 	ServerPort string `json:"server_port"`
+
+	// Change source selection ("notify", "replication" or "outbox"), with optional per-tenant overrides
+	ChangeSource            string `json:"change_source,omitempty"`
+	TenantChangeSources     string `json:"tenant_change_sources,omitempty"`
+	ReplicationPollInterval string `json:"replication_poll_interval,omitempty"`
+
+	// Tables whose triggers only notify {table, operation, id} (comma separated)
+	ReferencePayloadTables string `json:"reference_payload_tables,omitempty"`
+
+	// How long delivered outbox rows are kept before pruning
+	OutboxRetention string `json:"outbox_retention,omitempty"`
+
+	// Engine-owned change triggers: auto install/upgrade and table glob patterns (comma separated)
+	TriggerAutoInstall string `json:"trigger_auto_install,omitempty"`
+	TriggerInclude     string `json:"trigger_include,omitempty"`
+	TriggerExclude     string `json:"trigger_exclude,omitempty"`
+
+	// Fallback catalog diff interval for channel discovery when DDL event triggers are unavailable
+	ChannelRefreshInterval string `json:"channel_refresh_interval,omitempty"`
+
+	// Per-user authorization ("permissions" or "tenant"), rule file, admin roles and grant reload interval
+	AuthorizationMode            string `json:"authorization_mode,omitempty"`
+	AuthorizationRulesFile       string `json:"authorization_rules_file,omitempty"`
+	AuthorizationAdminRoles      string `json:"authorization_admin_roles,omitempty"`
+	AuthorizationRefreshInterval string `json:"authorization_refresh_interval,omitempty"`
+
+	// Column redaction rules file and landlord rule reload interval
+	RedactionRulesFile       string `json:"redaction_rules_file,omitempty"`
+	RedactionRefreshInterval string `json:"redaction_refresh_interval,omitempty"`
+
+	// Per-session send queue size and slow-consumer policy, with optional per-tenant overrides
+	SendQueueSize              string `json:"send_queue_size,omitempty"`
+	SlowConsumerPolicy         string `json:"slow_consumer_policy,omitempty"`
+	TenantSlowConsumerPolicies string `json:"tenant_slow_consumer_policies,omitempty"`
+
+	// Changes retained per tenant for resuming clients, optionally persisted under HistoryDir
+	HistorySize string `json:"history_size,omitempty"`
+	HistoryDir  string `json:"history_dir,omitempty"`
+
+	// At-least-once delivery for clients connecting with ack=true
+	AckTables     string `json:"ack_tables,omitempty"`
+	AckTimeout    string `json:"ack_timeout,omitempty"`
+	AckMaxPending string `json:"ack_max_pending,omitempty"`
+	AckStateTTL   string `json:"ack_state_ttl,omitempty"`
+
+	// Table snapshots: default page size, concurrently open snapshot transactions and idle timeout
+	SnapshotPageSize string `json:"snapshot_page_size,omitempty"`
+	SnapshotMaxOpen  string `json:"snapshot_max_open,omitempty"`
+	SnapshotTTL      string `json:"snapshot_ttl,omitempty"`
+
+	// How long deleted rows are remembered for delta sync
+	TombstoneRetention string `json:"tombstone_retention,omitempty"`
+
+	// Row hashes maintained by triggers in tenant databases and sent with every change (opt-in:
+	// the first install locks and backfills every managed table)
+	RowHashes string `json:"row_hashes,omitempty"`
+
+	// Group the changes of one database transaction into a single message
+	TransactionEnvelopes string `json:"transaction_envelopes,omitempty"`
+
+	// Bucket reconciliation: children per split bucket and the row count below which a bucket is patched
+	ReconcileFanout   string `json:"reconcile_fanout,omitempty"`
+	ReconcileLeafRows string `json:"reconcile_leaf_rows,omitempty"`
+
+	// Per-table debounce windows (table=duration pairs) collapsing changes of the same row
+	DebounceTables string `json:"debounce_tables,omitempty"`
+
+	// permessage-deflate: level, frame size threshold (with per-tenant overrides) and shared deflating of broadcast frames
+	Compression               string `json:"compression,omitempty"`
+	CompressionLevel          string `json:"compression_level,omitempty"`
+	CompressionMinBytes       string `json:"compression_min_bytes,omitempty"`
+	TenantCompressionMinBytes string `json:"tenant_compression_min_bytes,omitempty"`
+	SharedCompression         string `json:"shared_compression,omitempty"`
 }
 
 var config Config
@@ -27,7 +102,8 @@ var setupMode bool
 
 const configFileName = ".whagons-config.json"
 
-func init() {
+// initConfig parses the command line and loads the configuration; main calls it before anything reads config
+func initConfig() {
 	// Parse command line flags
 	flag.BoolVar(&setupMode, "setup", false, "Run interactive setup to configure all variables")
 	flag.Parse()
@@ -82,6 +158,57 @@ func loadConfiguration() {
 		DBPassword: getEnv("DB_PASSWORD", ""),
 		DBLandlord: getEnv("DB_LANDLORD", "landlord"),
 		ServerPort: getEnv("SERVER_PORT", "8082"),
+
+		ChangeSource:            getEnv("CHANGE_SOURCE", changeSourceNotify),
+		TenantChangeSources:     getEnv("TENANT_CHANGE_SOURCES", ""),
+		ReplicationPollInterval: getEnv("REPLICATION_POLL_INTERVAL", "1s"),
+		ReferencePayloadTables:  getEnv("REFERENCE_PAYLOAD_TABLES", ""),
+		OutboxRetention:         getEnv("OUTBOX_RETENTION", "24h"),
+		TriggerAutoInstall:      getEnv("TRIGGER_AUTO_INSTALL", "true"),
+		TriggerInclude:          getEnv("TRIGGER_INCLUDE", "wh_*"),
+		TriggerExclude:          getEnv("TRIGGER_EXCLUDE", ""),
+		ChannelRefreshInterval:  getEnv("CHANNEL_REFRESH_INTERVAL", "1m"),
+
+		AuthorizationMode:            getEnv("AUTHORIZATION_MODE", authorizationModePermissions),
+		AuthorizationRulesFile:       getEnv("AUTHORIZATION_RULES_FILE", ""),
+		AuthorizationAdminRoles:      getEnv("AUTHORIZATION_ADMIN_ROLES", "admin,super-admin"),
+		AuthorizationRefreshInterval: getEnv("AUTHORIZATION_REFRESH_INTERVAL", "5m"),
+
+		RedactionRulesFile:       getEnv("REDACTION_RULES_FILE", ""),
+		RedactionRefreshInterval: getEnv("REDACTION_REFRESH_INTERVAL", "1m"),
+
+		SendQueueSize:              getEnv("SEND_QUEUE_SIZE", "256"),
+		SlowConsumerPolicy:         getEnv("SLOW_CONSUMER_POLICY", slowConsumerDisconnect),
+		TenantSlowConsumerPolicies: getEnv("TENANT_SLOW_CONSUMER_POLICIES", ""),
+
+		HistorySize: getEnv("HISTORY_SIZE", "1000"),
+		HistoryDir:  getEnv("HISTORY_DIR", ""),
+
+		AckTables:     getEnv("ACK_TABLES", "wh_tasks,wh_approvals"),
+		AckTimeout:    getEnv("ACK_TIMEOUT", "10s"),
+		AckMaxPending: getEnv("ACK_MAX_PENDING", "1000"),
+		AckStateTTL:   getEnv("ACK_STATE_TTL", "10m"),
+
+		SnapshotPageSize: getEnv("SNAPSHOT_PAGE_SIZE", "500"),
+		SnapshotMaxOpen:  getEnv("SNAPSHOT_MAX_OPEN", "32"),
+		SnapshotTTL:      getEnv("SNAPSHOT_TTL", "1m"),
+
+		TombstoneRetention: getEnv("TOMBSTONE_RETENTION", "720h"),
+
+		RowHashes: getEnv("ROW_HASHES", "false"),
+
+		TransactionEnvelopes: getEnv("TRANSACTION_ENVELOPES", "true"),
+
+		ReconcileFanout:   getEnv("RECONCILE_FANOUT", "10"),
+		ReconcileLeafRows: getEnv("RECONCILE_LEAF_ROWS", "100"),
+
+		DebounceTables: getEnv("DEBOUNCE_TABLES", ""),
+
+		Compression:               getEnv("COMPRESSION", "true"),
+		CompressionLevel:          getEnv("COMPRESSION_LEVEL", "1"),
+		CompressionMinBytes:       getEnv("COMPRESSION_MIN_BYTES", "512"),
+		TenantCompressionMinBytes: getEnv("TENANT_COMPRESSION_MIN_BYTES", ""),
+		SharedCompression:         getEnv("SHARED_COMPRESSION", "true"),
 	}
 
 	// Final validation
@@ -190,24 +317,50 @@ func loadFromConfigFile() bool {
 	}
 
 	// Set environment variables from config file so getEnv() works
-	if fileConfig.DBHost != "" {
-		os.Setenv("DB_HOST", fileConfig.DBHost)
-	}
-	if fileConfig.DBPort != "" {
-		os.Setenv("DB_PORT", fileConfig.DBPort)
-	}
-	if fileConfig.DBUsername != "" {
-		os.Setenv("DB_USERNAME", fileConfig.DBUsername)
-	}
-	if fileConfig.DBPassword != "" {
-		os.Setenv("DB_PASSWORD", fileConfig.DBPassword)
-	}
-	if fileConfig.DBLandlord != "" {
-		os.Setenv("DB_LANDLORD", fileConfig.DBLandlord)
-	}
-	if fileConfig.ServerPort != "" {
-		os.Setenv("SERVER_PORT", fileConfig.ServerPort)
-	}
+	setEnvFromFile("DB_HOST", fileConfig.DBHost)
+	setEnvFromFile("DB_PORT", fileConfig.DBPort)
+	setEnvFromFile("DB_USERNAME", fileConfig.DBUsername)
+	setEnvFromFile("DB_PASSWORD", fileConfig.DBPassword)
+	setEnvFromFile("DB_LANDLORD", fileConfig.DBLandlord)
+	setEnvFromFile("SERVER_PORT", fileConfig.ServerPort)
+	setEnvFromFile("CHANGE_SOURCE", fileConfig.ChangeSource)
+	setEnvFromFile("TENANT_CHANGE_SOURCES", fileConfig.TenantChangeSources)
+	setEnvFromFile("REPLICATION_POLL_INTERVAL", fileConfig.ReplicationPollInterval)
+	setEnvFromFile("REFERENCE_PAYLOAD_TABLES", fileConfig.ReferencePayloadTables)
+	setEnvFromFile("OUTBOX_RETENTION", fileConfig.OutboxRetention)
+	setEnvFromFile("TRIGGER_AUTO_INSTALL", fileConfig.TriggerAutoInstall)
+	setEnvFromFile("TRIGGER_INCLUDE", fileConfig.TriggerInclude)
+	setEnvFromFile("TRIGGER_EXCLUDE", fileConfig.TriggerExclude)
+	setEnvFromFile("CHANNEL_REFRESH_INTERVAL", fileConfig.ChannelRefreshInterval)
+	setEnvFromFile("AUTHORIZATION_MODE", fileConfig.AuthorizationMode)
+	setEnvFromFile("AUTHORIZATION_RULES_FILE", fileConfig.AuthorizationRulesFile)
+	setEnvFromFile("AUTHORIZATION_ADMIN_ROLES", fileConfig.AuthorizationAdminRoles)
+	setEnvFromFile("AUTHORIZATION_REFRESH_INTERVAL", fileConfig.AuthorizationRefreshInterval)
+	setEnvFromFile("REDACTION_RULES_FILE", fileConfig.RedactionRulesFile)
+	setEnvFromFile("REDACTION_REFRESH_INTERVAL", fileConfig.RedactionRefreshInterval)
+	setEnvFromFile("SEND_QUEUE_SIZE", fileConfig.SendQueueSize)
+	setEnvFromFile("SLOW_CONSUMER_POLICY", fileConfig.SlowConsumerPolicy)
+	setEnvFromFile("TENANT_SLOW_CONSUMER_POLICIES", fileConfig.TenantSlowConsumerPolicies)
+	setEnvFromFile("HISTORY_SIZE", fileConfig.HistorySize)
+	setEnvFromFile("HISTORY_DIR", fileConfig.HistoryDir)
+	setEnvFromFile("ACK_TABLES", fileConfig.AckTables)
+	setEnvFromFile("ACK_TIMEOUT", fileConfig.AckTimeout)
+	setEnvFromFile("ACK_MAX_PENDING", fileConfig.AckMaxPending)
+	setEnvFromFile("ACK_STATE_TTL", fileConfig.AckStateTTL)
+	setEnvFromFile("SNAPSHOT_PAGE_SIZE", fileConfig.SnapshotPageSize)
+	setEnvFromFile("SNAPSHOT_MAX_OPEN", fileConfig.SnapshotMaxOpen)
+	setEnvFromFile("SNAPSHOT_TTL", fileConfig.SnapshotTTL)
+	setEnvFromFile("TOMBSTONE_RETENTION", fileConfig.TombstoneRetention)
+	setEnvFromFile("ROW_HASHES", fileConfig.RowHashes)
+	setEnvFromFile("TRANSACTION_ENVELOPES", fileConfig.TransactionEnvelopes)
+	setEnvFromFile("RECONCILE_FANOUT", fileConfig.ReconcileFanout)
+	setEnvFromFile("RECONCILE_LEAF_ROWS", fileConfig.ReconcileLeafRows)
+	setEnvFromFile("DEBOUNCE_TABLES", fileConfig.DebounceTables)
+	setEnvFromFile("COMPRESSION", fileConfig.Compression)
+	setEnvFromFile("COMPRESSION_LEVEL", fileConfig.CompressionLevel)
+	setEnvFromFile("COMPRESSION_MIN_BYTES", fileConfig.CompressionMinBytes)
+	setEnvFromFile("TENANT_COMPRESSION_MIN_BYTES", fileConfig.TenantCompressionMinBytes)
+	setEnvFromFile("SHARED_COMPRESSION", fileConfig.SharedCompression)
 
 	return true
 }
@@ -222,6 +375,13 @@ func saveToConfigFile() error {
 	return os.WriteFile(configFileName, data, 0600) // Read/write for owner only
 }
 
+// setEnvFromFile exports a config file value so getEnv() picks it up (empty values are skipped)
+func setEnvFromFile(key, value string) {
+	if value != "" {
+		os.Setenv(key, value)
+	}
+}
+
 // getEnv gets environment variable with fallback to default
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -230,6 +390,97 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getDurationEnv parses a duration config value, falling back to the default when empty or invalid
+func getDurationEnv(value string, defaultValue time.Duration) time.Duration {
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("⚠️  Invalid duration %q, using default %v", value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getBoolEnv parses a boolean config value, falling back to the default when empty or invalid
+func getBoolEnv(value string, defaultValue bool) bool {
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("⚠️  Invalid boolean %q, using default %v", value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvList splits a comma separated config value, dropping empty entries
+func getEnvList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getIntEnv parses a positive integer config value, falling back to the default when empty or invalid
+func getIntEnv(value string, defaultValue int) int {
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("⚠️  Invalid integer %q, using default %d", value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// tenantOverride looks up a tenant in a comma separated list of tenant=value pairs
+func tenantOverride(pairs, tenantName string) (string, bool) {
+	for _, pair := range strings.Split(pairs, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && strings.TrimSpace(name) == tenantName {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// changeSourceForTenant returns the change source configured for a tenant.
+// TENANT_CHANGE_SOURCES takes a comma separated list of tenant=source pairs and
+// overrides the global CHANGE_SOURCE so tenants can be migrated one at a time.
+func changeSourceForTenant(tenantName string) string {
+	if source, found := tenantOverride(config.TenantChangeSources, tenantName); found {
+		return source
+	}
+	if config.ChangeSource == "" {
+		return changeSourceNotify
+	}
+	return config.ChangeSource
+}
+
+// slowConsumerPolicyForTenant returns the slow-consumer policy of a tenant.
+// TENANT_SLOW_CONSUMER_POLICIES overrides SLOW_CONSUMER_POLICY with tenant=policy pairs.
+func slowConsumerPolicyForTenant(tenantName string) string {
+	policy := config.SlowConsumerPolicy
+	if override, found := tenantOverride(config.TenantSlowConsumerPolicies, tenantName); found {
+		policy = override
+	}
+	switch policy {
+	case slowConsumerDropOldest, slowConsumerCoalesce, slowConsumerDisconnect:
+		return policy
+	case "":
+		return slowConsumerDisconnect
+	}
+	log.Printf("⚠️  Unknown slow consumer policy %q for tenant %s, using %s", policy, tenantName, slowConsumerDisconnect)
+	return slowConsumerDisconnect
+}
+
 // isInteractive checks if the application is running in an interactive terminal
 func isInteractive() bool {
 	// Check if stdin is a terminal
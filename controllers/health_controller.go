@@ -19,6 +19,8 @@ type HealthEngineInterface interface {
 	GetTenantDatabasesCount() int
 	IsLandlordConnected() bool
 	GetCacheStats() map[string]int
+	GetListenerStatuses() []map[string]interface{}
+	GetDeliveryMetrics() map[string]interface{}
 }
 
 // NewHealthController creates a new health controller
@@ -42,6 +44,7 @@ func (hc *HealthController) GetHealth(c *fiber.Ctx) error {
 	totalSessionCount := hc.engine.GetTotalSessionsCount()
 	tenantCount := hc.engine.GetTenantDatabasesCount()
 	landlordConnected := hc.engine.IsLandlordConnected()
+	listeners := hc.engine.GetListenerStatuses()
 
 	status := "healthy"
 	httpStatus := fiber.StatusOK
@@ -50,6 +53,17 @@ func (hc *HealthController) GetHealth(c *fiber.Ctx) error {
 		httpStatus = fiber.StatusServiceUnavailable
 	}
 
+	// A tenant whose change source is down receives no events until the supervisor restarts it
+	downListeners := 0
+	for _, listener := range listeners {
+		if listener["state"] != "running" {
+			downListeners++
+		}
+	}
+	if downListeners > 0 && status == "healthy" {
+		status = "degraded"
+	}
+
 	response := fiber.Map{
 		"status":  status,
 		"service": "WhagonsRTE",
@@ -60,6 +74,8 @@ func (hc *HealthController) GetHealth(c *fiber.Ctx) error {
 			"total_sessions":       totalSessionCount,
 			"tenant_databases":     tenantCount,
 			"landlord_connected":   landlordConnected,
+			"listeners":            listeners,
+			"listeners_down":       downListeners,
 			"uptime":               time.Now().Format(time.RFC3339),
 		},
 	}
@@ -96,6 +112,7 @@ func (hc *HealthController) GetMetrics(c *fiber.Ctx) error {
 				"landlord_connected": landlordConnected,
 			},
 			"auth_cache": cacheStats,
+			"delivery":   hc.engine.GetDeliveryMetrics(),
 			"system": fiber.Map{
 				"uptime":  time.Now().Format(time.RFC3339),
 				"service": "WhagonsRTE",
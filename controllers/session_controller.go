@@ -20,6 +20,8 @@ type RealtimeEngineInterface interface {
 	BroadcastMessage(msgType, operation, message string, data interface{})
 	ReloadTenants() error
 	TestTenantNotification() error
+	GetTenantChannels() map[string][]string
+	GetSessions() []map[string]interface{}
 }
 
 // SystemMessage represents system messages for JSON responses
@@ -65,6 +67,29 @@ func (sc *SessionController) GetSessionsCount(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(response)
 }
 
+// ListSessions returns every connected session with its delivery progress
+// @Summary List connected sessions
+// @Description Returns active WebSocket sessions with queue depth and, for clients in ack mode, the highest contiguous acknowledged sequence and unacknowledged backlog
+// @Tags sessions
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/sessions [get]
+func (sc *SessionController) ListSessions(c *fiber.Ctx) error {
+	sessions := sc.engine.GetSessions()
+
+	response := fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"sessions":  sessions,
+			"count":     len(sessions),
+			"timestamp": time.Now().Format(time.RFC3339),
+		},
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
 // DisconnectAllSessions disconnects all active sessions
 // @Summary Disconnect all sessions
 // @Description Gracefully disconnects all active WebSocket sessions
@@ -225,6 +250,26 @@ func (sc *SessionController) TestTenantNotification(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusOK).JSON(response)
 }
 
+// GetTenantChannels returns the notification channels each tenant listener is subscribed to
+// @Summary Get tenant channels
+// @Description Returns the current LISTEN channel set of every tenant change source
+// @Tags tenants
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/tenants/channels [get]
+func (sc *SessionController) GetTenantChannels(c *fiber.Ctx) error {
+	response := fiber.Map{
+		"status": "success",
+		"data": fiber.Map{
+			"tenants":   sc.engine.GetTenantChannels(),
+			"timestamp": time.Now().Format(time.RFC3339),
+		},
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
 // BroadcastRequest represents the request body for broadcasting messages
 type BroadcastRequest struct {
 	Type      string      `json:"type" example:"system"`
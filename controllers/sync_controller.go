@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SyncController handles the client data synchronization endpoints
+type SyncController struct {
+	engine SyncEngineInterface
+}
+
+// SyncEngineInterface defines the methods we need from RealtimeEngine for client synchronization.
+// Requests are authenticated with the same bearer token and domain as the WebSocket.
+type SyncEngineInterface interface {
+	SyncSnapshot(authorization, token, domain string, body []byte) (interface{}, error)
+	SyncDelta(authorization, token, domain string, body []byte) (interface{}, error)
+	SyncChecksum(authorization, token, domain string, body []byte) (interface{}, error)
+	SyncReconcile(authorization, token, domain string, body []byte) (interface{}, error)
+}
+
+// syncFailure is implemented by engine errors that carry an HTTP status and error code
+type syncFailure interface {
+	StatusCode() int
+	Code() string
+}
+
+// NewSyncController creates a new sync controller
+func NewSyncController(engine SyncEngineInterface) *SyncController {
+	return &SyncController{
+		engine: engine,
+	}
+}
+
+// Snapshot returns the next page of a consistent table snapshot
+// @Summary Read a table snapshot
+// @Description Opens a consistent snapshot of a table (or continues one by snapshot_id) and returns a page of rows with the change-stream position to subscribe from
+// @Tags sync
+// @Accept json
+// @Produce json
+// @Param domain query string true "Tenant domain"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /api/sync/snapshot [post]
+func (sc *SyncController) Snapshot(c *fiber.Ctx) error {
+	page, err := sc.engine.SyncSnapshot(c.Get("Authorization"), c.Query("token"), c.Query("domain"), c.Body())
+	return sc.respond(c, page, err)
+}
+
+// Delta returns the rows changed and deleted since a client-held cursor
+// @Summary Read changes since a cursor
+// @Description Returns rows whose (updated_at, id) is after the cursor plus tombstones of rows deleted in the same range
+// @Tags sync
+// @Accept json
+// @Produce json
+// @Param domain query string true "Tenant domain"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 410 {object} map[string]interface{}
+// @Router /api/sync/delta [post]
+func (sc *SyncController) Delta(c *fiber.Ctx) error {
+	page, err := sc.engine.SyncDelta(c.Get("Authorization"), c.Query("token"), c.Query("domain"), c.Body())
+	return sc.respond(c, page, err)
+}
+
+// Checksum returns a checksum of the rows of a table visible to the caller
+// @Summary Checksum a table
+// @Description Hashes the visible rows of a table (optionally per id-range bucket) under a consistent snapshot so clients can detect drift in their local copy
+// @Tags sync
+// @Accept json
+// @Produce json
+// @Param domain query string true "Tenant domain"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /api/sync/checksum [post]
+func (sc *SyncController) Checksum(c *fiber.Ctx) error {
+	result, err := sc.engine.SyncChecksum(c.Get("Authorization"), c.Query("token"), c.Query("domain"), c.Body())
+	return sc.respond(c, result, err)
+}
+
+// Reconcile compares client bucket checksums and returns the differing buckets or their rows
+// @Summary Reconcile a table by buckets
+// @Description One round of hierarchical reconciliation: reports which of the client's id-range buckets differ, patches small ones with their rows and returns larger ones to be compared at a smaller bucket size
+// @Tags sync
+// @Accept json
+// @Produce json
+// @Param domain query string true "Tenant domain"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /api/sync/reconcile [post]
+func (sc *SyncController) Reconcile(c *fiber.Ctx) error {
+	result, err := sc.engine.SyncReconcile(c.Get("Authorization"), c.Query("token"), c.Query("domain"), c.Body())
+	return sc.respond(c, result, err)
+}
+
+// respond renders a sync result or the engine error with its status
+func (sc *SyncController) respond(c *fiber.Ctx, data interface{}, err error) error {
+	if err != nil {
+		status, code := fiber.StatusInternalServerError, "sync_failed"
+		if failure, ok := err.(syncFailure); ok {
+			status, code = failure.StatusCode(), failure.Code()
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"status":    "error",
+			"code":      code,
+			"message":   err.Error(),
+			"timestamp": time.Now().Format(time.RFC3339),
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status": "success",
+		"data":   data,
+	})
+}
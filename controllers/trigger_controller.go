@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TriggerController handles the engine-owned change trigger endpoints
+type TriggerController struct {
+	engine TriggerEngineInterface
+}
+
+// TriggerEngineInterface defines the methods we need from RealtimeEngine for trigger management
+type TriggerEngineInterface interface {
+	SyncTenantTriggers(apply bool) ([]interface{}, error)
+}
+
+// NewTriggerController creates a new trigger controller
+func NewTriggerController(engine TriggerEngineInterface) *TriggerController {
+	return &TriggerController{
+		engine: engine,
+	}
+}
+
+// GetTriggers reports the change trigger state of every tenant without changing anything
+// @Summary Inspect tenant change triggers
+// @Description Lists managed tables per tenant and reports missing or drifted change triggers
+// @Tags tenants
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{}
+// @Router /api/tenants/triggers [get]
+func (tc *TriggerController) GetTriggers(c *fiber.Ctx) error {
+	return tc.respond(c, false)
+}
+
+// SyncTriggers installs missing change triggers and upgrades drifted ones in every tenant
+// @Summary Sync tenant change triggers
+// @Description Idempotently installs or upgrades the engine-owned change triggers in every tenant
+// @Tags tenants
+// @Accept json
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 500 {object} map[string]interface{}
+// @Router /api/tenants/triggers/sync [post]
+func (tc *TriggerController) SyncTriggers(c *fiber.Ctx) error {
+	return tc.respond(c, true)
+}
+
+// respond runs the trigger sync and renders the per-tenant reports
+func (tc *TriggerController) respond(c *fiber.Ctx, apply bool) error {
+	reports, err := tc.engine.SyncTenantTriggers(apply)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":    "error",
+			"message":   "Failed to sync change triggers",
+			"error":     err.Error(),
+			"timestamp": time.Now().Format(time.RFC3339),
+		})
+	}
+
+	message := "Change triggers inspected"
+	if apply {
+		message = "Change triggers synced"
+	}
+
+	response := fiber.Map{
+		"status":  "success",
+		"message": message,
+		"data": fiber.Map{
+			"tenants":   reports,
+			"applied":   apply,
+			"timestamp": time.Now().Format(time.RFC3339),
+		},
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
@@ -11,10 +11,15 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// postgresConnString builds the lib/pq connection string for a database on the configured server
+func postgresConnString(dbName string) string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		config.DBHost, config.DBPort, config.DBUsername, config.DBPassword, dbName)
+}
+
 // connectToLandlord establishes connection to the landlord database
 func (e *RealtimeEngine) connectToLandlord() error {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		config.DBHost, config.DBPort, config.DBUsername, config.DBPassword, config.DBLandlord)
+	connStr := postgresConnString(config.DBLandlord)
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -41,6 +46,17 @@ func (e *RealtimeEngine) connectToLandlord() error {
 		log.Println("✅ Tenant notification system ready")
 	}
 
+	// Set up durable change source checkpoints
+	if err := e.setupCheckpointStore(); err != nil {
+		log.Printf("⚠️  Failed to setup checkpoint store: %v", err)
+		log.Println("🔍 Change sources will not resume from their last position after restarts")
+	}
+
+	// Set up the landlord column redaction rules
+	if err := e.setupRedactionStore(); err != nil {
+		log.Printf("⚠️  Failed to setup redaction store: %v", err)
+	}
+
 	return nil
 }
 
@@ -176,7 +192,7 @@ func (e *RealtimeEngine) reloadTenantDatabases() error {
 			log.Printf("✅ Connected to new tenant database: %s", tenant.Name)
 
 			// Start publication listener for the new tenant
-			go e.listenToTenantPublications(tenant.Name, tenant.Database)
+			e.listenToTenantPublications(tenant.Name, tenant.Database)
 			newTenantsCount++
 		}
 	}
@@ -217,8 +233,7 @@ func (e *RealtimeEngine) TestTenantNotification() error {
 func (e *RealtimeEngine) listenToLandlordTenantChanges() {
 	log.Println("🎧 Starting landlord tenant changes listener")
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		config.DBHost, config.DBPort, config.DBUsername, config.DBPassword, config.DBLandlord)
+	connStr := postgresConnString(config.DBLandlord)
 
 	listener := pq.NewListener(
 		connStr,
@@ -329,6 +344,7 @@ func (e *RealtimeEngine) handleTenantChangeNotification(notification *pq.Notific
 		case "DELETE":
 			if payload.OldData != nil {
 				log.Printf("➖ Tenant deleted: %s", payload.OldData.Name)
+				e.stopTenantListener(payload.OldData.Name)
 				// Close connection to deleted tenant
 				e.mutex.Lock()
 				if db, exists := e.tenantDBs[payload.OldData.Name]; exists {
@@ -354,8 +370,7 @@ func (e *RealtimeEngine) handleTenantChangeNotification(notification *pq.Notific
 
 // connectToTenant establishes connection to a specific tenant database
 func (e *RealtimeEngine) connectToTenant(tenant TenantDB) error {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		config.DBHost, config.DBPort, config.DBUsername, config.DBPassword, tenant.Database)
+	connStr := postgresConnString(tenant.Database)
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -375,6 +390,21 @@ func (e *RealtimeEngine) connectToTenant(tenant TenantDB) error {
 	e.tenantDBs[tenant.Name] = db
 	e.mutex.Unlock()
 
+	// Install or upgrade the engine-owned change triggers
+	if err := e.setupTenantTriggers(tenant.Name, db); err != nil {
+		log.Printf("⚠️  Failed to setup change triggers for tenant %s: %v", tenant.Name, err)
+	}
+
+	// Deleted rows are recorded for delta sync
+	if err := e.setupTenantTombstones(tenant.Name, db); err != nil {
+		log.Printf("⚠️  Delta sync will not report deletions for tenant %s: %v", tenant.Name, err)
+	}
+
+	// Row hashes let checksums be answered per bucket instead of per row
+	if err := e.setupTenantRowHashes(tenant.Name, db); err != nil {
+		log.Printf("⚠️  Checksums will hash rows on every request for tenant %s: %v", tenant.Name, err)
+	}
+
 	return nil
 }
 
@@ -413,7 +443,7 @@ func (e *RealtimeEngine) connectToTenantWithRetry(tenant TenantDB) {
 		log.Printf("✅ Connected to new tenant: %s (attempt %d)", tenant.Name, attempt)
 
 		// Start publication listener for the new tenant
-		go e.listenToTenantPublications(tenant.Name, tenant.Database)
+		e.listenToTenantPublications(tenant.Name, tenant.Database)
 		return
 	}
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// maxDebouncedChanges caps the rows held in one debounce window; a fuller window is flushed early
+const maxDebouncedChanges = 5000
+
+// debounceWindow collects the changes of one tenant table until its window elapses
+type debounceWindow struct {
+	changes  map[string]*bufferedChange // row key -> collapsed change, nil once nothing remains
+	order    []string                   // row keys in order of their first change
+	received int
+	timer    *time.Timer
+	flushed  chan struct{} // closed once the collapsed changes were delivered
+}
+
+// debounceBarrier holds back a change source checkpoint until the debounce windows open when it was
+// taken are flushed, so a restart replays changes that were still held in memory
+type debounceBarrier []chan struct{}
+
+// BatchMessage carries the collapsed changes of one debounce window a session may see
+type BatchMessage struct {
+	Type       string               `json:"type"` // always "batch"
+	TenantName string               `json:"tenant_name"`
+	Table      string               `json:"table"`
+	FirstSeq   uint64               `json:"first_seq"`
+	LastSeq    uint64               `json:"last_seq"`
+	Changes    []PublicationMessage `json:"changes"`
+	ClientTime string               `json:"client_timestamp"`
+}
+
+// debounceWindowFor returns the debounce window of a table, zero when changes are delivered right away.
+// DEBOUNCE_TABLES takes a comma separated list of table=duration pairs, e.g. wh_tasks=200ms.
+func debounceWindowFor(table string) time.Duration {
+	value, found := tenantOverride(config.DebounceTables, table)
+	if !found {
+		return 0
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0
+	}
+	return window
+}
+
+// validateDebounceTables checks the table=duration pairs of DEBOUNCE_TABLES
+func validateDebounceTables() error {
+	if strings.TrimSpace(config.DebounceTables) == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(config.DebounceTables, ",") {
+		table, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || strings.TrimSpace(table) == "" {
+			return fmt.Errorf("invalid debounce entry %q, expected table=duration", pair)
+		}
+		if window, err := time.ParseDuration(strings.TrimSpace(value)); err != nil || window <= 0 {
+			return fmt.Errorf("invalid debounce window %q for table %s", value, table)
+		}
+	}
+	return nil
+}
+
+// debounceChange holds a change of a debounced table, collapsing it with earlier changes of the same row
+func (e *RealtimeEngine) debounceChange(tenantName string, message, unredacted PublicationMessage, window time.Duration) {
+	key := tenantName + "/" + message.Table
+
+	e.debounceMutex.Lock()
+	pending, exists := e.debounceWindows[key]
+	if !exists {
+		pending = &debounceWindow{changes: make(map[string]*bufferedChange), flushed: make(chan struct{})}
+		e.debounceWindows[key] = pending
+		pending.timer = time.AfterFunc(window, func() {
+			e.flushDebounced(tenantName, message.Table)
+		})
+	}
+
+	// Rows without an id cannot be matched and are kept as they are
+	rowKey := changeRowKey(message.Table, &changeImages{message: &unredacted})
+	if rowKey == "" {
+		rowKey = fmt.Sprintf("#%d", pending.received)
+	}
+	pending.received++
+
+	earlier, seen := pending.changes[rowKey]
+	switch {
+	case earlier != nil:
+		collapsed, remains := collapseChange(earlier.message, message)
+		collapsedUnredacted, _ := collapseChange(earlier.unredacted, unredacted)
+		if remains {
+			earlier.message, earlier.unredacted = collapsed, collapsedUnredacted
+		} else {
+			// Inserted and deleted within the window - the row never existed for clients
+			pending.changes[rowKey] = nil
+		}
+	case seen:
+		pending.changes[rowKey] = &bufferedChange{message: message, unredacted: unredacted}
+	default:
+		pending.changes[rowKey] = &bufferedChange{message: message, unredacted: unredacted}
+		pending.order = append(pending.order, rowKey)
+	}
+	full := len(pending.order) >= maxDebouncedChanges
+	e.debounceMutex.Unlock()
+
+	if full {
+		e.flushDebounced(tenantName, message.Table)
+	}
+}
+
+// collapseChange merges a later change of a row into an earlier one so only the final state is delivered.
+// It returns false when nothing remains to deliver.
+func collapseChange(earlier, later PublicationMessage) (PublicationMessage, bool) {
+	collapsed := later
+	switch {
+	case earlier.Operation == "INSERT" && later.Operation == "DELETE":
+		return later, false
+	case earlier.Operation == "INSERT":
+		// The client never saw the row, so it is still an insert
+		collapsed.Operation = "INSERT"
+		collapsed.OldData = nil
+	case earlier.Operation == "DELETE":
+		// Deleted and inserted again - the client still holds the deleted image
+		collapsed.Operation = "UPDATE"
+		collapsed.OldData = earlier.OldData
+	case later.Operation == "DELETE" && earlier.OldData == nil:
+		// Keep the only old image there is, it identifies the deleted row
+	default:
+		// The client holds the row as it was before the earlier change
+		collapsed.OldData = earlier.OldData
+	}
+	collapsed.Message = changeText(collapsed.Operation, collapsed.TenantName, collapsed.Table)
+	return collapsed, true
+}
+
+// flushDebounced sequences the collapsed changes of a table's debounce window and delivers them together
+func (e *RealtimeEngine) flushDebounced(tenantName, table string) {
+	key := tenantName + "/" + table
+
+	// The window is taken under the publish lock, so debounceBarrier either sees it or waits for its delivery
+	history := e.historyFor(tenantName)
+	history.publish.Lock()
+	defer history.publish.Unlock()
+
+	e.debounceMutex.Lock()
+	pending, exists := e.debounceWindows[key]
+	if exists {
+		delete(e.debounceWindows, key)
+		pending.timer.Stop()
+	}
+	e.debounceMutex.Unlock()
+	if !exists {
+		return
+	}
+	defer close(pending.flushed)
+
+	deliveries := make([]*changeDelivery, 0, len(pending.order))
+	var first *PublicationMessage
+	for _, rowKey := range pending.order {
+		change := pending.changes[rowKey]
+		if change == nil {
+			continue
+		}
+		change.message.Seq = history.append(change.message, &change.unredacted)
+		change.unredacted.Seq = change.message.Seq
+		if first == nil {
+			first = &change.message
+		}
+		deliveries = append(deliveries, e.newChangeDelivery(change.message, &changeImages{message: &change.unredacted}))
+	}
+
+	switch len(deliveries) {
+	case 0:
+		log.Printf("⏱️ Debounced %d changes on %s.%s - nothing left to deliver", pending.received, tenantName, table)
+	case 1:
+		e.broadcastChange(*first, deliveries[0].authImages)
+	default:
+		receivers := e.broadcastGroup(deliveries, batchEnvelope)
+		log.Printf("⏱️ Debounced %d changes on %s.%s into a batch of %d for %d sessions",
+			pending.received, tenantName, table, len(deliveries), receivers)
+	}
+}
+
+// debounceBarrier returns a barrier released once every debounce window of a tenant open now is flushed
+func (e *RealtimeEngine) debounceBarrier(tenantName string) debounceBarrier {
+	history := e.historyFor(tenantName)
+	history.publish.Lock()
+	defer history.publish.Unlock()
+
+	e.debounceMutex.Lock()
+	defer e.debounceMutex.Unlock()
+
+	var barrier debounceBarrier
+	prefix := tenantName + "/"
+	for key, pending := range e.debounceWindows {
+		if strings.HasPrefix(key, prefix) {
+			barrier = append(barrier, pending.flushed)
+		}
+	}
+	return barrier
+}
+
+// released reports whether the windows the barrier waits for have all been flushed
+func (b debounceBarrier) released() bool {
+	for _, flushed := range b {
+		select {
+		case <-flushed:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// batchEnvelope wraps the changes of one debounce window a session may see
+func batchEnvelope(messages []PublicationMessage) interface{} {
+	return BatchMessage{
+		Type:       "batch",
+		TenantName: messages[0].TenantName,
+		Table:      messages[0].Table,
+		FirstSeq:   messages[0].Seq,
+		LastSeq:    messages[len(messages)-1].Seq,
+		Changes:    messages,
+		ClientTime: time.Now().Format(time.RFC3339),
+	}
+}
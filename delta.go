@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// tombstoneTruncated is the row id of the tombstone recorded when a whole table is truncated
+const tombstoneTruncated = "*"
+
+// DeltaRequest asks for the rows of a table changed after a client-held (updated_at, id) cursor
+type DeltaRequest struct {
+	RequestID      string `json:"request_id,omitempty"`
+	Table          string `json:"table"`
+	SinceUpdatedAt string `json:"since_updated_at"`
+	SinceID        string `json:"since_id,omitempty"`
+	Filter         string `json:"filter,omitempty"`
+	PageSize       int    `json:"page_size,omitempty"`
+}
+
+// DeltaCursor is the position of the last row returned, sent back as since_updated_at/since_id
+type DeltaCursor struct {
+	UpdatedAt string `json:"updated_at"`
+	ID        string `json:"id,omitempty"`
+}
+
+// Tombstone reports a row deleted after the client's cursor
+type Tombstone struct {
+	ID        string `json:"id"`
+	DeletedAt string `json:"deleted_at"`
+}
+
+// DeltaPage is one page of changed rows and the deletions that happened in the same time range
+type DeltaPage struct {
+	RequestID  string            `json:"request_id,omitempty"`
+	Table      string            `json:"table"`
+	Rows       []json.RawMessage `json:"rows"`
+	Tombstones []Tombstone       `json:"tombstones"`
+	NextCursor DeltaCursor       `json:"next_cursor"`
+	HasMore    bool              `json:"has_more"`
+	Seq        uint64            `json:"seq"`
+	Cursor     string            `json:"snapshot_cursor"`
+	LSN        string            `json:"lsn,omitempty"`
+}
+
+// tombstoneFunctionSQL records deleted rows, and truncated tables under tombstoneTruncated, when the
+// delete happens in the tenant database, so deletions are kept even when no engine is listening
+var tombstoneFunctionSQL = fmt.Sprintf(`
+	CREATE OR REPLACE FUNCTION whagons_rte_record_tombstone()
+	RETURNS TRIGGER AS $$
+	DECLARE
+		deleted_id TEXT;
+	BEGIN
+		IF TG_OP = 'TRUNCATE' THEN
+			deleted_id = %s;
+		ELSE
+			deleted_id = to_jsonb(OLD)->>'id';
+			IF deleted_id IS NULL THEN
+				RETURN NULL;
+			END IF;
+		END IF;
+
+		INSERT INTO whagons_rte_tombstones (table_name, row_id, deleted_at)
+		VALUES (TG_TABLE_NAME, deleted_id, clock_timestamp())
+		ON CONFLICT (table_name, row_id) DO UPDATE SET deleted_at = EXCLUDED.deleted_at;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;`, pq.QuoteLiteral(tombstoneTruncated))
+
+// setupTenantTombstones creates the table recording deleted rows for delta sync in a tenant database
+// and attaches the tombstone triggers to every managed table
+func (e *RealtimeEngine) setupTenantTombstones(tenantName string, db *sql.DB) error {
+	createTableSQL := `
+		CREATE TABLE IF NOT EXISTS whagons_rte_tombstones (
+			table_name TEXT NOT NULL,
+			row_id     TEXT NOT NULL,
+			deleted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (table_name, row_id)
+		);
+		CREATE INDEX IF NOT EXISTS whagons_rte_tombstones_deleted_idx
+			ON whagons_rte_tombstones (table_name, deleted_at);`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("failed to create tombstone table for tenant %s: %w", tenantName, err)
+	}
+	if _, err := db.Exec(tombstoneFunctionSQL); err != nil {
+		return fmt.Errorf("failed to create tombstone function for tenant %s: %w", tenantName, err)
+	}
+	return e.installMissingTombstones(tenantName, db)
+}
+
+// installMissingTombstones attaches the tombstone triggers to managed tables lacking them. It also runs
+// after DDL, so it only creates triggers that are missing.
+func (e *RealtimeEngine) installMissingTombstones(tenantName string, db *sql.DB) error {
+	tables, err := managedTables(db)
+	if err != nil {
+		return fmt.Errorf("failed to list tables for tenant %s: %w", tenantName, err)
+	}
+
+	for _, table := range tables {
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = to_regclass($1) AND tgname = $2)`,
+			pq.QuoteIdentifier(table), table+"_tombstone_trigger").Scan(&exists)
+		if err != nil {
+			log.Printf("⚠️  Failed to inspect tombstone trigger on %s for tenant %s: %v", table, tenantName, err)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		createTriggersSQL := fmt.Sprintf(`
+			CREATE TRIGGER %[1]s
+				AFTER DELETE ON %[3]s
+				FOR EACH ROW EXECUTE FUNCTION whagons_rte_record_tombstone();
+			CREATE TRIGGER %[2]s
+				AFTER TRUNCATE ON %[3]s
+				FOR EACH STATEMENT EXECUTE FUNCTION whagons_rte_record_tombstone();`,
+			pq.QuoteIdentifier(table+"_tombstone_trigger"), pq.QuoteIdentifier(table+"_tombstone_truncate_trigger"), pq.QuoteIdentifier(table))
+		if _, err := db.Exec(createTriggersSQL); err != nil {
+			log.Printf("⚠️  Failed to install tombstone triggers on %s for tenant %s: %v", table, tenantName, err)
+			continue
+		}
+		log.Printf("🪦 Tombstone triggers installed on %s for tenant %s", table, tenantName)
+	}
+	return nil
+}
+
+// pruneTombstones deletes tombstones older than TOMBSTONE_RETENTION in every tenant database
+func (e *RealtimeEngine) pruneTombstones() {
+	retention := getDurationEnv(config.TombstoneRetention, 30*24*time.Hour)
+
+	e.mutex.RLock()
+	tenantDBs := make(map[string]*sql.DB, len(e.tenantDBs))
+	for name, db := range e.tenantDBs {
+		tenantDBs[name] = db
+	}
+	e.mutex.RUnlock()
+
+	for tenantName, db := range tenantDBs {
+		result, err := db.Exec(`DELETE FROM whagons_rte_tombstones WHERE deleted_at < now() - $1::interval`,
+			fmt.Sprintf("%d seconds", int(retention.Seconds())))
+		if err != nil {
+			log.Printf("⚠️  Failed to prune tombstones for tenant %s: %v", tenantName, err)
+			continue
+		}
+		if pruned, _ := result.RowsAffected(); pruned > 0 {
+			log.Printf("🧹 Pruned %d tombstones for tenant %s", pruned, tenantName)
+		}
+	}
+}
+
+// deltaPage returns the rows of a table changed after the request cursor, in (updated_at, id) order,
+// with the tombstones of the same time range. Pages are read in their own snapshot; clients keep the
+// snapshot_cursor of the first page and subscribe with it once the last page is applied.
+func (e *RealtimeEngine) deltaPage(authSession *AuthenticatedSession, grants *UserGrants, request DeltaRequest) (*DeltaPage, error) {
+	filter, pageSize, err := e.checkSyncTable(grants, request.Table, request.Filter, request.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	if request.SinceUpdatedAt == "" {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_request", "since_updated_at is required - use a snapshot for a full load")
+	}
+
+	syncTx, err := e.beginSyncTransaction(authSession.TenantName)
+	if err != nil {
+		return nil, err
+	}
+	defer syncTx.tx.Rollback()
+
+	// Deletions older than the retention are gone, so such a cursor cannot be caught up
+	retention := getDurationEnv(config.TombstoneRetention, 30*24*time.Hour)
+	var expired bool
+	err = syncTx.tx.QueryRow(`SELECT $1::timestamptz < now() - $2::interval`,
+		request.SinceUpdatedAt, fmt.Sprintf("%d seconds", int(retention.Seconds()))).Scan(&expired)
+	if err != nil {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_cursor", "Invalid since_updated_at %q", request.SinceUpdatedAt)
+	}
+	if expired {
+		return nil, newSyncError(http.StatusGone, "cursor_expired", "Cursor is older than the tombstone retention - load a snapshot instead")
+	}
+
+	query := fmt.Sprintf(`SELECT row_to_json(t)::text, t.updated_at::text, t.id::text FROM %s t`, pq.QuoteIdentifier(request.Table))
+	args := []interface{}{pageSize, request.SinceUpdatedAt}
+	if request.SinceID != "" {
+		query += ` WHERE (t.updated_at, t.id) > ($2, $3)`
+		args = append(args, request.SinceID)
+	} else {
+		query += ` WHERE t.updated_at > $2`
+	}
+	query += ` ORDER BY t.updated_at, t.id LIMIT $1`
+
+	rows, err := syncTx.tx.Query(query, args...)
+	if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code == "42P01" || pqErr.Code == "42703") {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_table", "Table %s does not exist or has no id and updated_at columns", request.Table)
+	} else if err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "delta_failed", "Failed to read changes: %v", err)
+	}
+
+	redaction := e.redactionFor(request.Table)
+	page := &DeltaPage{
+		RequestID:  request.RequestID,
+		Table:      request.Table,
+		Rows:       []json.RawMessage{},
+		Tombstones: []Tombstone{},
+		NextCursor: DeltaCursor{UpdatedAt: request.SinceUpdatedAt, ID: request.SinceID},
+		Seq:        syncTx.seq,
+		Cursor:     syncTx.cursor(),
+		LSN:        syncTx.lsn,
+	}
+	read := 0
+	for rows.Next() {
+		var raw, updatedAt, id string
+		if err := rows.Scan(&raw, &updatedAt, &id); err != nil {
+			rows.Close()
+			return nil, newSyncError(http.StatusInternalServerError, "delta_failed", "Failed to read changes: %v", err)
+		}
+		read++
+		page.NextCursor = DeltaCursor{UpdatedAt: updatedAt, ID: id}
+
+		if row, visible := e.syncRowForSession(authSession, grants, request.Table, redaction, filter, json.RawMessage(raw)); visible {
+			page.Rows = append(page.Rows, row)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "delta_failed", "Failed to read changes: %v", err)
+	}
+	page.HasMore = read == pageSize
+
+	// Tombstones up to the last row of a partial page, so every deletion is returned exactly once across pages
+	tombstoneQuery := `
+		SELECT row_id, deleted_at::text
+		FROM whagons_rte_tombstones
+		WHERE table_name = $1 AND deleted_at > $2::timestamptz`
+	tombstoneArgs := []interface{}{request.Table, request.SinceUpdatedAt}
+	if page.HasMore {
+		tombstoneQuery += ` AND deleted_at <= $3::timestamptz`
+		tombstoneArgs = append(tombstoneArgs, page.NextCursor.UpdatedAt)
+	}
+	tombstoneQuery += ` ORDER BY deleted_at`
+
+	tombstoneRows, err := syncTx.tx.Query(tombstoneQuery, tombstoneArgs...)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P01" {
+		// Tombstone table could not be created (read-only tenant role) - deletions are not tracked
+		tombstoneRows, err = nil, nil
+	} else if err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "delta_failed", "Failed to read tombstones: %v", err)
+	}
+	for tombstoneRows != nil && tombstoneRows.Next() {
+		var tombstone Tombstone
+		if err := tombstoneRows.Scan(&tombstone.ID, &tombstone.DeletedAt); err != nil {
+			tombstoneRows.Close()
+			return nil, newSyncError(http.StatusInternalServerError, "delta_failed", "Failed to read tombstones: %v", err)
+		}
+		if tombstone.ID == tombstoneTruncated {
+			tombstoneRows.Close()
+			return nil, newSyncError(http.StatusConflict, "resync_required", "Table %s was truncated - load a snapshot instead", request.Table)
+		}
+		page.Tombstones = append(page.Tombstones, tombstone)
+	}
+	if tombstoneRows != nil {
+		tombstoneRows.Close()
+		if err := tombstoneRows.Err(); err != nil {
+			return nil, newSyncError(http.StatusInternalServerError, "delta_failed", "Failed to read tombstones: %v", err)
+		}
+	}
+
+	return page, nil
+}
+
+// SyncDelta serves one page of a delta sync over HTTP (implements SyncEngineInterface)
+func (e *RealtimeEngine) SyncDelta(authorization, token, domain string, body []byte) (interface{}, error) {
+	var request DeltaRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_request", "Invalid JSON request body")
+	}
+
+	authSession, grants, err := e.authenticateSyncRequest(authorization, token, domain)
+	if err != nil {
+		return nil, err
+	}
+	return e.deltaPage(authSession, grants, request)
+}
+
+// handleDelta serves one page of a delta sync over the WebSocket
+func (e *RealtimeEngine) handleDelta(wsSession *WebSocketSession, message ClientMessage) {
+	e.mutex.RLock()
+	authSession, exists := e.authenticatedSessions[wsSession.ID]
+	e.mutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	page, err := e.deltaPage(authSession, wsSession.sessionGrants(), DeltaRequest{
+		RequestID:      message.RequestID,
+		Table:          message.Table,
+		SinceUpdatedAt: message.SinceUpdatedAt,
+		SinceID:        message.SinceID,
+		Filter:         message.Filter,
+		PageSize:       message.PageSize,
+	})
+	if err != nil {
+		code := "delta_failed"
+		if syncErr, ok := err.(*syncError); ok {
+			code = syncErr.code
+		}
+		e.sendClientError(wsSession, message.RequestID, code, err.Error())
+		return
+	}
+
+	e.sendMessage(wsSession, SystemMessage{
+		Type:      "system",
+		Operation: "delta",
+		Message:   fmt.Sprintf("%d changed and %d deleted row(s) of %s", len(page.Rows), len(page.Tombstones), page.Table),
+		Data:      page,
+		Timestamp: time.Now().Format(time.RFC3339),
+		SessionId: wsSession.ID,
+	})
+}
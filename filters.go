@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxFilterConditions caps the number of AND-ed conditions in a single row filter
+const maxFilterConditions = 16
+
+// rowFilter is a parsed subscription predicate such as "workspace_id in (3,7) and deleted_at is null".
+// Conditions are AND-ed together and evaluated in Go against the row images of each change.
+type rowFilter struct {
+	Conditions []filterCondition
+}
+
+// filterCondition compares one column with one or more literal values
+type filterCondition struct {
+	Column   string
+	Operator string        // =, !=, <, <=, >, >=, in, not in, is null, is not null
+	Values   []interface{} // float64, string, bool or nil
+}
+
+// filterToken is a lexical token of a filter expression
+type filterToken struct {
+	kind  string // ident, number, string, op, punct
+	value string
+}
+
+// parseRowFilter parses and validates a filter expression
+func parseRowFilter(expression string) (*rowFilter, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("filter is empty")
+	}
+
+	p := &filterParser{tokens: tokens}
+	filter := &rowFilter{}
+	for {
+		condition, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		filter.Conditions = append(filter.Conditions, condition)
+		if len(filter.Conditions) > maxFilterConditions {
+			return nil, fmt.Errorf("filter has more than %d conditions", maxFilterConditions)
+		}
+
+		if p.done() {
+			return filter, nil
+		}
+		if !p.keyword("and") {
+			return nil, fmt.Errorf("expected 'and' near %q", p.peek().value)
+		}
+	}
+}
+
+// tokenizeFilter splits a filter expression into tokens
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, filterToken{kind: "punct", value: string(r)})
+			i++
+		case r == '=' || r == '!' || r == '<' || r == '>':
+			op := string(r)
+			if i+1 < len(runes) && (runes[i+1] == '=' || (r == '<' && runes[i+1] == '>')) {
+				op += string(runes[i+1])
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at position %d", i)
+			}
+			i += len(op)
+			if op == "<>" {
+				op = "!="
+			}
+			tokens = append(tokens, filterToken{kind: "op", value: op})
+		case r == '\'':
+			var value strings.Builder
+			i++
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\'' {
+					// '' escapes a quote like in SQL
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						value.WriteRune('\'')
+						i += 2
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string literal")
+			}
+			tokens = append(tokens, filterToken{kind: "string", value: value.String()})
+		case r == '-' || unicode.IsDigit(r):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			text := string(runes[start:i])
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q", text)
+			}
+			tokens = append(tokens, filterToken{kind: "number", value: text})
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: "ident", value: string(runes[start:i])})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a small recursive descent parser over filter tokens
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.done() {
+		return filterToken{kind: "eof", value: "end of filter"}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// keyword consumes a case-insensitive keyword if it is next
+func (p *filterParser) keyword(word string) bool {
+	token := p.peek()
+	if token.kind == "ident" && strings.EqualFold(token.value, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// condition parses "column op value", "column [not] in (values)" or "column is [not] null"
+func (p *filterParser) condition() (filterCondition, error) {
+	column := p.next()
+	if column.kind != "ident" || !tableNamePattern.MatchString(column.value) {
+		return filterCondition{}, fmt.Errorf("expected column name, got %q", column.value)
+	}
+	condition := filterCondition{Column: column.value}
+
+	switch {
+	case p.keyword("is"):
+		condition.Operator = "is null"
+		if p.keyword("not") {
+			condition.Operator = "is not null"
+		}
+		if !p.keyword("null") {
+			return condition, fmt.Errorf("expected 'null' after 'is' for column %s", column.value)
+		}
+		return condition, nil
+	case p.keyword("not"):
+		if !p.keyword("in") {
+			return condition, fmt.Errorf("expected 'in' after 'not' for column %s", column.value)
+		}
+		condition.Operator = "not in"
+	case p.keyword("in"):
+		condition.Operator = "in"
+	default:
+		op := p.next()
+		if op.kind != "op" {
+			return condition, fmt.Errorf("expected operator after column %s, got %q", column.value, op.value)
+		}
+		condition.Operator = op.value
+		value, err := p.literal()
+		if err != nil {
+			return condition, err
+		}
+		if value == nil {
+			return condition, fmt.Errorf("use 'is null' instead of comparing %s with null", column.value)
+		}
+		condition.Values = []interface{}{value}
+		return condition, nil
+	}
+
+	// in / not in list
+	if open := p.next(); open.value != "(" {
+		return condition, fmt.Errorf("expected '(' after %s for column %s", condition.Operator, column.value)
+	}
+	for {
+		value, err := p.literal()
+		if err != nil {
+			return condition, err
+		}
+		condition.Values = append(condition.Values, value)
+
+		separator := p.next()
+		if separator.value == ")" {
+			return condition, nil
+		}
+		if separator.value != "," {
+			return condition, fmt.Errorf("expected ',' or ')' in list for column %s", column.value)
+		}
+	}
+}
+
+// literal parses a number, quoted string, true, false or null
+func (p *filterParser) literal() (interface{}, error) {
+	token := p.next()
+	switch token.kind {
+	case "number":
+		value, _ := strconv.ParseFloat(token.value, 64)
+		return value, nil
+	case "string":
+		return token.value, nil
+	case "ident":
+		switch strings.ToLower(token.value) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("expected a value, got %q", token.value)
+}
+
+// Matches evaluates the filter against a decoded row. Rows missing a referenced column do not match.
+func (f *rowFilter) Matches(row map[string]interface{}) bool {
+	for _, condition := range f.Conditions {
+		if !condition.matches(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// mightMatch evaluates the filter against a partial row image, treating absent columns as matching
+func (f *rowFilter) mightMatch(row map[string]interface{}) bool {
+	for _, condition := range f.Conditions {
+		if _, exists := row[condition.Column]; exists && !condition.matches(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches evaluates a single condition
+func (c filterCondition) matches(row map[string]interface{}) bool {
+	value, exists := row[c.Column]
+	if !exists {
+		return false
+	}
+
+	switch c.Operator {
+	case "is null":
+		return value == nil
+	case "is not null":
+		return value != nil
+	case "in", "not in":
+		found := false
+		for _, candidate := range c.Values {
+			if cmp, ok := compareFilterValues(value, candidate); ok && cmp == 0 {
+				found = true
+				break
+			}
+		}
+		return found == (c.Operator == "in")
+	}
+
+	if value == nil {
+		return false
+	}
+	cmp, ok := compareFilterValues(value, c.Values[0])
+	if !ok {
+		return c.Operator == "!="
+	}
+	switch c.Operator {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareFilterValues compares a row value with a literal, coercing numeric strings
+func compareFilterValues(value, literal interface{}) (int, bool) {
+	if value == nil || literal == nil {
+		return 0, value == literal
+	}
+
+	switch lit := literal.(type) {
+	case float64:
+		var number float64
+		switch v := value.(type) {
+		case json.Number:
+			parsed, err := v.Float64()
+			if err != nil {
+				return 0, false
+			}
+			number = parsed
+		case string:
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, false
+			}
+			number = parsed
+		default:
+			return 0, false
+		}
+		switch {
+		case number < lit:
+			return -1, true
+		case number > lit:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case json.Number:
+			text = v.String()
+		default:
+			return 0, false
+		}
+		return strings.Compare(text, lit), true
+	case bool:
+		b, ok := value.(bool)
+		if !ok || b != lit {
+			return 1, ok
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// decodeRowImage decodes a row_to_json image keeping numbers exact
+func decodeRowImage(raw json.RawMessage) map[string]interface{} {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var row map[string]interface{}
+	if err := decoder.Decode(&row); err != nil {
+		return nil
+	}
+	return row
+}
+
+// changeImages lazily decodes the row images of a change so filters share one decode per broadcast
+type changeImages struct {
+	message *PublicationMessage
+	decoded bool
+	newRow  map[string]interface{}
+	oldRow  map[string]interface{}
+}
+
+// rows returns the decoded new and old images
+func (ci *changeImages) rows() (map[string]interface{}, map[string]interface{}) {
+	if !ci.decoded {
+		ci.newRow = decodeRowImage(ci.message.NewData)
+		ci.oldRow = decodeRowImage(ci.message.OldData)
+		ci.decoded = true
+	}
+	return ci.newRow, ci.oldRow
+}
+
+// rowAccess decides the row-level visibility of a change for one session. Rules are evaluated
+// against the unredacted images so hiding a column never widens access.
+type rowAccess struct {
+	images  *changeImages
+	visible func(row map[string]interface{}) bool
+}
+
+// check reports whether the new and old images are visible (missing images count as visible)
+func (a *rowAccess) check() (bool, bool) {
+	newRow, oldRow := a.images.rows()
+	return newRow == nil || a.visible(newRow), oldRow == nil || a.visible(oldRow)
+}
+
+// filterChange applies the session's subscriptions and row visibility to a change. An UPDATE that moves
+// a row into view is delivered as a synthetic INSERT, one that moves it out as a synthetic DELETE carrying
+// only the row id. When the old image lacks filtered columns (reference payloads, replica identity default)
+// those conditions are assumed to have matched, so clients at worst receive a DELETE for a row they never had.
+// When only is set, that subscription is evaluated instead of all of the session's subscriptions.
+func (wsSession *WebSocketSession) filterChange(message PublicationMessage, images *changeImages, access *rowAccess, only *Subscription) (PublicationMessage, bool) {
+	wsSession.mutex.Lock()
+	defer wsSession.mutex.Unlock()
+
+	subscriptions := wsSession.subscriptions
+	if only != nil {
+		subscriptions = map[string]*Subscription{only.ID: only}
+	}
+
+	subscribed, had, has := false, false, false
+	for _, subscription := range subscriptions {
+		if !subscription.matchesTable(message.Table) {
+			continue
+		}
+		if subscription.snapshot != nil && subscription.snapshot.includes(message.TxID) {
+			continue
+		}
+		subscribed = true
+		if subscription.Filter == nil {
+			had, has = true, true
+			break
+		}
+
+		newRow, oldRow := images.rows()
+		if newRow != nil && subscription.Filter.Matches(newRow) {
+			has = true
+		}
+		if oldRow == nil || subscription.Filter.mightMatch(oldRow) {
+			had = true
+		}
+	}
+	if !subscribed {
+		return message, false
+	}
+
+	if access != nil && (message.Operation == "INSERT" || message.Operation == "UPDATE" || message.Operation == "DELETE") {
+		newVisible, oldVisible := access.check()
+		has = has && newVisible
+		had = had && oldVisible
+	}
+
+	switch message.Operation {
+	case "INSERT":
+		return message, has
+	case "DELETE":
+		return message, had
+	case "UPDATE":
+		switch {
+		case had && has:
+			return message, true
+		case has:
+			message.Operation = "INSERT"
+			message.OldData = nil
+			message.Synthetic = true
+			message.Message = fmt.Sprintf("Record moved into view on %s.%s", message.TenantName, message.Table)
+			return message, true
+		case had:
+			newRow, _ := images.rows()
+			id, exists := newRow["id"]
+			if !exists {
+				return message, false
+			}
+			identity, err := json.Marshal(map[string]interface{}{"id": id})
+			if err != nil {
+				return message, false
+			}
+			message.Operation = "DELETE"
+			message.OldData = identity
+			message.NewData = nil
+			message.Synthetic = true
+			message.Message = fmt.Sprintf("Record moved out of view on %s.%s", message.TenantName, message.Table)
+			return message, true
+		}
+		return message, false
+	}
+
+	// TRUNCATE and other table-level operations reach every subscriber of the table
+	return message, true
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var historyFileNamePattern = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// historyEntry is a sequenced change retained for replay to reconnecting clients
+type historyEntry struct {
+	Message    PublicationMessage `json:"message"`
+	unredacted *PublicationMessage
+}
+
+// authMessage returns the images used to authorize a replayed entry. Entries loaded from disk only
+// keep the redacted images, so sensitive columns never reach the history file.
+func (entry *historyEntry) authMessage() *PublicationMessage {
+	if entry.unredacted != nil {
+		return entry.unredacted
+	}
+	return &entry.Message
+}
+
+// tenantHistory sequences the changes of a tenant and keeps the most recent ones for resumption.
+// Sequence numbers start at the engine start time in microseconds, so they keep increasing across
+// restarts and a client resuming from a previous run is detected as a gap instead of a replay.
+type tenantHistory struct {
+	publish sync.Mutex // held while a change is sequenced and broadcast, and while a subscription replays
+	mutex   sync.Mutex // guards the fields below
+
+	tenantName string
+	entries    []historyEntry
+	capacity   int
+	nextSeq    uint64
+
+	file      *os.File
+	fileLines int
+
+	transaction []bufferedChange // changes of the transaction being collected, guarded by publish
+}
+
+// historyFor returns the history of a tenant, creating (and loading) it on first use
+func (e *RealtimeEngine) historyFor(tenantName string) *tenantHistory {
+	e.historyMutex.Lock()
+	defer e.historyMutex.Unlock()
+
+	if history, exists := e.histories[tenantName]; exists {
+		return history
+	}
+
+	history := &tenantHistory{
+		tenantName: tenantName,
+		capacity:   getIntEnv(config.HistorySize, 1000),
+		nextSeq:    uint64(time.Now().UnixMicro()),
+	}
+	if config.HistoryDir != "" {
+		// Without replay the source lost whatever happened while the engine was down
+		resumable := changeSourceForTenant(tenantName) != changeSourceNotify
+		if err := history.openStore(config.HistoryDir, resumable); err != nil {
+			log.Printf("⚠️  History for tenant %s is memory only: %v", tenantName, err)
+		}
+	}
+	e.histories[tenantName] = history
+	return history
+}
+
+// openStore loads the retained entries from disk (when load is set) and opens the file for appending
+func (h *tenantHistory) openStore(dir string, load bool) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+	filename := filepath.Join(dir, historyFileNamePattern.ReplaceAllString(h.tenantName, "_")+".jsonl")
+
+	if load {
+		if file, err := os.Open(filename); err == nil {
+			scanner := bufio.NewScanner(file)
+			scanner.Buffer(make([]byte, 64*1024), maxMessageSize*4)
+			for scanner.Scan() {
+				var entry historyEntry
+				if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+					continue
+				}
+				h.entries = append(h.entries, entry)
+			}
+			file.Close()
+
+			if len(h.entries) > h.capacity {
+				h.entries = append([]historyEntry(nil), h.entries[len(h.entries)-h.capacity:]...)
+			}
+			if len(h.entries) > 0 {
+				h.nextSeq = h.entries[len(h.entries)-1].Message.Seq + 1
+				log.Printf("📜 Loaded %d history entries for tenant %s (last seq: %d)",
+					len(h.entries), h.tenantName, h.nextSeq-1)
+			}
+		}
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	h.file = file
+	h.fileLines = 0
+	for i := range h.entries {
+		h.writeEntry(&h.entries[i])
+	}
+	return nil
+}
+
+// writeEntry appends an entry to the history file
+func (h *tenantHistory) writeEntry(entry *historyEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err := h.file.Write(append(line, '\n')); err != nil {
+		log.Printf("⚠️  Failed to write history for tenant %s, continuing memory only: %v", h.tenantName, err)
+		h.file.Close()
+		h.file = nil
+		return
+	}
+	h.fileLines++
+}
+
+// compactStore rewrites the history file with the retained entries only
+func (h *tenantHistory) compactStore() {
+	if err := h.file.Truncate(0); err != nil {
+		log.Printf("⚠️  Failed to compact history for tenant %s: %v", h.tenantName, err)
+		return
+	}
+	h.file.Seek(0, 0)
+	h.fileLines = 0
+	for i := range h.entries {
+		if h.file == nil {
+			return
+		}
+		h.writeEntry(&h.entries[i])
+	}
+}
+
+// append assigns the next sequence number to a change and retains it
+func (h *tenantHistory) append(message PublicationMessage, unredacted *PublicationMessage) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	seq := h.nextSeq
+	h.nextSeq++
+
+	message.Seq = seq
+	authCopy := *unredacted
+	authCopy.Seq = seq
+	h.entries = append(h.entries, historyEntry{Message: message, unredacted: &authCopy})
+	if len(h.entries) > h.capacity {
+		// Copy once in a while instead of reslicing forever so dropped entries can be collected
+		if cap(h.entries) > 2*h.capacity {
+			h.entries = append(make([]historyEntry, 0, h.capacity+1), h.entries[len(h.entries)-h.capacity:]...)
+		} else {
+			h.entries = h.entries[len(h.entries)-h.capacity:]
+		}
+	}
+
+	if h.file != nil {
+		h.writeEntry(&h.entries[len(h.entries)-1])
+		if h.file != nil && h.fileLines > 2*h.capacity {
+			h.compactStore()
+		}
+	}
+	return seq
+}
+
+// lastSeq returns the sequence number of the latest change
+func (h *tenantHistory) lastSeq() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.nextSeq - 1
+}
+
+// since returns the retained changes after a sequence number; false when some of them are gone
+func (h *tenantHistory) since(after uint64) ([]historyEntry, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	latest := h.nextSeq - 1
+	switch {
+	case after == latest:
+		return nil, true
+	case after > latest:
+		return nil, false
+	}
+
+	oldest := h.nextSeq
+	if len(h.entries) > 0 {
+		oldest = h.entries[0].Message.Seq
+	}
+	if after+1 < oldest {
+		return nil, false
+	}
+
+	start := len(h.entries) - int(latest-after)
+	return append([]historyEntry(nil), h.entries[start:]...), true
+}
+
+// breakContinuity forgets the history after changes may have been lost, so resuming clients resync
+func (h *tenantHistory) breakContinuity() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.entries = nil
+	if now := uint64(time.Now().UnixMicro()); now > h.nextSeq {
+		h.nextSeq = now
+	} else {
+		h.nextSeq++
+	}
+	if h.file != nil {
+		h.compactStore()
+	}
+}
+
+// sendResyncRequired tells a single session that it must reload its data from the server
+func (e *RealtimeEngine) sendResyncRequired(wsSession *WebSocketSession, reason string) {
+	e.sendMessage(wsSession, SystemMessage{
+		Type:      "system",
+		Operation: "resync_required",
+		Message:   "Some changes are no longer available - reload data from the server",
+		Data: map[string]interface{}{
+			"tenant_name": wsSession.Tenant,
+			"reason":      reason,
+		},
+		Timestamp: time.Now().Format(time.RFC3339),
+		SessionId: wsSession.ID,
+	})
+}
+
+// replayHistory delivers the retained changes after a sequence number to a new subscription.
+// The caller holds history.publish so live changes cannot overtake the replay.
+func (e *RealtimeEngine) replayHistory(history *tenantHistory, wsSession *WebSocketSession, subscription *Subscription, after uint64) (int, bool) {
+	entries, ok := history.since(after)
+	if !ok {
+		return 0, false
+	}
+
+	e.mutex.RLock()
+	authSession, exists := e.authenticatedSessions[wsSession.ID]
+	e.mutex.RUnlock()
+	if !exists {
+		return 0, true
+	}
+
+	// Consecutive changes of one transaction are replayed together, as they were delivered live
+	replayed := 0
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && entries[start].Message.TxID != 0 && entries[end].Message.TxID == entries[start].Message.TxID {
+			end++
+		}
+		deliveries := make([]*changeDelivery, 0, end-start)
+		for i := start; i < end; i++ {
+			deliveries = append(deliveries, e.newChangeDelivery(entries[i].Message, &changeImages{message: entries[i].authMessage()}))
+		}
+		delivered, err := e.deliverGroup(deliveries, wsSession, authSession, subscription, transactionEnvelope, nil)
+		replayed += delivered
+		if err != nil {
+			break
+		}
+		start = end
+	}
+	return replayed, true
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -13,21 +14,45 @@ import (
 )
 
 func main() {
+	initConfig()
+
 	engine := &RealtimeEngine{
 		tenantDBs:             make(map[string]*sql.DB),
 		sessions:              make(map[string]*WebSocketSession),
 		authenticatedSessions: make(map[string]*AuthenticatedSession),
 		tokenCache:            make(map[string]*CachedToken),
+		listeners:             make(map[string]*tenantListener),
+		grantRefreshTimers:    make(map[string]*time.Timer),
+		deliveryStats:         make(map[string]*tenantDeliveryStats),
+		histories:             make(map[string]*tenantHistory),
+		ackStates:             make(map[string]*ackState),
+		snapshots:             make(map[string]*openSnapshot),
+		debounceWindows:       make(map[string]*debounceWindow),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				// Allow all origins for development - be more restrictive in production
 				return true
 			},
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
+			Subprotocols:      wireProtocols,
+			EnableCompression: getBoolEnv(config.Compression, true),
+			ReadBufferSize:    4096,
+			WriteBufferSize:   16384,
+			// Write buffers are only held while a frame is written, so idle sessions cost no buffer
+			WriteBufferPool: &sync.Pool{},
 		},
 	}
 
+	authorizer, err := newChangeAuthorizer()
+	if err != nil {
+		log.Fatalf("❌ Invalid authorization configuration: %v", err)
+	}
+	engine.authorizer = authorizer
+	log.Printf("🔐 Change authorization mode: %s", authorizer.Name())
+
+	if err := validateDebounceTables(); err != nil {
+		log.Fatalf("❌ Invalid debounce configuration: %v", err)
+	}
+
 	// Connect to landlord database
 	if err := engine.connectToLandlord(); err != nil {
 		log.Printf("⚠️  Failed to connect to landlord database: %v", err)
@@ -42,6 +67,11 @@ func main() {
 		}
 	}
 
+	// Load column redaction rules before any change is broadcast
+	if err := engine.reloadRedactionRules(); err != nil {
+		log.Fatalf("❌ Invalid redaction rules: %v", err)
+	}
+
 	// Start listening to publications from tenant databases (only if we have database connections)
 	if engine.landlordDB != nil && len(engine.tenantDBs) > 0 {
 		go engine.startPublicationListeners()
@@ -58,6 +88,53 @@ func main() {
 		}
 	}()
 
+	// Start periodic grant reload (permission table changes also trigger reloads)
+	go func() {
+		ticker := time.NewTicker(getDurationEnv(config.AuthorizationRefreshInterval, 5*time.Minute))
+		defer ticker.Stop()
+		for range ticker.C {
+			engine.refreshSessionGrants("")
+		}
+	}()
+
+	// Start periodic redaction rule reload (picks up landlord table edits)
+	go func() {
+		ticker := time.NewTicker(getDurationEnv(config.RedactionRefreshInterval, time.Minute))
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := engine.reloadRedactionRules(); err != nil {
+				log.Printf("⚠️  Failed to reload redaction rules, keeping previous rules: %v", err)
+			}
+		}
+	}()
+
+	// Start retransmission of unacknowledged changes to clients in ack mode
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			engine.checkAckStates()
+		}
+	}()
+
+	// Start idle snapshot cleanup routine
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			engine.expireSnapshots()
+		}
+	}()
+
+	// Start tombstone pruning routine
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			engine.pruneTombstones()
+		}
+	}()
+
 	// Start zombie session cleanup routine
 	go func() {
 		ticker := time.NewTicker(30 * time.Second) // Clean up every 30 seconds
@@ -113,6 +190,9 @@ func main() {
 	log.Printf("   POST /api/sessions/disconnect-all - Disconnect all sessions")
 	log.Printf("   POST /api/tenants/reload - Reload and connect to new tenants")
 	log.Printf("   POST /api/tenants/test-notification - Test tenant notification system")
+	log.Printf("   GET  /api/tenants/channels - List channels each tenant listener is subscribed to")
+	log.Printf("   GET  /api/tenants/triggers - Inspect tenant change triggers")
+	log.Printf("   POST /api/tenants/triggers/sync - Install or upgrade tenant change triggers")
 	log.Printf("   POST /api/broadcast - Broadcast message to all sessions")
 
 	// Start HTTP server with Fiber
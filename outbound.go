@@ -0,0 +1,445 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Slow-consumer policies applied when a session's send queue is full
+const (
+	slowConsumerDropOldest = "drop_oldest" // discard the oldest queued frame
+	slowConsumerCoalesce   = "coalesce"    // replace the queued frame of the same row by the newest one, disconnect when there is none
+	slowConsumerDisconnect = "disconnect"  // close the session with a resync_required reason
+)
+
+// closeResyncRequired is the application close code telling clients to reload from scratch
+const closeResyncRequired = 4000
+
+var (
+	errSendQueueFull = errors.New("send queue full")
+	errSessionClosed = errors.New("session closed")
+)
+
+// outboundFrame is a frame waiting in a session's send queue
+type outboundFrame struct {
+	messageType int
+	data        []byte
+	prepared    *websocket.PreparedMessage // shared with other sessions, nil for frames of this session only
+	rowKey      string                     // table:id of the row the frame describes, used to coalesce
+	operation   string                     // change operation of a row frame
+
+	// asInsert re-encodes an UPDATE as an INSERT, for when it replaces the INSERT of its row
+	asInsert func() (outboundFrame, error)
+}
+
+// pushResult tells how a frame was admitted into a full queue
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	pushDroppedOldest
+	pushCoalesced
+	pushOverflow
+	pushClosing
+)
+
+// outboundQueue is the bounded send queue of a session, drained only by writePump
+type outboundQueue struct {
+	mutex     sync.Mutex
+	frames    []outboundFrame
+	limit     int
+	policy    string
+	ready     chan struct{} // signalled when frames are added
+	closing   bool          // a close frame is queued, nothing may follow it
+	maxDepth  int
+	dropped   int64
+	coalesced int64
+
+	forcedDisconnects int64
+}
+
+// push adds a frame, applying the slow-consumer policy when the queue is full.
+// Control frames (close) are always admitted.
+func (q *outboundQueue) push(frame outboundFrame) pushResult {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closing {
+		return pushClosing
+	}
+	if frame.messageType == websocket.CloseMessage {
+		q.closing = true
+	}
+
+	result := pushQueued
+	if len(q.frames) >= q.limit && frame.messageType != websocket.CloseMessage {
+		switch q.policy {
+		case slowConsumerDropOldest:
+			q.frames = q.frames[1:]
+			q.dropped++
+			result = pushDroppedOldest
+		case slowConsumerCoalesce:
+			replaced := -1
+			for i := len(q.frames) - 1; i >= 0 && frame.rowKey != ""; i-- {
+				if q.frames[i].rowKey == frame.rowKey {
+					replaced = i
+					break
+				}
+			}
+			if replaced < 0 {
+				return pushOverflow
+			}
+
+			// The client never saw the row, so the replacement is still an insert, or nothing at all
+			if q.frames[replaced].operation == "INSERT" {
+				switch frame.operation {
+				case "DELETE":
+					q.frames = append(q.frames[:replaced], q.frames[replaced+1:]...)
+					q.coalesced++
+					return pushCoalesced
+				case "UPDATE":
+					if frame.asInsert == nil {
+						return pushOverflow
+					}
+					insert, err := frame.asInsert()
+					if err != nil {
+						log.Printf("❌ Failed to encode coalesced insert: %v", err)
+						return pushOverflow
+					}
+					frame = insert
+				}
+			}
+
+			// The replacement is queued last, after the frames queued since the replaced one
+			q.frames = append(q.frames[:replaced], q.frames[replaced+1:]...)
+			q.coalesced++
+			result = pushCoalesced
+		default:
+			return pushOverflow
+		}
+	}
+
+	q.frames = append(q.frames, frame)
+	if len(q.frames) > q.maxDepth {
+		q.maxDepth = len(q.frames)
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+// pop takes the oldest queued frame for writing. Only frames still queued count towards
+// the limit and can be coalesced, not the one writePump is busy writing.
+func (q *outboundQueue) pop() (outboundFrame, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.frames) == 0 {
+		return outboundFrame{}, false
+	}
+	frame := q.frames[0]
+	q.frames[0] = outboundFrame{}
+	q.frames = q.frames[1:]
+	return frame, true
+}
+
+// forceDisconnect discards every queued frame of a session disconnected for falling behind and
+// returns how many were discarded
+func (q *outboundQueue) forceDisconnect() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	discarded := int64(len(q.frames))
+	q.dropped += discarded
+	q.frames = nil
+	q.forcedDisconnects++
+	return discarded
+}
+
+// stats returns the current depth and counters of the queue
+func (q *outboundQueue) stats() (depth, maxDepth int, dropped, coalesced, forcedDisconnects int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.frames), q.maxDepth, q.dropped, q.coalesced, q.forcedDisconnects
+}
+
+// tenantDeliveryStats accumulates slow-consumer events of a tenant across sessions
+type tenantDeliveryStats struct {
+	dropped           int64
+	coalesced         int64
+	forcedDisconnects int64
+
+	// Byte counters of closed sessions; open sessions keep their own
+	frameBytes       int64
+	wireBytes        int64
+	compressedFrames int64
+}
+
+// newSessionQueue initializes the send queue of a session with its tenant's slow-consumer policy
+func (wsSession *WebSocketSession) newSessionQueue() {
+	wsSession.queue = &outboundQueue{
+		limit:  getIntEnv(config.SendQueueSize, 256),
+		policy: slowConsumerPolicyForTenant(wsSession.Tenant),
+		ready:  make(chan struct{}, 1),
+	}
+	wsSession.pongs = make(chan string, 1)
+	wsSession.done = make(chan struct{})
+}
+
+// enqueue queues a frame for writePump without blocking the caller
+func (wsSession *WebSocketSession) enqueue(frame outboundFrame) (pushResult, error) {
+	select {
+	case <-wsSession.done:
+		return pushOverflow, errSessionClosed
+	default:
+	}
+
+	switch result := wsSession.queue.push(frame); result {
+	case pushOverflow:
+		return result, errSendQueueFull
+	case pushClosing:
+		return result, errSessionClosed
+	default:
+		return result, nil
+	}
+}
+
+// close asks writePump to send a close frame after the frames already queued and to shut the connection down
+func (wsSession *WebSocketSession) close(code int, reason string) {
+	wsSession.enqueue(outboundFrame{
+		messageType: websocket.CloseMessage,
+		data:        websocket.FormatCloseMessage(code, reason),
+	})
+}
+
+// stop signals writePump to exit immediately
+func (wsSession *WebSocketSession) stop() {
+	wsSession.doneOnce.Do(func() {
+		close(wsSession.done)
+	})
+}
+
+// queueMessage encodes a message in the session's wire format and queues it
+func (e *RealtimeEngine) queueMessage(wsSession *WebSocketSession, message interface{}, rowKey string) error {
+	data, err := wsSession.format.encode(message)
+	if err != nil {
+		log.Printf("❌ Failed to encode %s message for session %s: %v", wsSession.format.protocol, wsSession.ID, err)
+		return err
+	}
+	return e.queueFrame(wsSession, data, rowKey)
+}
+
+// queueFrame queues an encoded frame for a session
+func (e *RealtimeEngine) queueFrame(wsSession *WebSocketSession, data []byte, rowKey string) error {
+	return e.queueOutbound(wsSession, outboundFrame{messageType: wsSession.format.messageType, data: data, rowKey: rowKey})
+}
+
+// queueShared queues a frame shared with other sessions
+func (e *RealtimeEngine) queueShared(wsSession *WebSocketSession, frame *sharedFrame, rowKey string) error {
+	return e.queueOutbound(wsSession, outboundFrame{
+		messageType: wsSession.format.messageType,
+		data:        frame.data,
+		prepared:    frame.prepared,
+		rowKey:      rowKey,
+	})
+}
+
+// queueChange queues the frame of a change for a session
+func (e *RealtimeEngine) queueChange(wsSession *WebSocketSession, delivery *changeDelivery, frame *sessionFrame) error {
+	shared, err := delivery.encode(frame)
+	if err != nil {
+		log.Printf("❌ Failed to encode %s message for session %s: %v", wsSession.format.protocol, wsSession.ID, err)
+		return err
+	}
+	return e.queueOutbound(wsSession, delivery.outbound(frame, shared, wsSession.queue.policy == slowConsumerCoalesce))
+}
+
+// queueOutbound queues a frame and applies the slow-consumer policy of the session's tenant
+func (e *RealtimeEngine) queueOutbound(wsSession *WebSocketSession, frame outboundFrame) error {
+	result, err := wsSession.enqueue(frame)
+
+	switch result {
+	case pushDroppedOldest:
+		e.recordDeliveryEvent(wsSession.Tenant, func(stats *tenantDeliveryStats) { stats.dropped++ })
+	case pushCoalesced:
+		e.recordDeliveryEvent(wsSession.Tenant, func(stats *tenantDeliveryStats) { stats.coalesced++ })
+	}
+
+	if err == errSendQueueFull {
+		log.Printf("🐌 Send queue full for session %s (tenant: %s, policy: %s) - disconnecting with resync_required",
+			wsSession.ID, wsSession.Tenant, wsSession.queue.policy)
+		// The client reloads everything after reconnecting, so the backlog is worthless
+		discarded := wsSession.queue.forceDisconnect()
+		e.recordDeliveryEvent(wsSession.Tenant, func(stats *tenantDeliveryStats) {
+			stats.forcedDisconnects++
+			stats.dropped += discarded
+		})
+		wsSession.close(closeResyncRequired, "resync_required")
+	}
+	return err
+}
+
+// recordDeliveryEvent updates the slow-consumer counters of a tenant
+func (e *RealtimeEngine) recordDeliveryEvent(tenantName string, update func(stats *tenantDeliveryStats)) {
+	e.deliveryMutex.Lock()
+	defer e.deliveryMutex.Unlock()
+
+	stats, exists := e.deliveryStats[tenantName]
+	if !exists {
+		stats = &tenantDeliveryStats{}
+		e.deliveryStats[tenantName] = stats
+	}
+	update(stats)
+}
+
+// writePump is the only goroutine writing to the session's connection: it drains the send queue and sends pings
+func (e *RealtimeEngine) writePump(wsSession *WebSocketSession) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		wsSession.stop()
+		wsSession.Conn.Close()
+		e.recordCompressionStats(wsSession)
+	}()
+
+	for {
+		select {
+		case <-wsSession.queue.ready:
+			for {
+				frame, ok := wsSession.queue.pop()
+				if !ok {
+					break
+				}
+				wsSession.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := wsSession.writeFrame(frame); err != nil {
+					log.Printf("❌ WebSocket write error for session %s: %v", wsSession.ID, err)
+					return
+				}
+				if frame.messageType == websocket.CloseMessage {
+					return
+				}
+			}
+		case <-ticker.C:
+			wsSession.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := wsSession.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("❌ WebSocket ping error for session %s: %v", wsSession.ID, err)
+				return
+			}
+		case appData := <-wsSession.pongs:
+			wsSession.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := wsSession.Conn.WriteMessage(websocket.PongMessage, []byte(appData)); err != nil {
+				log.Printf("❌ WebSocket pong error for session %s: %v", wsSession.ID, err)
+				return
+			}
+		case <-wsSession.done:
+			return
+		}
+	}
+}
+
+// changeRowKey identifies the row of a change for coalescing ("" when the row has no id)
+func changeRowKey(table string, images *changeImages) string {
+	newRow, oldRow := images.rows()
+	row := newRow
+	if row == nil {
+		row = oldRow
+	}
+	id, exists := row["id"]
+	if !exists || id == nil {
+		return ""
+	}
+	return table + ":" + fmt.Sprint(id)
+}
+
+// GetDeliveryMetrics returns send queue depth and slow-consumer counters per session and per tenant (implements HealthEngineInterface)
+func (e *RealtimeEngine) GetDeliveryMetrics() map[string]interface{} {
+	e.mutex.RLock()
+	sessions := make([]*WebSocketSession, 0, len(e.sessions))
+	for _, wsSession := range e.sessions {
+		sessions = append(sessions, wsSession)
+	}
+	e.mutex.RUnlock()
+
+	tenants := make(map[string]map[string]interface{})
+	tenantEntry := func(tenantName string) map[string]interface{} {
+		entry, exists := tenants[tenantName]
+		if !exists {
+			entry = map[string]interface{}{
+				"sessions":           0,
+				"queued":             0,
+				"dropped":            int64(0),
+				"coalesced":          int64(0),
+				"forced_disconnects": int64(0),
+				"frame_bytes":        int64(0),
+				"wire_bytes":         int64(0),
+				"compressed_frames":  int64(0),
+			}
+			tenants[tenantName] = entry
+		}
+		return entry
+	}
+
+	sessionMetrics := make([]map[string]interface{}, 0, len(sessions))
+	for _, wsSession := range sessions {
+		depth, maxDepth, dropped, coalesced, forcedDisconnects := wsSession.queue.stats()
+		frameBytes, wireBytes := wsSession.frameBytes.Load(), wsSession.wireBytes.Load()
+		compressedFrames := wsSession.compressedFrames.Load()
+		sessionMetrics = append(sessionMetrics, map[string]interface{}{
+			"session_id":         wsSession.ID,
+			"tenant":             wsSession.Tenant,
+			"user_id":            wsSession.UserID,
+			"policy":             wsSession.queue.policy,
+			"depth":              depth,
+			"max_depth":          maxDepth,
+			"limit":              wsSession.queue.limit,
+			"dropped":            dropped,
+			"coalesced":          coalesced,
+			"forced_disconnects": forcedDisconnects,
+			"compression":        wsSession.compression,
+			"frame_bytes":        frameBytes,
+			"wire_bytes":         wireBytes,
+			"compressed_frames":  compressedFrames,
+		})
+
+		entry := tenantEntry(wsSession.Tenant)
+		entry["sessions"] = entry["sessions"].(int) + 1
+		entry["queued"] = entry["queued"].(int) + depth
+		entry["frame_bytes"] = entry["frame_bytes"].(int64) + frameBytes
+		entry["wire_bytes"] = entry["wire_bytes"].(int64) + wireBytes
+		entry["compressed_frames"] = entry["compressed_frames"].(int64) + compressedFrames
+	}
+	sort.Slice(sessionMetrics, func(i, j int) bool {
+		return sessionMetrics[i]["depth"].(int) > sessionMetrics[j]["depth"].(int)
+	})
+
+	e.deliveryMutex.Lock()
+	for tenantName, stats := range e.deliveryStats {
+		entry := tenantEntry(tenantName)
+		entry["dropped"] = stats.dropped
+		entry["coalesced"] = stats.coalesced
+		entry["forced_disconnects"] = stats.forcedDisconnects
+		entry["frame_bytes"] = entry["frame_bytes"].(int64) + stats.frameBytes
+		entry["wire_bytes"] = entry["wire_bytes"].(int64) + stats.wireBytes
+		entry["compressed_frames"] = entry["compressed_frames"].(int64) + stats.compressedFrames
+	}
+	e.deliveryMutex.Unlock()
+
+	// Bytes on the wire (frame headers included) per byte of encoded frames
+	for _, entry := range tenants {
+		entry["compression_ratio"] = compressionRatio(entry["frame_bytes"].(int64), entry["wire_bytes"].(int64))
+	}
+
+	return map[string]interface{}{
+		"sessions": sessionMetrics,
+		"tenants":  tenants,
+	}
+}
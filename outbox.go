@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// outboxChannel carries the wake-up signal sent after outbox rows are committed
+	outboxChannel = "whagons_rte_outbox"
+
+	// outboxBatchSize caps the number of outbox rows delivered per drain query
+	outboxBatchSize = 500
+
+	// outboxSweepInterval drains the outbox even without a wake-up (missed signals, reconnects)
+	outboxSweepInterval = 30 * time.Second
+
+	// outboxPruneInterval is how often delivered rows older than the retention are deleted
+	outboxPruneInterval = time.Hour
+)
+
+// outboxChangeSource drains the whagons_rte_outbox table filled by tenant triggers.
+// pg_notify only wakes the engine up, the rows themselves are durable, so nothing is lost
+// while the engine is down and no payload limit applies. Works without wal_level=logical.
+type outboxChangeSource struct {
+	engine     *RealtimeEngine
+	tenantName string
+	dbName     string
+	held       []heldOutboxRows
+}
+
+// heldOutboxRows are published outbox rows only marked delivered once their debounced changes were delivered
+type heldOutboxRows struct {
+	ids     []int64
+	barrier debounceBarrier
+}
+
+// Name implements ChangeSource
+func (s *outboxChangeSource) Name() string {
+	return changeSourceOutbox
+}
+
+// Resumable implements ChangeSource - undelivered rows stay in the outbox until drained
+func (s *outboxChangeSource) Resumable() bool {
+	return true
+}
+
+// Run implements ChangeSource
+func (s *outboxChangeSource) Run(stop <-chan struct{}) error {
+	s.engine.mutex.RLock()
+	tenantDB, exists := s.engine.tenantDBs[s.tenantName]
+	s.engine.mutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("tenant database connection not found for %s", s.tenantName)
+	}
+
+	if err := s.engine.setupTenantOutbox(s.tenantName, tenantDB); err != nil {
+		return err
+	}
+
+	listener := pq.NewListener(
+		postgresConnString(s.dbName),
+		10*time.Second,
+		time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("❌ Outbox listener error for %s: %v", s.tenantName, err)
+			}
+		})
+	defer listener.Close()
+
+	if err := listener.Listen(outboxChannel); err != nil {
+		return fmt.Errorf("failed to listen to %s for tenant %s: %w", outboxChannel, s.tenantName, err)
+	}
+
+	log.Printf("📡 Draining outbox for tenant: %s", s.tenantName)
+	s.engine.recordListenerChannels(s.tenantName, []string{outboxChannel})
+
+	retention := getDurationEnv(config.OutboxRetention, 24*time.Hour)
+	sweep := time.NewTicker(outboxSweepInterval)
+	defer sweep.Stop()
+	prune := time.NewTicker(outboxPruneInterval)
+	defer prune.Stop()
+
+	// Deliver whatever accumulated while the engine was not running
+	if err := s.drain(tenantDB); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-listener.Notify:
+			// Wake-up (or nil after a reconnect) - the outbox is the source of truth either way
+			if err := s.drain(tenantDB); err != nil {
+				return err
+			}
+		case <-sweep.C:
+			if err := listener.Ping(); err != nil {
+				return fmt.Errorf("outbox listener ping failed for tenant %s: %w", s.tenantName, err)
+			}
+			if err := s.drain(tenantDB); err != nil {
+				return err
+			}
+		case <-prune.C:
+			s.prune(tenantDB, retention)
+		}
+	}
+}
+
+// drain delivers undelivered outbox rows in id order and marks them delivered.
+// Rows are marked after publishing, and after their debounce window was flushed, so a crash
+// in between redelivers rather than loses them.
+func (s *outboxChangeSource) drain(db *sql.DB) error {
+	if err := s.markReleased(db); err != nil {
+		return err
+	}
+
+	for {
+		// Rows held for a debounce window were published already
+		heldIDs := []int64{} // a nil array would exclude every row
+		for _, held := range s.held {
+			heldIDs = append(heldIDs, held.ids...)
+		}
+
+		rows, err := db.Query(`
+			SELECT id, table_name, op, new_data, old_data, extract(epoch from created_at), txid
+			FROM whagons_rte_outbox
+			WHERE delivered_at IS NULL
+			AND NOT (id = ANY($2))
+			ORDER BY id
+			LIMIT $1`, outboxBatchSize, pq.Array(heldIDs))
+		if err != nil {
+			return fmt.Errorf("failed to read outbox for tenant %s: %w", s.tenantName, err)
+		}
+
+		var ids []int64
+		var changes []PostgreSQLNotification
+		for rows.Next() {
+			var id int64
+			var change PostgreSQLNotification
+			var newData, oldData []byte
+			if err := rows.Scan(&id, &change.Table, &change.Operation, &newData, &oldData, &change.Timestamp, &change.TxID); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan outbox row for tenant %s: %w", s.tenantName, err)
+			}
+			if newData != nil {
+				change.NewData = json.RawMessage(newData)
+			}
+			if oldData != nil {
+				change.OldData = json.RawMessage(oldData)
+			}
+			ids = append(ids, id)
+			changes = append(changes, change)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read outbox for tenant %s: %w", s.tenantName, err)
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		for _, change := range changes {
+			s.engine.publishChange(s.tenantName, change)
+		}
+		s.engine.flushTransaction(s.tenantName)
+
+		s.held = append(s.held, heldOutboxRows{ids: ids, barrier: s.engine.debounceBarrier(s.tenantName)})
+		if err := s.markReleased(db); err != nil {
+			return err
+		}
+
+		if len(ids) < outboxBatchSize {
+			return nil
+		}
+	}
+}
+
+// markReleased marks the held rows whose debounced changes were delivered, in the order they were published
+func (s *outboxChangeSource) markReleased(db *sql.DB) error {
+	var ids []int64
+	for len(s.held) > 0 && s.held[0].barrier.released() {
+		ids = append(ids, s.held[0].ids...)
+		s.held = s.held[1:]
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(`UPDATE whagons_rte_outbox SET delivered_at = now() WHERE id = ANY($1)`, pq.Array(ids)); err != nil {
+		return fmt.Errorf("failed to mark outbox rows delivered for tenant %s: %w", s.tenantName, err)
+	}
+
+	lastID := strconv.FormatInt(ids[len(ids)-1], 10)
+	if err := s.engine.saveCheckpoint(s.tenantName, changeSourceOutbox, lastID); err != nil {
+		log.Printf("⚠️  %v", err)
+	}
+	return nil
+}
+
+// prune deletes delivered outbox rows older than the retention period
+func (s *outboxChangeSource) prune(db *sql.DB, retention time.Duration) {
+	result, err := db.Exec(`
+		DELETE FROM whagons_rte_outbox
+		WHERE delivered_at IS NOT NULL
+		AND delivered_at < now() - $1::interval`, fmt.Sprintf("%d seconds", int(retention.Seconds())))
+	if err != nil {
+		log.Printf("⚠️  Failed to prune outbox for tenant %s: %v", s.tenantName, err)
+		return
+	}
+	if pruned, _ := result.RowsAffected(); pruned > 0 {
+		log.Printf("🧹 Pruned %d delivered outbox rows for tenant %s", pruned, s.tenantName)
+	}
+}
+
+// setupTenantOutbox creates the outbox table written by whagons_rte_outbox_capture in a tenant database
+func (e *RealtimeEngine) setupTenantOutbox(tenantName string, db *sql.DB) error {
+	createTableSQL := `
+		CREATE TABLE IF NOT EXISTS whagons_rte_outbox (
+			id           BIGSERIAL PRIMARY KEY,
+			table_name   TEXT NOT NULL,
+			op           TEXT NOT NULL,
+			pk           TEXT,
+			new_data     JSONB,
+			old_data     JSONB,
+			txid         BIGINT NOT NULL DEFAULT txid_current(),
+			created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			delivered_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS whagons_rte_outbox_pending_idx
+			ON whagons_rte_outbox (id) WHERE delivered_at IS NULL;`
+
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("failed to create outbox table for tenant %s: %w", tenantName, err)
+	}
+
+	return nil
+}
@@ -7,7 +7,6 @@ import (
 	"log"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/lib/pq"
 )
 
@@ -37,145 +36,304 @@ func (e *RealtimeEngine) startPublicationListeners() {
 		}
 
 		if _, exists := tenantDBs[tenantName]; exists {
-			go e.listenToTenantPublications(tenantName, dbName)
+			e.listenToTenantPublications(tenantName, dbName)
 		}
 	}
 }
 
-// listenToTenantPublications listens to PostgreSQL notifications for a specific tenant
-func (e *RealtimeEngine) listenToTenantPublications(tenantName, dbName string) {
-	log.Printf("🎧 Starting publication listener for tenant: %s (database: %s)", tenantName, dbName)
+// handlePublicationNotifications processes a batch of PostgreSQL notifications in arrival order
+func (e *RealtimeEngine) handlePublicationNotifications(tenantName string, tenantDB *sql.DB, notifications []*pq.Notification) {
+	changes := make([]PostgreSQLNotification, 0, len(notifications))
+	hasReferences := false
 
-	listener := pq.NewListener(
-		fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-			config.DBHost, config.DBPort, config.DBUsername, config.DBPassword, dbName),
-		10*time.Second,
-		time.Minute,
-		func(ev pq.ListenerEventType, err error) {
-			if err != nil {
-				log.Printf("❌ PostgreSQL listener error for %s: %v", tenantName, err)
-			}
-		})
+	for _, notification := range notifications {
+		log.Printf("📡 Publication notification received from %s on channel '%s'", tenantName, notification.Channel)
 
-	defer listener.Close()
+		// Parse the PostgreSQL notification payload once
+		var pgNotification PostgreSQLNotification
+		if err := json.Unmarshal([]byte(notification.Extra), &pgNotification); err != nil {
+			log.Printf("❌ Failed to parse notification JSON from %s: %v", tenantName, err)
+			continue
+		}
+		if pgNotification.Payload == payloadModeReference {
+			hasReferences = true
+		}
+		changes = append(changes, pgNotification)
+	}
 
-	// Query all tables with change triggers dynamically
-	// Get a connection to the tenant database to query triggers
-	e.mutex.RLock()
-	tenantDB, exists := e.tenantDBs[tenantName]
-	e.mutex.RUnlock()
+	// Reference payloads only carry the primary key - fetch the rows before publishing
+	if hasReferences {
+		changes = e.resolveReferencePayloads(tenantName, tenantDB, changes)
+	}
 
-	if !exists {
-		log.Printf("❌ Tenant database connection not found for %s", tenantName)
-		return
+	for _, change := range changes {
+		e.publishChange(tenantName, change)
+	}
+}
+
+// publishChange turns a row change from any change source into a PublicationMessage and broadcasts it
+func (e *RealtimeEngine) publishChange(tenantName string, change PostgreSQLNotification) {
+	// Create clean publication message with raw JSON data (generic for all tables)
+	message := PublicationMessage{
+		Type:        "database",
+		TenantName:  tenantName,
+		Table:       change.Table,
+		Operation:   change.Operation,
+		NewData:     change.NewData,
+		OldData:     change.OldData,
+		DBTimestamp: change.Timestamp,
+		ClientTime:  time.Now().Format(time.RFC3339),
+		TxID:        change.TxID,
 	}
 
-	// Query for all triggers that match the pattern *_changes_trigger
-	// This dynamically finds all tables (wh_* and Spatie permission tables) with triggers
-	query := `
-		SELECT DISTINCT 
-			REPLACE(tgname, '_changes_trigger', '') as table_name
-		FROM pg_trigger 
-		WHERE tgname LIKE '%_changes_trigger'
-		AND tgisinternal = false
-		ORDER BY table_name
-	`
+	message.Message = changeText(change.Operation, tenantName, change.Table)
 
-	rows, err := tenantDB.Query(query)
-	if err != nil {
-		log.Printf("❌ Failed to query triggers for tenant %s: %v", tenantName, err)
-		log.Printf("⚠️  No channels will be subscribed for tenant %s", tenantName)
-		return
+	e.recordListenerEvent(tenantName)
+
+	// Role, permission and team changes alter what connected users may see
+	if grantTables[change.Table] {
+		e.scheduleGrantRefresh(tenantName)
 	}
-	defer rows.Close()
 
-	var channels []string
-	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			log.Printf("⚠️  Error scanning trigger row: %v", err)
-			continue
+	log.Printf("🔄 Processed %s operation on %s.%s - broadcasting to sessions",
+		change.Operation, tenantName, change.Table)
+
+	// Hide sensitive columns before anything leaves the engine; authorization keeps the full images
+	unredacted := message
+	e.redactMessage(&message)
+
+	// Hot tables collapse the changes of a row within their debounce window. Their changes are
+	// sequenced when the window closes, so they leave the transaction envelope to the other tables.
+	if window := debounceWindowFor(change.Table); window > 0 {
+		if change.Operation != "TRUNCATE" {
+			e.debounceChange(tenantName, message, unredacted, window)
+			return
 		}
-		channelName := fmt.Sprintf("whagons_%s_changes", tableName)
-		channels = append(channels, channelName)
+		// Changes held back must not arrive after the truncate
+		e.flushDebounced(tenantName, change.Table)
 	}
 
-	if len(channels) == 0 {
-		log.Printf("⚠️  No triggers found for tenant %s - no channels will be subscribed", tenantName)
+	history := e.historyFor(tenantName)
+	history.publish.Lock()
+	defer history.publish.Unlock()
+
+	// A change of another transaction completes the one being collected
+	if len(history.transaction) > 0 && history.transaction[0].message.TxID != message.TxID {
+		e.flushTransactionLocked(history)
+	}
+	if message.TxID != 0 && getBoolEnv(config.TransactionEnvelopes, true) {
+		history.transaction = append(history.transaction, bufferedChange{message: message, unredacted: unredacted})
 		return
 	}
 
-	// Subscribe to all channels dynamically discovered
-	for _, channelName := range channels {
-		if err := listener.Listen(channelName); err != nil {
-			log.Printf("⚠️  Failed to listen to channel %s for tenant %s: %v", channelName, tenantName, err)
-			continue
-		}
-		log.Printf("✅ Listening to channel '%s' for tenant: %s", channelName, tenantName)
+	// Sequence and record the change, then broadcast it before the next change can be sequenced
+	message.Seq = history.append(message, &unredacted)
+	unredacted.Seq = message.Seq
+
+	// Broadcast to all connected WebSocket sessions
+	e.broadcastChange(message, &changeImages{message: &unredacted})
+}
+
+// changeText generates a generic message based on operation
+func changeText(operation, tenantName, table string) string {
+	switch operation {
+	case "INSERT":
+		return fmt.Sprintf("New record created in %s.%s", tenantName, table)
+	case "UPDATE":
+		return fmt.Sprintf("Record updated in %s.%s", tenantName, table)
+	case "DELETE":
+		return fmt.Sprintf("Record deleted from %s.%s", tenantName, table)
+	default:
+		return fmt.Sprintf("%s operation on %s.%s", operation, tenantName, table)
 	}
+}
+
+// BroadcastPublicationMessage sends a publication message to authenticated sessions with tenant access
+func (e *RealtimeEngine) BroadcastPublicationMessage(message PublicationMessage) {
+	e.broadcastChange(message, &changeImages{message: &message})
+}
 
-	log.Printf("📡 Subscribed to %d channels for tenant: %s", len(channels), tenantName)
+// changeDelivery is the per-change state shared by every session a change is delivered to
+type changeDelivery struct {
+	message    PublicationMessage
+	authImages *changeImages // unredacted row images used for row-level authorization
+	redaction  *tableRedaction
+	variants   map[string]*messageVariant
+	rowKey     string
+	ackTable   bool // delivered at-least-once to sessions in ack mode
+
+	frames map[frameKey]*sharedFrame // encoded frames shared by sessions receiving the same message
+	shapes map[frameKey]int          // frame keys numbered in order of first use, to tell apart envelopes
+}
 
-	for {
-		select {
-		case notification := <-listener.Notify:
-			if notification != nil {
-				e.handlePublicationNotification(tenantName, notification)
-			}
-		case <-time.After(90 * time.Second):
-			// Ping to keep connection alive
-			if err := listener.Ping(); err != nil {
-				log.Printf("❌ Ping failed for tenant %s: %v", tenantName, err)
-				return
+// frameKey identifies what a session receives of a change: sessions with equal keys get identical frames
+type frameKey struct {
+	format    *wireFormat
+	variant   string
+	operation string
+	synthetic bool
+	compact   bool
+	ack       bool
+}
+
+// sessionFrame is the message a session receives of a change
+type sessionFrame struct {
+	message PublicationMessage
+	rowKey  string // coalesces the frame with an earlier queued frame of the same row
+	key     frameKey
+}
+
+// newChangeDelivery prepares a change for delivery to sessions
+func (e *RealtimeEngine) newChangeDelivery(message PublicationMessage, authImages *changeImages) *changeDelivery {
+	return &changeDelivery{
+		message:    message,
+		authImages: authImages,
+		redaction:  e.redactionFor(message.Table),
+		variants:   make(map[string]*messageVariant),
+		rowKey:     changeRowKey(message.Table, authImages),
+		ackTable:   message.Seq > 0 && ackTables()[message.Table],
+		frames:     make(map[frameKey]*sharedFrame),
+		shapes:     make(map[frameKey]int),
+	}
+}
+
+// encode returns a session's frame in its wire format, encoding each distinct frame of the change once
+func (delivery *changeDelivery) encode(frame *sessionFrame) (*sharedFrame, error) {
+	if shared, exists := delivery.frames[frame.key]; exists {
+		return shared, nil
+	}
+	data, err := frame.key.format.encode(frame.message)
+	if err != nil {
+		return nil, err
+	}
+	shared := newSharedFrame(frame.key.format.messageType, data)
+	delivery.frames[frame.key] = shared
+	return shared, nil
+}
+
+// outbound builds the queued frame of a session's change. With coalesce, an UPDATE can turn into the
+// INSERT of its row when it replaces a queued INSERT the client has not received yet.
+func (delivery *changeDelivery) outbound(frame *sessionFrame, shared *sharedFrame, coalesce bool) outboundFrame {
+	queued := outboundFrame{
+		messageType: frame.key.format.messageType,
+		data:        shared.data,
+		prepared:    shared.prepared,
+		rowKey:      frame.rowKey,
+		operation:   frame.message.Operation,
+	}
+	if coalesce && frame.rowKey != "" && frame.message.Operation == "UPDATE" {
+		queued.asInsert = func() (outboundFrame, error) {
+			insert := *frame
+			insert.message.Operation = "INSERT"
+			insert.message.OldData = nil
+			insert.message.Message = changeText("INSERT", insert.message.TenantName, insert.message.Table)
+			insert.key.operation = "INSERT"
+			shared, err := delivery.encode(&insert)
+			if err != nil {
+				return outboundFrame{}, err
 			}
+			return delivery.outbound(&insert, shared, false), nil
 		}
 	}
+	return queued
 }
 
-// handlePublicationNotification processes a PostgreSQL notification
-func (e *RealtimeEngine) handlePublicationNotification(tenantName string, notification *pq.Notification) {
-	log.Printf("📡 Publication notification received from %s on channel '%s'", tenantName, notification.Channel)
+// shape numbers the distinct frames of the change
+func (delivery *changeDelivery) shape(key frameKey) int {
+	id, exists := delivery.shapes[key]
+	if !exists {
+		id = len(delivery.shapes)
+		delivery.shapes[key] = id
+	}
+	return id
+}
 
-	// Parse the PostgreSQL notification payload once
-	var pgNotification PostgreSQLNotification
-	if err := json.Unmarshal([]byte(notification.Extra), &pgNotification); err != nil {
-		log.Printf("❌ Failed to parse notification JSON from %s: %v", tenantName, err)
-		return
+// deliverToSession authorizes, redacts and filters a change for one session and queues it.
+// When only is set, just that subscription is considered (history replay for a new subscription).
+func (e *RealtimeEngine) deliverToSession(delivery *changeDelivery, wsSession *WebSocketSession, authSession *AuthenticatedSession, only *Subscription) (bool, error) {
+	frame, err := e.sessionChange(delivery, wsSession, authSession, only)
+	if err != nil {
+		return true, err
+	}
+	if frame == nil {
+		return false, nil
 	}
 
-	// Create clean publication message with raw JSON data (generic for all tables)
-	message := PublicationMessage{
-		Type:        "database",
-		TenantName:  tenantName,
-		Table:       pgNotification.Table,
-		Operation:   pgNotification.Operation,
-		NewData:     pgNotification.NewData,
-		OldData:     pgNotification.OldData,
-		DBTimestamp: pgNotification.Timestamp,
-		ClientTime:  time.Now().Format(time.RFC3339),
+	// Enqueue only - the session's writePump does the actual write
+	return true, e.queueChange(wsSession, delivery, frame)
+}
+
+// sessionChange authorizes, redacts and filters a change for one session. It returns nil when the
+// session does not receive the change.
+func (e *RealtimeEngine) sessionChange(delivery *changeDelivery, wsSession *WebSocketSession, authSession *AuthenticatedSession, only *Subscription) (*sessionFrame, error) {
+	message := delivery.message
+
+	// Check if the authenticated session can access this tenant's data
+	if !authSession.canAccessTenant(message.TenantName) {
+		log.Printf("🔒 Session %s (tenant: %s) denied access to %s data",
+			wsSession.ID, authSession.TenantName, message.TenantName)
+		return nil, nil
 	}
 
-	// Generate a generic message based on operation
-	switch pgNotification.Operation {
-	case "INSERT":
-		message.Message = fmt.Sprintf("New record created in %s.%s", tenantName, pgNotification.Table)
-	case "UPDATE":
-		message.Message = fmt.Sprintf("Record updated in %s.%s", tenantName, pgNotification.Table)
-	case "DELETE":
-		message.Message = fmt.Sprintf("Record deleted from %s.%s", tenantName, pgNotification.Table)
-	default:
-		message.Message = fmt.Sprintf("%s operation on %s.%s", pgNotification.Operation, tenantName, pgNotification.Table)
+	// Per-user table and row authorization
+	grants := wsSession.sessionGrants()
+	if grants == nil || !e.authorizer.CanReadTable(grants, message.Table) {
+		return nil, nil
+	}
+	access := &rowAccess{
+		images: delivery.authImages,
+		visible: func(row map[string]interface{}) bool {
+			return e.authorizer.CanReadRow(grants, message.Table, row)
+		},
 	}
 
-	log.Printf("🔄 Processed %s operation on %s.%s - broadcasting to sessions",
-		pgNotification.Operation, tenantName, pgNotification.Table)
+	// Columns restricted to abilities the session lacks are removed
+	variant := variantForSession(delivery.variants, message, delivery.redaction, authSession)
 
-	// Broadcast to all connected WebSocket sessions
-	e.BroadcastPublicationMessage(message)
+	// Sessions only receive tables they subscribed to, narrowed by their row filters
+	sessionMessage, deliver := wsSession.filterChange(variant.message, variant.images, access, only)
+	if !deliver {
+		return nil, nil
+	}
+
+	// Sessions that negotiated compact updates get the primary key and changed columns only
+	rowKey := delivery.rowKey
+	if wsSession.compactUpdates && sessionMessage.Operation == "UPDATE" && !sessionMessage.Synthetic {
+		if compactNew := variant.compactUpdate(); compactNew != nil {
+			sessionMessage.NewData, sessionMessage.OldData, sessionMessage.Compact = compactNew, nil, true
+			// A partial row must not replace an earlier queued frame of the same row
+			rowKey = ""
+		}
+	}
+
+	// Critical tables are retransmitted until the client acks them
+	if delivery.ackTable && wsSession.ackState != nil {
+		if err := wsSession.ackState.trackDelivery(&sessionMessage, rowKey); err != nil {
+			log.Printf("🐌 Session %s has too many unacknowledged changes - requesting resync", wsSession.ID)
+			wsSession.ackState.reset()
+			e.sendResyncRequired(wsSession, "ack_backlog")
+			return nil, err
+		}
+	}
+
+	// Sessions learn their id from the handshake, so nothing else in the frame is per-session
+	return &sessionFrame{
+		message: sessionMessage,
+		rowKey:  rowKey,
+		key: frameKey{
+			format:    wsSession.format,
+			variant:   variant.key,
+			operation: sessionMessage.Operation,
+			synthetic: sessionMessage.Synthetic,
+			compact:   sessionMessage.Compact,
+			ack:       sessionMessage.AckRequired,
+		},
+	}, nil
 }
 
-// BroadcastPublicationMessage sends a publication message to authenticated sessions with tenant access
-func (e *RealtimeEngine) BroadcastPublicationMessage(message PublicationMessage) {
+// broadcastChange delivers a change to every session allowed to see it. authImages are the
+// unredacted row images used for row-level authorization.
+func (e *RealtimeEngine) broadcastChange(message PublicationMessage, authImages *changeImages) {
 	e.mutex.RLock()
 	sessions := make(map[string]*WebSocketSession)
 	authSessions := make(map[string]*AuthenticatedSession)
@@ -189,6 +347,7 @@ func (e *RealtimeEngine) BroadcastPublicationMessage(message PublicationMessage)
 
 	broadcastCount := 0
 	authorizedCount := 0
+	delivery := e.newChangeDelivery(message, authImages)
 
 	for sessionID, wsSession := range sessions {
 		authSession, isAuthenticated := authSessions[sessionID]
@@ -199,35 +358,17 @@ func (e *RealtimeEngine) BroadcastPublicationMessage(message PublicationMessage)
 			continue
 		}
 
-		// Check if the authenticated session can access this tenant's data
-		if !authSession.canAccessTenant(message.TenantName) {
-			log.Printf("🔒 Session %s (tenant: %s) denied access to %s data",
-				sessionID, authSession.TenantName, message.TenantName)
+		authorized, err := e.deliverToSession(delivery, wsSession, authSession, nil)
+		if !authorized {
 			continue
 		}
-
 		authorizedCount++
 
-		// Set the sessionId for this specific session
-		message.SessionId = sessionID
-
-		jsonMessage, err := json.Marshal(message)
 		if err != nil {
-			log.Printf("❌ Failed to marshal publication message: %v", err)
-			continue
-		}
-
-		wsSession.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-		if err := wsSession.Conn.WriteMessage(websocket.TextMessage, jsonMessage); err != nil {
-			log.Printf("❌ Failed to send to session %s: %v", sessionID, err)
-			// Remove failed session
-			e.mutex.Lock()
-			delete(e.sessions, sessionID)
-			delete(e.authenticatedSessions, sessionID)
-			e.mutex.Unlock()
+			log.Printf("❌ Failed to queue publication for session %s: %v", sessionID, err)
 		} else {
 			broadcastCount++
-			log.Printf("📤 Sent publication to authenticated session %s (tenant: %s)",
+			log.Printf("📤 Queued publication for authenticated session %s (tenant: %s)",
 				sessionID, authSession.TenantName)
 		}
 	}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxReconcileRanges caps the id ranges compared in one reconciliation round
+const maxReconcileRanges = 1000
+
+// IDRange is the half-open range of row ids [FromID, ToID)
+type IDRange struct {
+	FromID int64 `json:"from_id"`
+	ToID   int64 `json:"to_id"`
+}
+
+// ReconcileRequest is one round of bucket reconciliation: the client's checksums of its non-empty
+// buckets of bucket_size inside ranges (the whole table when no range is given)
+type ReconcileRequest struct {
+	RequestID  string           `json:"request_id,omitempty"`
+	Table      string           `json:"table"`
+	Filter     string           `json:"filter,omitempty"`
+	BucketSize int64            `json:"bucket_size"`
+	Ranges     []IDRange        `json:"ranges,omitempty"`
+	Buckets    []BucketChecksum `json:"buckets"`
+}
+
+// RangePatch replaces every row the client holds with an id in [FromID, ToID) by Rows
+type RangePatch struct {
+	FromID int64             `json:"from_id"`
+	ToID   int64             `json:"to_id"`
+	Rows   []json.RawMessage `json:"rows"`
+}
+
+// ReconcileResult lists the buckets that differ. Small ones are patched right away; the others are
+// returned in descend to be compared again with next_bucket_size.
+type ReconcileResult struct {
+	RequestID      string           `json:"request_id,omitempty"`
+	Table          string           `json:"table"`
+	BucketSize     int64            `json:"bucket_size"`
+	Mismatched     []BucketChecksum `json:"mismatched"`
+	NextBucketSize int64            `json:"next_bucket_size,omitempty"`
+	Descend        []IDRange        `json:"descend,omitempty"`
+	Patches        []RangePatch     `json:"patches,omitempty"`
+	Deferred       []IDRange        `json:"deferred,omitempty"` // not patched to bound the response, ask again with bucket_size
+	Seq            uint64           `json:"seq"`
+	Cursor         string           `json:"snapshot_cursor"`
+	LSN            string           `json:"lsn,omitempty"`
+}
+
+// reconcileRound compares the client's bucket checksums with the rows it may see under one snapshot
+func (e *RealtimeEngine) reconcileRound(authSession *AuthenticatedSession, grants *UserGrants, request ReconcileRequest) (*ReconcileResult, error) {
+	filter, _, err := e.checkSyncTable(grants, request.Table, request.Filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	if request.BucketSize <= 0 {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_request", "bucket_size must be positive")
+	}
+	if len(request.Ranges) > maxReconcileRanges {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_request", "At most %d ranges per request", maxReconcileRanges)
+	}
+	if len(request.Buckets) > maxChecksumBuckets {
+		return nil, newSyncError(http.StatusBadRequest, "too_many_buckets", "At most %d buckets per request", maxChecksumBuckets)
+	}
+	for _, idRange := range request.Ranges {
+		if idRange.FromID >= idRange.ToID || idRange.FromID%request.BucketSize != 0 || idRange.ToID%request.BucketSize != 0 {
+			return nil, newSyncError(http.StatusBadRequest, "invalid_request", "Range [%d, %d) is not aligned to bucket_size %d", idRange.FromID, idRange.ToID, request.BucketSize)
+		}
+	}
+
+	clientBuckets := make(map[int64]BucketChecksum, len(request.Buckets))
+	for _, bucket := range request.Buckets {
+		if !bucketInRanges(bucket.Bucket, request.BucketSize, request.Ranges) {
+			return nil, newSyncError(http.StatusBadRequest, "invalid_request", "Bucket %d is outside the requested ranges", bucket.Bucket)
+		}
+		clientBuckets[bucket.Bucket] = bucket
+	}
+
+	syncTx, err := e.beginSyncTransaction(authSession.TenantName)
+	if err != nil {
+		return nil, err
+	}
+	defer syncTx.tx.Rollback()
+
+	started := time.Now()
+	serverBuckets := make(map[int64]BucketChecksum)
+	checksumRequests := []ChecksumRequest{{Table: request.Table, Filter: request.Filter, BucketSize: request.BucketSize}}
+	if len(request.Ranges) > 0 {
+		checksumRequests = checksumRequests[:0]
+		for _, idRange := range request.Ranges {
+			fromID, toID := idRange.FromID, idRange.ToID
+			checksumRequests = append(checksumRequests, ChecksumRequest{
+				Table: request.Table, Filter: request.Filter, BucketSize: request.BucketSize, FromID: &fromID, ToID: &toID,
+			})
+		}
+	}
+	for _, checksumRequest := range checksumRequests {
+		checksum, err := e.checksumInTx(syncTx, authSession, grants, filter, checksumRequest)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range checksum.Buckets {
+			serverBuckets[bucket.Bucket] = bucket
+		}
+	}
+
+	// Buckets missing on either side are empty there
+	var emptyChecksum rowDigest
+	mismatched := make(map[int64]BucketChecksum)
+	for index, server := range serverBuckets {
+		if client, exists := clientBuckets[index]; !exists || client.Checksum != server.Checksum || client.Count != server.Count {
+			mismatched[index] = server
+		}
+	}
+	for index, client := range clientBuckets {
+		if _, exists := serverBuckets[index]; !exists && (client.Count != 0 || client.Checksum != emptyChecksum.String()) {
+			mismatched[index] = BucketChecksum{
+				Bucket: index, FromID: index * request.BucketSize, ToID: (index + 1) * request.BucketSize, Checksum: emptyChecksum.String(),
+			}
+		}
+	}
+
+	result := &ReconcileResult{
+		RequestID:  request.RequestID,
+		Table:      request.Table,
+		BucketSize: request.BucketSize,
+		Mismatched: make([]BucketChecksum, 0, len(mismatched)),
+		Seq:        syncTx.seq,
+		Cursor:     syncTx.cursor(),
+		LSN:        syncTx.lsn,
+	}
+	for _, bucket := range mismatched {
+		result.Mismatched = append(result.Mismatched, bucket)
+	}
+	sort.Slice(result.Mismatched, func(i, j int) bool { return result.Mismatched[i].Bucket < result.Mismatched[j].Bucket })
+
+	// Buckets with few rows (or that cannot be split further) are patched, larger ones are split
+	fanout := int64(getIntEnv(config.ReconcileFanout, 10))
+	if fanout < 2 {
+		fanout = 2
+	}
+	var nextBucketSize int64
+	if request.BucketSize%fanout == 0 {
+		nextBucketSize = request.BucketSize / fanout
+	}
+	leafRows := getIntEnv(config.ReconcileLeafRows, 100)
+	redaction := e.redactionFor(request.Table)
+	patchedRows := 0
+
+	for _, bucket := range result.Mismatched {
+		idRange := IDRange{FromID: bucket.FromID, ToID: bucket.ToID}
+		if bucket.Count > leafRows && nextBucketSize > 0 {
+			result.Descend = append(result.Descend, idRange)
+			continue
+		}
+		if patchedRows > 0 && patchedRows+bucket.Count > maxSnapshotPageSize {
+			result.Deferred = append(result.Deferred, idRange)
+			continue
+		}
+
+		patch, err := e.readRangeRows(syncTx, authSession, grants, request.Table, redaction, filter, idRange)
+		if err != nil {
+			return nil, err
+		}
+		patchedRows += len(patch.Rows)
+		result.Patches = append(result.Patches, *patch)
+	}
+	if len(result.Descend) > 0 {
+		result.NextBucketSize = nextBucketSize
+	}
+
+	log.Printf("🌳 Reconciled %s.%s for user %d at bucket size %d: %d mismatched, %d to split, %d rows patched in %v",
+		authSession.TenantName, request.Table, authSession.UserID, request.BucketSize,
+		len(result.Mismatched), len(result.Descend), patchedRows, time.Since(started).Round(time.Millisecond))
+	return result, nil
+}
+
+// bucketInRanges reports whether a bucket lies inside one of the ranges (or no range is given)
+func bucketInRanges(index, bucketSize int64, ranges []IDRange) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, idRange := range ranges {
+		if index*bucketSize >= idRange.FromID && (index+1)*bucketSize <= idRange.ToID {
+			return true
+		}
+	}
+	return false
+}
+
+// readRangeRows reads the rows of an id range visible to the caller, in id order
+func (e *RealtimeEngine) readRangeRows(syncTx *syncTransaction, authSession *AuthenticatedSession, grants *UserGrants, table string, redaction *tableRedaction, filter *rowFilter, idRange IDRange) (*RangePatch, error) {
+	query := fmt.Sprintf(`SELECT row_to_json(t)::text FROM %s t WHERE t.id >= $1 AND t.id < $2 ORDER BY t.id`, pq.QuoteIdentifier(table))
+	rows, err := syncTx.tx.Query(query, idRange.FromID, idRange.ToID)
+	if err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "reconcile_failed", "Failed to read %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	patch := &RangePatch{FromID: idRange.FromID, ToID: idRange.ToID, Rows: []json.RawMessage{}}
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, newSyncError(http.StatusInternalServerError, "reconcile_failed", "Failed to read %s: %v", table, err)
+		}
+		if row, visible := e.syncRowForSession(authSession, grants, table, redaction, filter, json.RawMessage(raw)); visible {
+			patch.Rows = append(patch.Rows, row)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "reconcile_failed", "Failed to read %s: %v", table, err)
+	}
+	return patch, nil
+}
+
+// SyncReconcile serves one bucket reconciliation round over HTTP (implements SyncEngineInterface)
+func (e *RealtimeEngine) SyncReconcile(authorization, token, domain string, body []byte) (interface{}, error) {
+	var request ReconcileRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_request", "Invalid JSON request body")
+	}
+
+	authSession, grants, err := e.authenticateSyncRequest(authorization, token, domain)
+	if err != nil {
+		return nil, err
+	}
+	return e.reconcileRound(authSession, grants, request)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Redaction actions
+const (
+	redactionDrop    = "drop"    // remove the column from every payload
+	redactionMask    = "mask"    // replace non-null values with redactionMaskValue
+	redactionAbility = "ability" // only sessions holding one of the abilities receive the column
+)
+
+// redactionMaskValue replaces the value of masked columns
+const redactionMaskValue = "********"
+
+// defaultRedactionRules always apply, on top of the rule file and the landlord table
+var defaultRedactionRules = []RedactionRule{
+	{Table: "wh_users", Column: "password", Action: redactionDrop},
+	{Table: "wh_users", Column: "remember_token", Action: redactionDrop},
+	{Table: "wh_users", Column: "two_factor_secret", Action: redactionDrop},
+	{Table: "wh_users", Column: "two_factor_recovery_codes", Action: redactionDrop},
+	{Table: "wh_invitations", Column: "token", Action: redactionDrop},
+	{Table: "personal_access_tokens", Column: "token", Action: redactionDrop},
+}
+
+// RedactionRule hides one column of the tables matching a glob pattern
+type RedactionRule struct {
+	Table     string   `json:"table"`
+	Column    string   `json:"column"`
+	Action    string   `json:"action"`
+	Abilities []string `json:"abilities,omitempty"`
+}
+
+// tableRedaction is the combined redaction of a single table
+type tableRedaction struct {
+	drop       map[string]bool
+	mask       map[string]bool
+	restricted map[string][]string // column -> abilities allowed to see it
+}
+
+// validate checks a rule loaded from the rule file or the landlord table
+func (rule RedactionRule) validate() error {
+	if _, err := path.Match(rule.Table, ""); err != nil || rule.Table == "" {
+		return fmt.Errorf("invalid table pattern %q", rule.Table)
+	}
+	if rule.Column == "" {
+		return fmt.Errorf("missing column for table %s", rule.Table)
+	}
+	switch rule.Action {
+	case redactionDrop, redactionMask:
+		return nil
+	case redactionAbility:
+		if len(rule.Abilities) == 0 {
+			return fmt.Errorf("column %s.%s is ability-restricted but lists no abilities", rule.Table, rule.Column)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown redaction action %q for %s.%s", rule.Action, rule.Table, rule.Column)
+}
+
+// setupRedactionStore creates the landlord table holding column redaction rules
+func (e *RealtimeEngine) setupRedactionStore() error {
+	createTableSQL := `
+		CREATE TABLE IF NOT EXISTS whagons_rte_redactions (
+			id            SERIAL PRIMARY KEY,
+			table_pattern TEXT NOT NULL,
+			column_name   TEXT NOT NULL,
+			action        TEXT NOT NULL CHECK (action IN ('drop', 'mask', 'ability')),
+			abilities     TEXT[] NOT NULL DEFAULT '{}',
+			created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`
+
+	if _, err := e.landlordDB.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("failed to create redaction table: %w", err)
+	}
+
+	log.Println("✅ Redaction store ready")
+	return nil
+}
+
+// reloadRedactionRules rebuilds the active rules from the defaults, REDACTION_RULES_FILE and the landlord table.
+// On failure the previous rules stay active.
+func (e *RealtimeEngine) reloadRedactionRules() error {
+	rules := append([]RedactionRule{}, defaultRedactionRules...)
+
+	if config.RedactionRulesFile != "" {
+		data, err := os.ReadFile(config.RedactionRulesFile)
+		if err != nil {
+			return fmt.Errorf("failed to read redaction rules: %w", err)
+		}
+		var fileRules []RedactionRule
+		if err := json.Unmarshal(data, &fileRules); err != nil {
+			return fmt.Errorf("failed to parse redaction rules %s: %w", config.RedactionRulesFile, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+
+	if e.landlordDB != nil {
+		rows, err := e.landlordDB.Query(`SELECT table_pattern, column_name, action, abilities FROM whagons_rte_redactions ORDER BY id`)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P01" {
+			// Redaction store could not be created (read-only landlord role) - file and default rules still apply
+			rows, err = nil, nil
+		} else if err != nil {
+			return fmt.Errorf("failed to load redaction rules: %w", err)
+		}
+		for rows != nil && rows.Next() {
+			var rule RedactionRule
+			if err := rows.Scan(&rule.Table, &rule.Column, &rule.Action, pq.Array(&rule.Abilities)); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan redaction rule: %w", err)
+			}
+			rules = append(rules, rule)
+		}
+		if rows != nil {
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to load redaction rules: %w", err)
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	e.redactionMutex.Lock()
+	changed := len(rules) != len(e.redactionRules)
+	e.redactionRules = rules
+	e.redactionMutex.Unlock()
+
+	if changed {
+		log.Printf("🙈 Loaded %d column redaction rules", len(rules))
+	}
+	return nil
+}
+
+// redactionFor combines every rule matching a table (nil when nothing is redacted)
+func (e *RealtimeEngine) redactionFor(table string) *tableRedaction {
+	e.redactionMutex.RLock()
+	defer e.redactionMutex.RUnlock()
+
+	var redaction *tableRedaction
+	for _, rule := range e.redactionRules {
+		if matched, _ := path.Match(rule.Table, table); !matched {
+			continue
+		}
+		if redaction == nil {
+			redaction = &tableRedaction{
+				drop:       make(map[string]bool),
+				mask:       make(map[string]bool),
+				restricted: make(map[string][]string),
+			}
+		}
+		switch rule.Action {
+		case redactionDrop:
+			redaction.drop[rule.Column] = true
+		case redactionMask:
+			redaction.mask[rule.Column] = true
+		case redactionAbility:
+			redaction.restricted[rule.Column] = append(redaction.restricted[rule.Column], rule.Abilities...)
+		}
+	}
+	return redaction
+}
+
+// redactMessage drops and masks columns of both row images before the message is broadcast
+func (e *RealtimeEngine) redactMessage(message *PublicationMessage) {
+	redaction := e.redactionFor(message.Table)
+	if redaction == nil || (len(redaction.drop) == 0 && len(redaction.mask) == 0) {
+		return
+	}
+	message.NewData = redactImage(message.NewData, redaction.drop, redaction.mask)
+	message.OldData = redactImage(message.OldData, redaction.drop, redaction.mask)
+}
+
+// redactImage removes and masks columns of a row_to_json image. Images without any of the
+// columns are returned untouched; images that fail to decode are dropped entirely.
+func redactImage(raw json.RawMessage, drop, mask map[string]bool) json.RawMessage {
+	if len(raw) == 0 || string(raw) == "null" {
+		return raw
+	}
+
+	var row map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &row); err != nil {
+		log.Printf("⚠️  Dropping row image that could not be redacted: %v", err)
+		return nil
+	}
+
+	touched := false
+	for column, value := range row {
+		switch {
+		case drop[column]:
+			delete(row, column)
+			touched = true
+		case mask[column] && string(value) != "null":
+			row[column] = json.RawMessage(`"` + redactionMaskValue + `"`)
+			touched = true
+		}
+	}
+	if !touched {
+		return raw
+	}
+
+	redacted, err := json.Marshal(row)
+	if err != nil {
+		log.Printf("⚠️  Dropping row image that could not be redacted: %v", err)
+		return nil
+	}
+	return redacted
+}
+
+// messageVariant is a broadcast message with the ability-restricted columns a group of sessions may not see removed
+type messageVariant struct {
+	key     string // hidden columns
+	message PublicationMessage
+	images  *changeImages
+
+	compacted  bool
+	compactNew json.RawMessage // id and changed columns of an UPDATE, nil when the images cannot be compared
+}
+
+// redacts reports whether a session's images lose or mask columns of the table, given its hidden columns
+func (redaction *tableRedaction) redacts(hidden []string) bool {
+	return redaction != nil && (len(redaction.drop) > 0 || len(redaction.mask) > 0 || len(hidden) > 0)
+}
+
+// hiddenColumns returns the ability-restricted columns a session may not see, sorted
+func (redaction *tableRedaction) hiddenColumns(authSession *AuthenticatedSession) []string {
+	if redaction == nil {
+		return nil
+	}
+	var hidden []string
+	for column, abilities := range redaction.restricted {
+		allowed := false
+		for _, ability := range abilities {
+			if authSession.hasAbility(ability) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			hidden = append(hidden, column)
+		}
+	}
+	sort.Strings(hidden)
+	return hidden
+}
+
+// variantForSession returns the message variant matching the abilities of a session, building it on first use
+func variantForSession(variants map[string]*messageVariant, base PublicationMessage, redaction *tableRedaction, authSession *AuthenticatedSession) *messageVariant {
+	hidden := redaction.hiddenColumns(authSession)
+	key := strings.Join(hidden, ",")
+
+	if variant, exists := variants[key]; exists {
+		return variant
+	}
+
+	variant := &messageVariant{key: key, message: base}
+	if len(hidden) > 0 {
+		drop := make(map[string]bool, len(hidden))
+		for _, column := range hidden {
+			drop[column] = true
+		}
+		variant.message.NewData = redactImage(base.NewData, drop, nil)
+		variant.message.OldData = redactImage(base.OldData, drop, nil)
+	}
+	// Clients verify the row they apply against its stored hash, which covers the whole row,
+	// so images with redacted columns carry none
+	if getBoolEnv(config.RowHashes, false) && !redaction.redacts(hidden) {
+		variant.message.RowHash = imageHash(variant.message.NewData)
+	}
+	// Filters and row rules see the same columns as the client, so hidden columns cannot be probed
+	variant.images = &changeImages{message: &variant.message}
+	variants[key] = variant
+	return variant
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var testRedactionRules = []RedactionRule{
+	{Table: "wh_users", Column: "password", Action: redactionDrop},
+	{Table: "wh_users", Column: "email", Action: redactionMask},
+	{Table: "wh_*", Column: "salary", Action: redactionAbility, Abilities: []string{"payroll"}},
+}
+
+// decodeImage turns a row image into a map for comparison, nil for a missing image
+func decodeImage(t *testing.T, raw json.RawMessage) map[string]interface{} {
+	t.Helper()
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal(raw, &row); err != nil {
+		t.Fatalf("invalid row image %s: %v", raw, err)
+	}
+	return row
+}
+
+func TestRedactMessage(t *testing.T) {
+	e := &RealtimeEngine{redactionRules: testRedactionRules}
+
+	tests := []struct {
+		name      string
+		table     string
+		operation string
+		newData   string
+		oldData   string
+		wantNew   map[string]interface{}
+		wantOld   map[string]interface{}
+	}{
+		{
+			name:      "insert drops and masks the new image",
+			table:     "wh_users",
+			operation: "INSERT",
+			newData:   `{"id":1,"password":"secret","email":"a@b.c","name":"Ann"}`,
+			wantNew:   map[string]interface{}{"id": float64(1), "email": redactionMaskValue, "name": "Ann"},
+		},
+		{
+			name:      "update redacts both images",
+			table:     "wh_users",
+			operation: "UPDATE",
+			newData:   `{"id":1,"password":"new","email":"new@b.c","name":"Ann"}`,
+			oldData:   `{"id":1,"password":"old","email":"old@b.c","name":"Anne"}`,
+			wantNew:   map[string]interface{}{"id": float64(1), "email": redactionMaskValue, "name": "Ann"},
+			wantOld:   map[string]interface{}{"id": float64(1), "email": redactionMaskValue, "name": "Anne"},
+		},
+		{
+			name:      "delete redacts the old image",
+			table:     "wh_users",
+			operation: "DELETE",
+			oldData:   `{"id":1,"password":"secret","email":"a@b.c"}`,
+			wantOld:   map[string]interface{}{"id": float64(1), "email": redactionMaskValue},
+		},
+		{
+			name:      "null values are not masked",
+			table:     "wh_users",
+			operation: "UPDATE",
+			newData:   `{"id":1,"email":null}`,
+			oldData:   `{"id":1,"email":"a@b.c"}`,
+			wantNew:   map[string]interface{}{"id": float64(1), "email": nil},
+			wantOld:   map[string]interface{}{"id": float64(1), "email": redactionMaskValue},
+		},
+		{
+			name:      "ability-restricted columns are left to the session variants",
+			table:     "wh_teams",
+			operation: "UPDATE",
+			newData:   `{"id":2,"salary":10}`,
+			oldData:   `{"id":2,"salary":9}`,
+			wantNew:   map[string]interface{}{"id": float64(2), "salary": float64(10)},
+			wantOld:   map[string]interface{}{"id": float64(2), "salary": float64(9)},
+		},
+		{
+			name:      "other tables are untouched",
+			table:     "wh_tasks",
+			operation: "UPDATE",
+			newData:   `{"id":3,"password":"x"}`,
+			oldData:   `{"id":3,"password":"y"}`,
+			wantNew:   map[string]interface{}{"id": float64(3), "password": "x"},
+			wantOld:   map[string]interface{}{"id": float64(3), "password": "y"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := PublicationMessage{Table: tt.table, Operation: tt.operation}
+			if tt.newData != "" {
+				message.NewData = json.RawMessage(tt.newData)
+			}
+			if tt.oldData != "" {
+				message.OldData = json.RawMessage(tt.oldData)
+			}
+
+			e.redactMessage(&message)
+
+			if got := decodeImage(t, message.NewData); !reflect.DeepEqual(got, tt.wantNew) {
+				t.Errorf("new image = %v, want %v", got, tt.wantNew)
+			}
+			if got := decodeImage(t, message.OldData); !reflect.DeepEqual(got, tt.wantOld) {
+				t.Errorf("old image = %v, want %v", got, tt.wantOld)
+			}
+		})
+	}
+}
+
+func TestVariantForSession(t *testing.T) {
+	e := &RealtimeEngine{redactionRules: testRedactionRules}
+
+	tests := []struct {
+		name      string
+		operation string
+		abilities []string
+		newData   string
+		oldData   string
+		wantKey   string
+		wantNew   map[string]interface{}
+		wantOld   map[string]interface{}
+	}{
+		{
+			name:      "update hides the column from sessions without the ability",
+			operation: "UPDATE",
+			abilities: []string{"tasks:read"},
+			newData:   `{"id":1,"salary":10,"name":"Ann"}`,
+			oldData:   `{"id":1,"salary":9,"name":"Ann"}`,
+			wantKey:   "salary",
+			wantNew:   map[string]interface{}{"id": float64(1), "name": "Ann"},
+			wantOld:   map[string]interface{}{"id": float64(1), "name": "Ann"},
+		},
+		{
+			name:      "update keeps the column for sessions with the ability",
+			operation: "UPDATE",
+			abilities: []string{"payroll"},
+			newData:   `{"id":1,"salary":10}`,
+			oldData:   `{"id":1,"salary":9}`,
+			wantKey:   "",
+			wantNew:   map[string]interface{}{"id": float64(1), "salary": float64(10)},
+			wantOld:   map[string]interface{}{"id": float64(1), "salary": float64(9)},
+		},
+		{
+			name:      "wildcard ability sees every column",
+			operation: "INSERT",
+			abilities: []string{"*"},
+			newData:   `{"id":1,"salary":10}`,
+			wantKey:   "",
+			wantNew:   map[string]interface{}{"id": float64(1), "salary": float64(10)},
+		},
+		{
+			name:      "delete hides the column in the old image",
+			operation: "DELETE",
+			oldData:   `{"id":1,"salary":9}`,
+			wantKey:   "salary",
+			wantOld:   map[string]interface{}{"id": float64(1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := PublicationMessage{Table: "wh_users", Operation: tt.operation}
+			if tt.newData != "" {
+				base.NewData = json.RawMessage(tt.newData)
+			}
+			if tt.oldData != "" {
+				base.OldData = json.RawMessage(tt.oldData)
+			}
+			variants := make(map[string]*messageVariant)
+			authSession := &AuthenticatedSession{Abilities: tt.abilities}
+
+			variant := variantForSession(variants, base, e.redactionFor(base.Table), authSession)
+
+			if variant.key != tt.wantKey {
+				t.Errorf("variant key = %q, want %q", variant.key, tt.wantKey)
+			}
+			if got := decodeImage(t, variant.message.NewData); !reflect.DeepEqual(got, tt.wantNew) {
+				t.Errorf("new image = %v, want %v", got, tt.wantNew)
+			}
+			if got := decodeImage(t, variant.message.OldData); !reflect.DeepEqual(got, tt.wantOld) {
+				t.Errorf("old image = %v, want %v", got, tt.wantOld)
+			}
+			if again := variantForSession(variants, base, e.redactionFor(base.Table), authSession); again != variant {
+				t.Errorf("variant was built twice for key %q", tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestVariantRowHash(t *testing.T) {
+	e := &RealtimeEngine{redactionRules: testRedactionRules}
+	config.RowHashes = "true"
+	t.Cleanup(func() { config.RowHashes = "" })
+
+	tests := []struct {
+		name      string
+		table     string
+		abilities []string
+		wantHash  bool
+	}{
+		{name: "unredacted table", table: "projects", wantHash: true},
+		{name: "dropped and masked columns", table: "wh_users", abilities: []string{"*"}, wantHash: false},
+		{name: "hidden column", table: "wh_teams", wantHash: false},
+		{name: "restricted column the session may see", table: "wh_teams", abilities: []string{"payroll"}, wantHash: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := PublicationMessage{Table: tt.table, Operation: "INSERT", NewData: json.RawMessage(`{"id":1,"salary":10}`)}
+			variant := variantForSession(make(map[string]*messageVariant), base, e.redactionFor(tt.table), &AuthenticatedSession{Abilities: tt.abilities})
+
+			if got := variant.message.RowHash != ""; got != tt.wantHash {
+				t.Errorf("row hash present = %v, want %v", got, tt.wantHash)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// payloadModeReference marks trigger payloads that only carry {table, operation, id}
+	payloadModeReference = "reference"
+
+	// notifyBatchSize caps how many queued notifications are resolved together
+	notifyBatchSize = 500
+
+	// referenceFetchAttempts is how often a failing row lookup is tried before clients are told to resync
+	referenceFetchAttempts = 3
+)
+
+// referencePayloadTables returns the tables configured to send reference payloads
+func referencePayloadTables() []string {
+	return getEnvList(config.ReferencePayloadTables)
+}
+
+// resolveReferencePayloads fills in the row images of reference notifications, batched per table
+// with one primary key lookup each. The fetched row is the current state, which may already include
+// later changes; their own notifications follow in the same order so clients converge. Rows missing
+// from the lookup were deleted since and are skipped; when the lookup itself keeps failing the
+// changes are lost, so the tenant's sessions are asked to resync.
+func (e *RealtimeEngine) resolveReferencePayloads(tenantName string, db *sql.DB, changes []PostgreSQLNotification) []PostgreSQLNotification {
+	idsByTable := make(map[string][]string)
+	for _, change := range changes {
+		if change.Payload == payloadModeReference && change.Operation != "DELETE" {
+			idsByTable[change.Table] = append(idsByTable[change.Table], referenceID(change.ID))
+		}
+	}
+
+	rowsByTable := make(map[string]map[string]json.RawMessage)
+	failedTables := make(map[string]bool)
+	for table, ids := range idsByTable {
+		fetched, err := fetchReferencedRows(db, table, ids)
+		if err != nil {
+			log.Printf("❌ Failed to fetch referenced %s rows for tenant %s: %v", table, tenantName, err)
+			failedTables[table] = true
+			continue
+		}
+		rowsByTable[table] = fetched
+	}
+	if len(failedTables) > 0 {
+		defer e.requestTenantResync(tenantName, "reference_lookup_failed")
+	}
+
+	resolved := make([]PostgreSQLNotification, 0, len(changes))
+	for _, change := range changes {
+		if change.Payload != payloadModeReference {
+			resolved = append(resolved, change)
+			continue
+		}
+
+		if len(change.ID) == 0 {
+			log.Printf("⚠️  Reference payload for %s without id from tenant %s - skipping", change.Table, tenantName)
+			continue
+		}
+
+		id := referenceID(change.ID)
+		if change.Operation == "DELETE" {
+			change.OldData = json.RawMessage(fmt.Sprintf(`{"id":%s}`, change.ID))
+		} else if failedTables[change.Table] {
+			log.Printf("⚠️  Referenced row %s.%s could not be read for tenant %s - dropping %s", change.Table, id, tenantName, change.Operation)
+			continue
+		} else {
+			row, found := rowsByTable[change.Table][id]
+			if !found {
+				// Row was deleted before we could read it; the DELETE notification follows
+				log.Printf("⚠️  Referenced row %s.%s no longer exists for tenant %s - skipping %s", change.Table, id, tenantName, change.Operation)
+				continue
+			}
+			change.NewData = row
+		}
+		change.Payload = ""
+		resolved = append(resolved, change)
+	}
+
+	return resolved
+}
+
+// fetchReferencedRows runs fetchRowsByID, retrying transient failures with a short backoff
+func fetchReferencedRows(db *sql.DB, table string, ids []string) (map[string]json.RawMessage, error) {
+	var err error
+	for attempt := 1; attempt <= referenceFetchAttempts; attempt++ {
+		var fetched map[string]json.RawMessage
+		if fetched, err = fetchRowsByID(db, table, ids); err == nil {
+			return fetched, nil
+		}
+		if attempt < referenceFetchAttempts {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+	}
+	return nil, err
+}
+
+// fetchRowsByID loads row_to_json images for a set of primary keys of a table
+func fetchRowsByID(db *sql.DB, table string, ids []string) (map[string]json.RawMessage, error) {
+	var idType string
+	err := db.QueryRow(`
+		SELECT format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		WHERE a.attrelid = to_regclass($1) AND a.attname = 'id' AND NOT a.attisdropped`, table).Scan(&idType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve id column of %s: %w", table, err)
+	}
+
+	query := fmt.Sprintf(`SELECT t.id::text, row_to_json(t) FROM %s t WHERE t.id = ANY($1::text[]::%s[])`,
+		pq.QuoteIdentifier(table), idType)
+	rows, err := db.Query(query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]json.RawMessage, len(ids))
+	for rows.Next() {
+		var id string
+		var row []byte
+		if err := rows.Scan(&id, &row); err != nil {
+			return nil, err
+		}
+		result[id] = json.RawMessage(row)
+	}
+	return result, rows.Err()
+}
+
+// referenceID returns the text form of a JSON primary key (numbers as-is, strings unquoted)
+func referenceID(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	return string(raw)
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// replicationSlotPrefix prefixes the logical replication slot created for each tenant database
+	replicationSlotPrefix = "whagons_rte_"
+
+	// replicationBatchSize caps the number of changes decoded per poll
+	replicationBatchSize = 1000
+
+	// postgresEpochOffset is the number of seconds between the Unix epoch and 2000-01-01 (PostgreSQL epoch)
+	postgresEpochOffset = 946684800
+)
+
+var slotNameSanitizer = regexp.MustCompile(`[^a-z0-9_]`)
+
+// replicationChangeSource consumes a pgoutput logical replication slot for a tenant database.
+// It uses the SQL replication functions so it works over the regular lib/pq connection pool
+// and reads the publications the Laravel migrations already create (whagons_*).
+type replicationChangeSource struct {
+	engine     *RealtimeEngine
+	tenantName string
+	dbName     string
+	relations  map[uint32]*pgoutputRelation
+	checkpoint uint64 // end LSN of the last transaction delivered to sessions
+	published  uint64 // end LSN of the last transaction handed to publishChange
+	held       []heldLSN
+}
+
+// heldLSN is a slot position that is only advanced to once its debounced changes were delivered
+type heldLSN struct {
+	lsn     uint64
+	barrier debounceBarrier
+}
+
+// pgoutputRelation describes a table as announced by a pgoutput Relation message
+type pgoutputRelation struct {
+	Namespace string
+	Name      string
+	Columns   []pgoutputColumn
+}
+
+// pgoutputColumn describes a single column of a pgoutput relation
+type pgoutputColumn struct {
+	Name    string
+	TypeOID uint32
+}
+
+// pgoutputTransaction tracks the transaction currently being decoded
+type pgoutputTransaction struct {
+	XID       uint32
+	Timestamp float64
+	EndLSN    uint64
+	Changes   []PostgreSQLNotification
+}
+
+// Name implements ChangeSource
+func (s *replicationChangeSource) Name() string {
+	return changeSourceReplication
+}
+
+// slotName returns the replication slot used for this tenant database
+func (s *replicationChangeSource) slotName() string {
+	return replicationSlotPrefix + slotNameSanitizer.ReplaceAllString(strings.ToLower(s.dbName), "_")
+}
+
+// Resumable implements ChangeSource - the slot retains WAL until the checkpoint is advanced
+func (s *replicationChangeSource) Resumable() bool {
+	return true
+}
+
+// Run implements ChangeSource
+func (s *replicationChangeSource) Run(stop <-chan struct{}) error {
+	s.engine.mutex.RLock()
+	tenantDB, exists := s.engine.tenantDBs[s.tenantName]
+	s.engine.mutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("tenant database connection not found for %s", s.tenantName)
+	}
+
+	publications, err := s.discoverPublications(tenantDB)
+	if err != nil {
+		return err
+	}
+	if len(publications) == 0 {
+		return fmt.Errorf("no whagons_* publications found for tenant %s", s.tenantName)
+	}
+
+	if err := s.ensureSlot(tenantDB); err != nil {
+		return err
+	}
+
+	if err := s.loadCheckpoint(); err != nil {
+		return err
+	}
+
+	log.Printf("📡 Consuming replication slot '%s' for tenant %s from %s (publications: %s)",
+		s.slotName(), s.tenantName, formatLSN(s.checkpoint), strings.Join(publications, ", "))
+
+	s.relations = make(map[uint32]*pgoutputRelation)
+	pollInterval := getDurationEnv(config.ReplicationPollInterval, time.Second)
+	publicationNames := strings.Join(publications, ",")
+
+	for {
+		count, err := s.poll(tenantDB, publicationNames)
+		if err != nil {
+			return err
+		}
+
+		// Keep draining while the slot has a backlog, otherwise wait for the next poll.
+		// A held slot returns the same batch until the debounce windows are flushed.
+		if count < replicationBatchSize || len(s.held) > 0 {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+}
+
+// loadCheckpoint restores the last delivered LSN persisted in the landlord database
+func (s *replicationChangeSource) loadCheckpoint() error {
+	position, err := s.engine.loadCheckpoint(s.tenantName, changeSourceReplication)
+	if err != nil {
+		// Without a checkpoint the slot still resumes from its confirmed position,
+		// we only lose the ability to skip transactions delivered before a crash
+		log.Printf("⚠️  %v", err)
+		return nil
+	}
+	if position == "" {
+		return nil
+	}
+
+	lsn, err := parseLSN(position)
+	if err != nil {
+		return fmt.Errorf("invalid checkpoint for tenant %s: %w", s.tenantName, err)
+	}
+	s.checkpoint = lsn
+	s.published = lsn
+	s.engine.recordListenerPosition(s.tenantName, position)
+	return nil
+}
+
+// discoverPublications lists the whagons_* publications defined in the tenant database
+func (s *replicationChangeSource) discoverPublications(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT pubname FROM pg_publication WHERE pubname LIKE 'whagons\_%' ORDER BY pubname`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query publications for tenant %s: %w", s.tenantName, err)
+	}
+	defer rows.Close()
+
+	var publications []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Printf("⚠️  Error scanning publication row: %v", err)
+			continue
+		}
+		publications = append(publications, name)
+	}
+	return publications, rows.Err()
+}
+
+// ensureSlot creates the pgoutput replication slot for the tenant database if it does not exist
+func (s *replicationChangeSource) ensureSlot(db *sql.DB) error {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, s.slotName()).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check replication slot for tenant %s: %w", s.tenantName, err)
+	}
+	if exists {
+		return nil
+	}
+
+	if _, err := db.Exec(`SELECT pg_create_logical_replication_slot($1, 'pgoutput')`, s.slotName()); err != nil {
+		return fmt.Errorf("failed to create replication slot for tenant %s (is wal_level=logical?): %w", s.tenantName, err)
+	}
+
+	log.Printf("✅ Created replication slot '%s' for tenant %s", s.slotName(), s.tenantName)
+	return nil
+}
+
+// poll peeks the next batch of changes from the slot, publishes complete transactions not published yet,
+// then persists the checkpoint and advances the slot. Changes are never removed from the slot before
+// they were delivered, including those held in a debounce window, so a crash replays them instead of losing them.
+func (s *replicationChangeSource) poll(db *sql.DB, publicationNames string) (int, error) {
+	rows, err := db.Query(`
+		SELECT data
+		FROM pg_logical_slot_peek_binary_changes($1, NULL, $2,
+			'proto_version', '1',
+			'publication_names', $3)`,
+		s.slotName(), replicationBatchSize, publicationNames)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read replication slot for tenant %s: %w", s.tenantName, err)
+	}
+	defer rows.Close()
+
+	var tx pgoutputTransaction
+	var lastEndLSN uint64
+	var xidHorizon uint64 // current 64-bit txid, used to widen the 32-bit xids of decoded transactions
+	count := 0
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return count, fmt.Errorf("failed to scan replication message: %w", err)
+		}
+		count++
+
+		// A message that cannot be decoded fails the poll, so the slot keeps it instead of skipping a change
+		committed, err := s.decode(data, &tx)
+		if err != nil {
+			return count, fmt.Errorf("failed to decode pgoutput message for tenant %s: %w", s.tenantName, err)
+		}
+		if !committed {
+			continue
+		}
+
+		// Transactions at or before the checkpoint were delivered before a restart, and the slot
+		// returns published transactions again while it is held
+		if tx.EndLSN > s.published {
+			if xidHorizon == 0 {
+				if err := db.QueryRow(`SELECT txid_snapshot_xmax(txid_current_snapshot())`).Scan(&xidHorizon); err != nil {
+					log.Printf("⚠️  Failed to read the current txid for tenant %s: %v", s.tenantName, err)
+				}
+			}
+			if err := s.fillUnchangedColumns(db, tx.Changes); err != nil {
+				return count, err
+			}
+			for _, change := range tx.Changes {
+				if xidHorizon != 0 {
+					change.TxID = widenXID(tx.XID, xidHorizon)
+				}
+				s.engine.publishChange(s.tenantName, change)
+			}
+			s.engine.flushTransaction(s.tenantName)
+		}
+		lastEndLSN = tx.EndLSN
+		tx = pgoutputTransaction{}
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("failed to read replication slot for tenant %s: %w", s.tenantName, err)
+	}
+
+	if lastEndLSN > s.published {
+		s.published = lastEndLSN
+	}
+	// A held slot returns positions it already holds
+	if lastEndLSN > 0 && (len(s.held) == 0 || lastEndLSN > s.held[len(s.held)-1].lsn) {
+		s.held = append(s.held, heldLSN{lsn: lastEndLSN, barrier: s.engine.debounceBarrier(s.tenantName)})
+	}
+	return count, s.advanceReleased(db)
+}
+
+// advanceReleased advances the slot to the last held position whose debounced changes were delivered
+func (s *replicationChangeSource) advanceReleased(db *sql.DB) error {
+	var lsn uint64
+	for len(s.held) > 0 && s.held[0].barrier.released() {
+		lsn = s.held[0].lsn
+		s.held = s.held[1:]
+	}
+	if lsn == 0 {
+		return nil
+	}
+	return s.advance(db, lsn)
+}
+
+// advance persists the delivered position and releases the WAL behind it from the slot
+func (s *replicationChangeSource) advance(db *sql.DB, lsn uint64) error {
+	if lsn > s.checkpoint {
+		if err := s.engine.saveCheckpoint(s.tenantName, changeSourceReplication, formatLSN(lsn)); err != nil {
+			log.Printf("⚠️  %v", err)
+		}
+		s.checkpoint = lsn
+	}
+
+	if _, err := db.Exec(`SELECT pg_replication_slot_advance($1, $2::pg_lsn)`, s.slotName(), formatLSN(lsn)); err != nil {
+		return fmt.Errorf("failed to advance replication slot for tenant %s: %w", s.tenantName, err)
+	}
+	return nil
+}
+
+// fillUnchangedColumns completes UPDATE images missing unchanged TOASTed columns. The values come from
+// the old image under REPLICA IDENTITY FULL, otherwise from the current row, fetched once per table.
+// Columns of rows deleted since are left out, their DELETE follows.
+func (s *replicationChangeSource) fillUnchangedColumns(db *sql.DB, changes []PostgreSQLNotification) error {
+	rowIDs := make(map[int]string)
+	idsByTable := make(map[string][]string)
+	for i := range changes {
+		change := &changes[i]
+		if len(change.Unchanged) == 0 {
+			continue
+		}
+		var oldRow map[string]json.RawMessage
+		if len(change.OldData) > 0 {
+			if err := json.Unmarshal(change.OldData, &oldRow); err != nil {
+				return fmt.Errorf("invalid old image of %s for tenant %s: %w", change.Table, s.tenantName, err)
+			}
+		}
+		var missing []string
+		for _, column := range change.Unchanged {
+			if value, found := oldRow[column]; found {
+				change.NewData = appendColumn(change.NewData, column, value)
+			} else {
+				missing = append(missing, column)
+			}
+		}
+		change.Unchanged = missing
+		if len(missing) == 0 {
+			continue
+		}
+
+		var row struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(change.NewData, &row); err != nil {
+			return fmt.Errorf("invalid new image of %s for tenant %s: %w", change.Table, s.tenantName, err)
+		}
+		if row.ID == nil {
+			return fmt.Errorf("cannot read unchanged columns of %s for tenant %s: row has no id", change.Table, s.tenantName)
+		}
+		rowIDs[i] = referenceID(row.ID)
+		idsByTable[change.Table] = append(idsByTable[change.Table], rowIDs[i])
+	}
+
+	rowsByTable := make(map[string]map[string]json.RawMessage)
+	for table, ids := range idsByTable {
+		fetched, err := fetchRowsByID(db, table, ids)
+		if err != nil {
+			return fmt.Errorf("failed to read unchanged columns of %s for tenant %s: %w", table, s.tenantName, err)
+		}
+		rowsByTable[table] = fetched
+	}
+
+	for i, id := range rowIDs {
+		change := &changes[i]
+		var current map[string]json.RawMessage
+		if fetched, found := rowsByTable[change.Table][id]; found {
+			if err := json.Unmarshal(fetched, &current); err != nil {
+				return fmt.Errorf("invalid current image of %s row %s for tenant %s: %w", change.Table, id, s.tenantName, err)
+			}
+		}
+		for _, column := range change.Unchanged {
+			if value, found := current[column]; found {
+				change.NewData = appendColumn(change.NewData, column, value)
+			} else {
+				log.Printf("⚠️  Unchanged column %s.%s of row %s not found for tenant %s - row deleted since", change.Table, column, id, s.tenantName)
+			}
+		}
+		change.Unchanged = nil
+	}
+	return nil
+}
+
+// appendColumn adds a column to a JSON object image
+func appendColumn(image json.RawMessage, column string, value json.RawMessage) json.RawMessage {
+	key, _ := json.Marshal(column)
+	out := make([]byte, 0, len(image)+len(key)+len(value)+2)
+	out = append(out, image[:len(image)-1]...)
+	if len(image) > 2 {
+		out = append(out, ',')
+	}
+	out = append(out, key...)
+	out = append(out, ':')
+	out = append(out, value...)
+	return append(out, '}')
+}
+
+// widenXID converts a 32-bit xid into the 64-bit txid form using a recent txid as reference
+func widenXID(xid uint32, horizon uint64) uint64 {
+	txid := horizon&^0xFFFFFFFF | uint64(xid)
+	if txid > horizon && txid >= 1<<32 {
+		txid -= 1 << 32 // the transaction ran before the last xid wraparound
+	}
+	return txid
+}
+
+// decode parses a single pgoutput message into the current transaction and reports whether it committed
+func (s *replicationChangeSource) decode(data []byte, tx *pgoutputTransaction) (bool, error) {
+	changes, err := s.decodeMessage(data, tx)
+	if err != nil {
+		return false, err
+	}
+	tx.Changes = append(tx.Changes, changes...)
+	return data[0] == 'C', nil
+}
+
+// decodeMessage parses a single pgoutput message, updating the relation cache and returning any row changes
+func (s *replicationChangeSource) decodeMessage(data []byte, tx *pgoutputTransaction) ([]PostgreSQLNotification, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+
+	r := &pgoutputReader{buf: data[1:]}
+
+	switch data[0] {
+	case 'B': // Begin: final LSN, commit timestamp, xid
+		r.uint64()
+		tx.Timestamp = pgTimestampToUnix(int64(r.uint64()))
+		tx.XID = r.uint32()
+	case 'C': // Commit: flags, commit LSN, end LSN, commit timestamp
+		r.uint8()
+		r.uint64()
+		tx.EndLSN = r.uint64()
+	case 'O', 'Y', 'M': // Origin, Type and logical decoding messages carry no row data
+	case 'R':
+		relationID := r.uint32()
+		relation := &pgoutputRelation{Namespace: r.string(), Name: r.string()}
+		r.uint8() // replica identity
+		columnCount := int(r.uint16())
+		for i := 0; i < columnCount; i++ {
+			r.uint8() // flags
+			column := pgoutputColumn{Name: r.string(), TypeOID: r.uint32()}
+			r.uint32() // type modifier
+			relation.Columns = append(relation.Columns, column)
+		}
+		s.relations[relationID] = relation
+	case 'I':
+		relation, err := s.relation(r.uint32())
+		if err != nil {
+			return nil, err
+		}
+		r.uint8() // 'N'
+		newData, _ := r.tuple(relation)
+		return []PostgreSQLNotification{{
+			Table:     relation.Name,
+			Operation: "INSERT",
+			NewData:   newData,
+			Timestamp: tx.Timestamp,
+		}}, r.err
+	case 'U':
+		relation, err := s.relation(r.uint32())
+		if err != nil {
+			return nil, err
+		}
+		change := PostgreSQLNotification{Table: relation.Name, Operation: "UPDATE", Timestamp: tx.Timestamp}
+		kind := r.uint8()
+		if kind == 'K' || kind == 'O' {
+			// Old image is only sent for key changes or REPLICA IDENTITY FULL
+			change.OldData, _ = r.tuple(relation)
+			r.uint8() // 'N'
+		}
+		change.NewData, change.Unchanged = r.tuple(relation)
+		return []PostgreSQLNotification{change}, r.err
+	case 'D':
+		relation, err := s.relation(r.uint32())
+		if err != nil {
+			return nil, err
+		}
+		r.uint8() // 'K' or 'O'
+		oldData, _ := r.tuple(relation)
+		return []PostgreSQLNotification{{
+			Table:     relation.Name,
+			Operation: "DELETE",
+			OldData:   oldData,
+			Timestamp: tx.Timestamp,
+		}}, r.err
+	case 'T':
+		relationCount := int(r.uint32())
+		r.uint8() // options
+		var changes []PostgreSQLNotification
+		for i := 0; i < relationCount; i++ {
+			relation, err := s.relation(r.uint32())
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, PostgreSQLNotification{Table: relation.Name, Operation: "TRUNCATE", Timestamp: tx.Timestamp})
+		}
+		return changes, r.err
+	default:
+		return nil, fmt.Errorf("unsupported message type %q", data[0])
+	}
+
+	return nil, r.err
+}
+
+// relation looks up a relation announced earlier in the stream
+func (s *replicationChangeSource) relation(id uint32) (*pgoutputRelation, error) {
+	relation, exists := s.relations[id]
+	if !exists {
+		return nil, fmt.Errorf("unknown relation id %d", id)
+	}
+	return relation, nil
+}
+
+// pgoutputReader reads big-endian pgoutput fields, remembering the first error
+type pgoutputReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pgoutputReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = fmt.Errorf("message truncated")
+		return nil
+	}
+	out := r.buf[:n]
+	r.buf = r.buf[n:]
+	return out
+}
+
+func (r *pgoutputReader) uint8() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *pgoutputReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *pgoutputReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *pgoutputReader) uint64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *pgoutputReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(r.buf, 0)
+	if end < 0 {
+		r.err = fmt.Errorf("unterminated string")
+		return ""
+	}
+	value := string(r.buf[:end])
+	r.buf = r.buf[end+1:]
+	return value
+}
+
+// tuple decodes TupleData into a JSON object keyed by column name, in column order like row_to_json.
+// Scalars, json and timestamps are converted the way row_to_json writes them; other types, arrays
+// included, keep their text form as a JSON string. It also returns the unchanged TOASTed columns the
+// server did not send, which are left out of the object.
+func (r *pgoutputReader) tuple(relation *pgoutputRelation) (json.RawMessage, []string) {
+	columnCount := int(r.uint16())
+
+	columnName := func(i int) string {
+		if i < len(relation.Columns) {
+			return relation.Columns[i].Name
+		}
+		return fmt.Sprintf("column_%d", i)
+	}
+
+	var out bytes.Buffer
+	out.WriteByte('{')
+	written := 0
+	var unchanged []string
+	for i := 0; i < columnCount && r.err == nil; i++ {
+		kind := r.uint8()
+		var value json.RawMessage
+		switch kind {
+		case 'n':
+			value = json.RawMessage("null")
+		case 'u':
+			// Unchanged TOASTed value - not sent by the server, filled in by fillUnchangedColumns
+			unchanged = append(unchanged, columnName(i))
+			continue
+		case 't':
+			length := int(r.uint32())
+			text := r.take(length)
+			var typeOID uint32
+			if i < len(relation.Columns) {
+				typeOID = relation.Columns[i].TypeOID
+			}
+			value = pgTextToJSON(typeOID, string(text))
+		default:
+			r.err = fmt.Errorf("unsupported tuple data kind %q", kind)
+			return nil, nil
+		}
+
+		if written > 0 {
+			out.WriteByte(',')
+		}
+		key, _ := json.Marshal(columnName(i))
+		out.Write(key)
+		out.WriteByte(':')
+		out.Write(value)
+		written++
+	}
+	out.WriteByte('}')
+
+	if r.err != nil {
+		return nil, nil
+	}
+	return json.RawMessage(out.Bytes()), unchanged
+}
+
+// pgTextToJSON converts a value in PostgreSQL text output format to JSON based on its type OID
+func pgTextToJSON(typeOID uint32, text string) json.RawMessage {
+	switch typeOID {
+	case 16: // bool
+		if text == "t" {
+			return json.RawMessage("true")
+		}
+		return json.RawMessage("false")
+	case 20, 21, 23, 26, 700, 701, 1700: // int8, int2, int4, oid, float4, float8, numeric
+		// NaN and Infinity are valid numerics but not valid JSON numbers
+		if json.Valid([]byte(text)) {
+			return json.RawMessage(text)
+		}
+	case 114, 3802: // json, jsonb
+		if json.Valid([]byte(text)) {
+			return json.RawMessage(text)
+		}
+	case 1114: // timestamp - row_to_json uses ISO 8601 with a T separator
+		text = strings.Replace(text, " ", "T", 1)
+	case 1184: // timestamptz - also with a full +hh:mm offset where the text form may only have +hh
+		text = isoOffset(strings.Replace(text, " ", "T", 1))
+	case 1266: // timetz
+		text = isoOffset(text)
+	}
+
+	encoded, _ := json.Marshal(text)
+	return json.RawMessage(encoded)
+}
+
+// isoOffset completes a trailing +hh or -hh UTC offset to the +hh:mm form
+func isoOffset(text string) string {
+	n := len(text)
+	if n >= 3 && (text[n-3] == '+' || text[n-3] == '-') && isDigit(text[n-2]) && isDigit(text[n-1]) {
+		return text + ":00"
+	}
+	return text
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// pgTimestampToUnix converts microseconds since the PostgreSQL epoch to Unix seconds
+func pgTimestampToUnix(micros int64) float64 {
+	return float64(micros)/1e6 + postgresEpochOffset
+}
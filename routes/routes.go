@@ -14,6 +14,8 @@ import (
 type EngineInterface interface {
 	controllers.RealtimeEngineInterface
 	controllers.HealthEngineInterface
+	controllers.TriggerEngineInterface
+	controllers.SyncEngineInterface
 }
 
 // SetupRoutes configures all API routes
@@ -21,6 +23,8 @@ func SetupRoutes(app *fiber.App, engine EngineInterface) {
 	// Create controllers
 	sessionController := controllers.NewSessionController(engine)
 	healthController := controllers.NewHealthController(engine)
+	triggerController := controllers.NewTriggerController(engine)
+	syncController := controllers.NewSyncController(engine)
 
 	// Add middleware for logging, CORS, and recovery
 	setupMiddleware(app)
@@ -37,6 +41,7 @@ func SetupRoutes(app *fiber.App, engine EngineInterface) {
 
 	// Session management endpoints
 	sessions := api.Group("/sessions")
+	sessions.Get("/", sessionController.ListSessions)
 	sessions.Get("/count", sessionController.GetSessionsCount)
 	sessions.Post("/disconnect-all", sessionController.DisconnectAllSessions)
 
@@ -44,6 +49,16 @@ func SetupRoutes(app *fiber.App, engine EngineInterface) {
 	tenants := api.Group("/tenants")
 	tenants.Post("/reload", sessionController.ReloadTenants)
 	tenants.Post("/test-notification", sessionController.TestTenantNotification)
+	tenants.Get("/channels", sessionController.GetTenantChannels)
+	tenants.Get("/triggers", triggerController.GetTriggers)
+	tenants.Post("/triggers/sync", triggerController.SyncTriggers)
+
+	// Client synchronization endpoints
+	sync := api.Group("/sync")
+	sync.Post("/snapshot", syncController.Snapshot)
+	sync.Post("/delta", syncController.Delta)
+	sync.Post("/checksum", syncController.Checksum)
+	sync.Post("/reconcile", syncController.Reconcile)
 
 	// Broadcasting endpoint
 	api.Post("/broadcast", sessionController.BroadcastMessage)
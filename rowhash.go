@@ -0,0 +1,398 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// rowHashBucketSize is the id range of the rolling hashes kept in row_hash_buckets. Checksums whose
+// bucket size is a multiple of it are answered from the buckets instead of scanning the table.
+const rowHashBucketSize = 1000
+
+// rowHashVersion is bumped whenever the row hash definition changes; hashes are rebuilt on upgrade
+const rowHashVersion = 1
+
+// Engine-owned row hash objects installed in every tenant database
+const (
+	rowHashTable       = "row_hashes"
+	rowHashBucketTable = "row_hash_buckets"
+	rowHashFunction    = "update_row_hash"
+)
+
+// rowHashFunctionSQL keeps row_hashes and row_hash_buckets in step with a table. A row hash is
+// md5(to_jsonb(row)::text); a bucket hash is the XOR of the row hashes in its id range, stored as two
+// 64-bit halves so a change only touches its own bucket.
+var rowHashFunctionSQL = fmt.Sprintf(`
+	CREATE OR REPLACE FUNCTION update_row_hash()
+	RETURNS TRIGGER AS $$
+	DECLARE
+		old_hash TEXT;
+		new_hash TEXT;
+	BEGIN
+		IF TG_OP = 'TRUNCATE' THEN
+			DELETE FROM row_hashes WHERE table_name = TG_TABLE_NAME;
+			DELETE FROM row_hash_buckets WHERE table_name = TG_TABLE_NAME;
+			RETURN NULL;
+		END IF;
+
+		IF TG_OP IN ('UPDATE', 'DELETE') THEN
+			DELETE FROM row_hashes WHERE table_name = TG_TABLE_NAME AND row_id = OLD.id
+			RETURNING row_hash INTO old_hash;
+			IF old_hash IS NOT NULL THEN
+				UPDATE row_hash_buckets SET
+					row_count = row_count - 1,
+					hash_hi = hash_hi # ('x' || substr(old_hash, 1, 16))::bit(64)::bigint,
+					hash_lo = hash_lo # ('x' || substr(old_hash, 17, 16))::bit(64)::bigint
+				WHERE table_name = TG_TABLE_NAME AND bucket = floor(OLD.id::numeric / %[1]d)::bigint;
+			END IF;
+		END IF;
+
+		IF TG_OP IN ('INSERT', 'UPDATE') THEN
+			new_hash = md5(to_jsonb(NEW)::text);
+			INSERT INTO row_hashes (table_name, row_id, row_hash, last_updated)
+			VALUES (TG_TABLE_NAME, NEW.id, new_hash, COALESCE((to_jsonb(NEW)->>'updated_at')::timestamptz, now()));
+			INSERT INTO row_hash_buckets (table_name, bucket, row_count, hash_hi, hash_lo)
+			VALUES (
+				TG_TABLE_NAME,
+				floor(NEW.id::numeric / %[1]d)::bigint,
+				1,
+				('x' || substr(new_hash, 1, 16))::bit(64)::bigint,
+				('x' || substr(new_hash, 17, 16))::bit(64)::bigint
+			)
+			ON CONFLICT (table_name, bucket) DO UPDATE SET
+				row_count = row_hash_buckets.row_count + 1,
+				hash_hi = row_hash_buckets.hash_hi # EXCLUDED.hash_hi,
+				hash_lo = row_hash_buckets.hash_lo # EXCLUDED.hash_lo;
+		END IF;
+
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;`, rowHashBucketSize)
+
+// rowHashComment is the version marker stored on the row hash function
+func rowHashComment() string {
+	return fmt.Sprintf("whagonsRTE row hash v%d (bucket size %d)", rowHashVersion, rowHashBucketSize)
+}
+
+// imageHash returns the row hash of a row_to_json image, or "" when there is no row
+func imageHash(raw json.RawMessage) string {
+	row := decodeRowImage(raw)
+	if row == nil {
+		return ""
+	}
+	return hashRow(row).String()
+}
+
+// splitDigest converts the signed 64-bit halves stored by PostgreSQL back into a digest
+func splitDigest(hi, lo int64) rowDigest {
+	var digest rowDigest
+	for i := 0; i < 8; i++ {
+		digest[i] = byte(uint64(hi) >> (56 - 8*i))
+		digest[8+i] = byte(uint64(lo) >> (56 - 8*i))
+	}
+	return digest
+}
+
+// digestHalves splits a digest into the signed 64-bit halves stored by PostgreSQL
+func digestHalves(digest rowDigest) (int64, int64) {
+	var hi, lo uint64
+	for i := 0; i < 8; i++ {
+		hi = hi<<8 | uint64(digest[i])
+		lo = lo<<8 | uint64(digest[8+i])
+	}
+	return int64(hi), int64(lo)
+}
+
+// setupTenantRowHashes installs row_hashes, row_hash_buckets and the row hash triggers on every managed
+// table with an integer id when a tenant connects. Tables getting the trigger for the first time are backfilled.
+func (e *RealtimeEngine) setupTenantRowHashes(tenantName string, db *sql.DB) error {
+	if !getBoolEnv(config.RowHashes, false) {
+		return nil
+	}
+
+	createTablesSQL := `
+		CREATE TABLE IF NOT EXISTS row_hashes (
+			table_name   TEXT NOT NULL,
+			row_id       BIGINT NOT NULL,
+			row_hash     TEXT NOT NULL,
+			last_updated TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (table_name, row_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_row_hashes_last_updated ON row_hashes (table_name, last_updated DESC);
+		CREATE TABLE IF NOT EXISTS row_hash_buckets (
+			table_name TEXT NOT NULL,
+			bucket     BIGINT NOT NULL,
+			row_count  BIGINT NOT NULL DEFAULT 0,
+			hash_hi    BIGINT NOT NULL DEFAULT 0,
+			hash_lo    BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (table_name, bucket)
+		);`
+	if _, err := db.Exec(createTablesSQL); err != nil {
+		return fmt.Errorf("failed to create row hash tables for tenant %s: %w", tenantName, err)
+	}
+
+	// A missing, outdated or edited function means every stored hash has to be recomputed
+	status, err := inspectFunction(db, rowHashFunction, rowHashFunctionSQL, rowHashComment())
+	if err != nil {
+		return fmt.Errorf("failed to check %s for tenant %s: %w", rowHashFunction, tenantName, err)
+	}
+	rebuild := status != triggerStatusOK
+	if rebuild {
+		if _, err := db.Exec(rowHashFunctionSQL); err != nil {
+			return fmt.Errorf("failed to create %s for tenant %s: %w", rowHashFunction, tenantName, err)
+		}
+		if _, err := db.Exec(fmt.Sprintf("COMMENT ON FUNCTION %s() IS %s", pq.QuoteIdentifier(rowHashFunction), pq.QuoteLiteral(rowHashComment()))); err != nil {
+			return fmt.Errorf("failed to version %s for tenant %s: %w", rowHashFunction, tenantName, err)
+		}
+	}
+
+	return e.installRowHashes(tenantName, db, rebuild)
+}
+
+// installMissingRowHashes hashes managed tables created since the tenant connected. It runs after DDL
+// and creates nothing else: CREATE TABLE IF NOT EXISTS fires the DDL event trigger even when it is a
+// no-op, which would notify again and refresh forever.
+func (e *RealtimeEngine) installMissingRowHashes(tenantName string, db *sql.DB) error {
+	if !getBoolEnv(config.RowHashes, false) {
+		return nil
+	}
+	return e.installRowHashes(tenantName, db, false)
+}
+
+// installRowHashes attaches the row hash triggers to managed tables with an integer id that lack them,
+// or recomputes every table's hashes when rebuild is set
+func (e *RealtimeEngine) installRowHashes(tenantName string, db *sql.DB, rebuild bool) error {
+	tables, err := managedTables(db)
+	if err != nil {
+		return fmt.Errorf("failed to list tables for tenant %s: %w", tenantName, err)
+	}
+
+	installed := 0
+	for _, table := range tables {
+		var integerID, hashed bool
+		err := db.QueryRow(`
+			SELECT
+				EXISTS (SELECT 1 FROM information_schema.columns
+					WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'id'
+					AND data_type IN ('smallint', 'integer', 'bigint')),
+				EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = to_regclass($2) AND tgname = $3)`,
+			table, pq.QuoteIdentifier(table), table+"_row_hash_trigger").Scan(&integerID, &hashed)
+		if err != nil {
+			log.Printf("⚠️  Failed to inspect row hash trigger on %s for tenant %s: %v", table, tenantName, err)
+			continue
+		}
+		if !integerID || (hashed && !rebuild) {
+			continue
+		}
+
+		if err := installRowHashTrigger(db, table, !hashed); err != nil {
+			log.Printf("⚠️  Failed to install row hashes on %s for tenant %s: %v", table, tenantName, err)
+			continue
+		}
+		installed++
+	}
+
+	if installed > 0 {
+		log.Printf("🧮 Row hashes built for %d table(s) of tenant %s", installed, tenantName)
+	}
+	return nil
+}
+
+// installRowHashTrigger (re)computes the row and bucket hashes of a table and, when create is set,
+// attaches the row hash triggers. The table is locked against writes meanwhile so no change is missed.
+func installRowHashTrigger(db *sql.DB, table string, create bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	quotedTable := pq.QuoteIdentifier(table)
+	if _, err := tx.Exec(fmt.Sprintf("LOCK TABLE %s IN SHARE ROW EXCLUSIVE MODE", quotedTable)); err != nil {
+		return fmt.Errorf("failed to lock table: %w", err)
+	}
+
+	if create {
+		createTriggersSQL := fmt.Sprintf(`
+			CREATE TRIGGER %[1]s
+				AFTER INSERT OR UPDATE OR DELETE ON %[3]s
+				FOR EACH ROW EXECUTE FUNCTION update_row_hash();
+			CREATE TRIGGER %[2]s
+				AFTER TRUNCATE ON %[3]s
+				FOR EACH STATEMENT EXECUTE FUNCTION update_row_hash();`,
+			pq.QuoteIdentifier(table+"_row_hash_trigger"), pq.QuoteIdentifier(table+"_row_hash_truncate_trigger"), quotedTable)
+		if _, err := tx.Exec(createTriggersSQL); err != nil {
+			return fmt.Errorf("failed to create triggers: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM row_hashes WHERE table_name = $1`, table); err != nil {
+		return fmt.Errorf("failed to clear row hashes: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM row_hash_buckets WHERE table_name = $1`, table); err != nil {
+		return fmt.Errorf("failed to clear bucket hashes: %w", err)
+	}
+	backfillSQL := fmt.Sprintf(`
+		INSERT INTO row_hashes (table_name, row_id, row_hash, last_updated)
+		SELECT $1, t.id, md5(to_jsonb(t)::text), COALESCE((to_jsonb(t)->>'updated_at')::timestamptz, now())
+		FROM %s t`, quotedTable)
+	if _, err := tx.Exec(backfillSQL, table); err != nil {
+		return fmt.Errorf("failed to backfill row hashes: %w", err)
+	}
+
+	// Fold the row hashes into buckets here, bit_xor() is not available before PostgreSQL 14
+	rows, err := tx.Query(`SELECT row_id, row_hash FROM row_hashes WHERE table_name = $1`, table)
+	if err != nil {
+		return fmt.Errorf("failed to read row hashes: %w", err)
+	}
+	type bucketState struct {
+		count  int64
+		digest rowDigest
+	}
+	buckets := make(map[int64]*bucketState)
+	for rows.Next() {
+		var rowID int64
+		var rowHash string
+		if err := rows.Scan(&rowID, &rowHash); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read row hashes: %w", err)
+		}
+		digest, err := parseDigest(rowHash)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		index := floorDiv(rowID, rowHashBucketSize)
+		bucket, exists := buckets[index]
+		if !exists {
+			bucket = &bucketState{}
+			buckets[index] = bucket
+		}
+		bucket.count++
+		bucket.digest.xor(digest)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read row hashes: %w", err)
+	}
+
+	for index, bucket := range buckets {
+		hi, lo := digestHalves(bucket.digest)
+		_, err := tx.Exec(`
+			INSERT INTO row_hash_buckets (table_name, bucket, row_count, hash_hi, hash_lo)
+			VALUES ($1, $2, $3, $4, $5)`, table, index, bucket.count, hi, lo)
+		if err != nil {
+			return fmt.Errorf("failed to store bucket hashes: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// parseDigest decodes a hex row hash
+func parseDigest(text string) (rowDigest, error) {
+	var digest rowDigest
+	if len(text) != 2*len(digest) {
+		return digest, fmt.Errorf("invalid row hash %q", text)
+	}
+	for i := range digest {
+		value, err := strconv.ParseUint(text[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return digest, fmt.Errorf("invalid row hash %q", text)
+		}
+		digest[i] = byte(value)
+	}
+	return digest, nil
+}
+
+// checksumFromBuckets fills a checksum from row_hash_buckets. It returns false when the table has no
+// row hash trigger; the caller then hashes the rows itself.
+func checksumFromBuckets(tx *sql.Tx, request ChecksumRequest, result *ChecksumResult) (bool, error) {
+	var hashed bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = to_regclass($1) AND tgname = $2)`,
+		pq.QuoteIdentifier(request.Table), request.Table+"_row_hash_trigger").Scan(&hashed)
+	if err != nil || !hashed {
+		return false, err
+	}
+
+	query := `SELECT bucket, row_count, hash_hi, hash_lo FROM row_hash_buckets WHERE table_name = $1 AND row_count > 0`
+	idQuery := `SELECT row_id::text FROM row_hashes WHERE table_name = $1`
+	args := []interface{}{request.Table}
+	idArgs := []interface{}{request.Table}
+	if request.FromID != nil {
+		args = append(args, floorDiv(*request.FromID, rowHashBucketSize))
+		query += fmt.Sprintf(" AND bucket >= $%d", len(args))
+		idArgs = append(idArgs, *request.FromID)
+		idQuery += fmt.Sprintf(" AND row_id >= $%d", len(idArgs))
+	}
+	if request.ToID != nil {
+		args = append(args, floorDiv(*request.ToID, rowHashBucketSize))
+		query += fmt.Sprintf(" AND bucket < $%d", len(args))
+		idArgs = append(idArgs, *request.ToID)
+		idQuery += fmt.Sprintf(" AND row_id < $%d", len(idArgs))
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var total rowDigest
+	buckets := make(map[int64]*BucketChecksum)
+	bucketDigests := make(map[int64]*rowDigest)
+	for rows.Next() {
+		var fine, count, hi, lo int64
+		if err := rows.Scan(&fine, &count, &hi, &lo); err != nil {
+			return false, err
+		}
+		digest := splitDigest(hi, lo)
+		total.xor(digest)
+		result.Count += int(count)
+
+		if request.BucketSize == 0 {
+			continue
+		}
+		index := floorDiv(fine, request.BucketSize/rowHashBucketSize)
+		bucket, exists := buckets[index]
+		if !exists {
+			if len(buckets) >= maxChecksumBuckets {
+				return false, newSyncError(http.StatusBadRequest, "too_many_buckets", "More than %d buckets - use a larger bucket_size or an id range", maxChecksumBuckets)
+			}
+			bucket = &BucketChecksum{Bucket: index, FromID: index * request.BucketSize, ToID: (index + 1) * request.BucketSize}
+			buckets[index] = bucket
+			bucketDigests[index] = &rowDigest{}
+		}
+		bucket.Count += int(count)
+		bucketDigests[index].xor(digest)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	result.Checksum = total.String()
+	result.Buckets = collectBuckets(request.BucketSize, buckets, bucketDigests)
+
+	// The most recently updated row, read back from the table so the timestamp has the row's own format
+	idQuery += " ORDER BY last_updated DESC, row_id DESC LIMIT 1"
+	err = tx.QueryRow(idQuery, idArgs...).Scan(&result.LastRowID)
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	var lastUpdated sql.NullString
+	err = tx.QueryRow(fmt.Sprintf(`SELECT row_to_json(t)->>'updated_at' FROM %s t WHERE t.id = $1`, pq.QuoteIdentifier(request.Table)),
+		result.LastRowID).Scan(&lastUpdated)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	result.LastUpdated = lastUpdated.String
+	return true, nil
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// maxSnapshotPageSize caps the rows read per snapshot page
+const maxSnapshotPageSize = 5000
+
+// syncError is a sync API failure carrying the HTTP status and the WebSocket error code
+type syncError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (err *syncError) Error() string {
+	return err.message
+}
+
+// StatusCode returns the HTTP status of the failure (used by the sync controller)
+func (err *syncError) StatusCode() int {
+	return err.status
+}
+
+// Code returns the machine-readable error code of the failure (used by the sync controller)
+func (err *syncError) Code() string {
+	return err.code
+}
+
+func newSyncError(status int, code, format string, args ...interface{}) *syncError {
+	return &syncError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// txSnapshot is a PostgreSQL transaction snapshot (txid_current_snapshot): transactions below xmin
+// were finished when it was taken, those from xmax on and those listed in xip were not
+type txSnapshot struct {
+	xmin uint64
+	xmax uint64
+	xip  map[uint64]bool
+}
+
+// parseTxSnapshot parses the xmin:xmax:xip,... text form
+func parseTxSnapshot(text string) (*txSnapshot, error) {
+	parts := strings.Split(text, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid transaction snapshot %q", text)
+	}
+	xmin, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction snapshot %q", text)
+	}
+	xmax, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || xmax < xmin {
+		return nil, fmt.Errorf("invalid transaction snapshot %q", text)
+	}
+	snapshot := &txSnapshot{xmin: xmin, xmax: xmax, xip: make(map[uint64]bool)}
+	for _, item := range getEnvList(parts[2]) {
+		txid, err := strconv.ParseUint(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transaction snapshot %q", text)
+		}
+		snapshot.xip[txid] = true
+	}
+	return snapshot, nil
+}
+
+// includes reports whether the changes of a committed transaction are part of the snapshot.
+// Changes without a txid (triggers older than version 2) are never considered included.
+func (s *txSnapshot) includes(txid uint64) bool {
+	if txid == 0 {
+		return false
+	}
+	return txid < s.xmin || (txid < s.xmax && !s.xip[txid])
+}
+
+// formatSnapshotCursor encodes the change-stream position of a snapshot for the subscribe message
+func formatSnapshotCursor(seq uint64, snapshot string) string {
+	return fmt.Sprintf("%d@%s", seq, snapshot)
+}
+
+// parseSnapshotCursor decodes a cursor returned with a snapshot
+func parseSnapshotCursor(cursor string) (uint64, *txSnapshot, error) {
+	seqText, snapshotText, found := strings.Cut(cursor, "@")
+	if !found {
+		return 0, nil, fmt.Errorf("invalid snapshot cursor %q", cursor)
+	}
+	seq, err := strconv.ParseUint(seqText, 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid snapshot cursor %q", cursor)
+	}
+	snapshot, err := parseTxSnapshot(snapshotText)
+	if err != nil {
+		return 0, nil, err
+	}
+	return seq, snapshot, nil
+}
+
+// SnapshotRequest asks for the next page of a table snapshot. Without SnapshotID a new snapshot is opened.
+type SnapshotRequest struct {
+	RequestID  string `json:"request_id,omitempty"`
+	Table      string `json:"table"`
+	Filter     string `json:"filter,omitempty"`
+	PageSize   int    `json:"page_size,omitempty"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+}
+
+// SnapshotPage is one page of rows read from a consistent table snapshot
+type SnapshotPage struct {
+	RequestID  string            `json:"request_id,omitempty"`
+	SnapshotID string            `json:"snapshot_id"`
+	Table      string            `json:"table"`
+	Seq        uint64            `json:"seq"`
+	Cursor     string            `json:"snapshot_cursor"`
+	LSN        string            `json:"lsn,omitempty"`
+	Page       int               `json:"page"`
+	Rows       []json.RawMessage `json:"rows"`
+	HasMore    bool              `json:"has_more"`
+}
+
+// openSnapshot is a REPEATABLE READ transaction kept open between the pages of a snapshot
+type openSnapshot struct {
+	mutex sync.Mutex
+
+	id          string
+	tenantName  string
+	tokenID     int
+	table       string
+	filter      *rowFilter
+	pageSize    int
+	tx          *sql.Tx
+	seq         uint64
+	txSnapshot  string
+	lsn         string
+	lastID      string // keyset cursor: id of the last row read
+	page        int
+	lastUsedAt  time.Time
+	authSession *AuthenticatedSession
+	grants      *UserGrants
+}
+
+// snapshotPage opens a snapshot or continues an open one and returns its next page
+func (e *RealtimeEngine) snapshotPage(authSession *AuthenticatedSession, grants *UserGrants, request SnapshotRequest) (*SnapshotPage, error) {
+	var snapshot *openSnapshot
+	if request.SnapshotID != "" {
+		e.snapshotMutex.Lock()
+		snapshot = e.snapshots[request.SnapshotID]
+		e.snapshotMutex.Unlock()
+		if snapshot == nil || snapshot.tenantName != authSession.TenantName || snapshot.tokenID != authSession.TokenID {
+			return nil, newSyncError(http.StatusNotFound, "unknown_snapshot", "Snapshot %s not found or expired", request.SnapshotID)
+		}
+	} else {
+		opened, err := e.openTableSnapshot(authSession, grants, request)
+		if err != nil {
+			return nil, err
+		}
+		snapshot = opened
+	}
+
+	snapshot.mutex.Lock()
+	defer snapshot.mutex.Unlock()
+	if snapshot.tx == nil {
+		return nil, newSyncError(http.StatusNotFound, "unknown_snapshot", "Snapshot %s not found or expired", snapshot.id)
+	}
+	snapshot.lastUsedAt = time.Now()
+
+	page, err := e.readSnapshotPage(snapshot)
+	if err != nil {
+		e.closeSnapshot(snapshot)
+		return nil, err
+	}
+	page.RequestID = request.RequestID
+	if !page.HasMore {
+		e.closeSnapshot(snapshot)
+		log.Printf("📸 Snapshot %s of %s.%s complete (%d page(s), seq %d)",
+			snapshot.id, snapshot.tenantName, snapshot.table, snapshot.page, snapshot.seq)
+	}
+	return page, nil
+}
+
+// openTableSnapshot starts the snapshot transaction of a table. Every change sequenced after it that
+// the snapshot does not contain (per txid) is delivered live to subscriptions resuming from its cursor.
+func (e *RealtimeEngine) openTableSnapshot(authSession *AuthenticatedSession, grants *UserGrants, request SnapshotRequest) (*openSnapshot, error) {
+	filter, pageSize, err := e.checkSyncTable(grants, request.Table, request.Filter, request.PageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	e.snapshotMutex.Lock()
+	openCount := len(e.snapshots)
+	e.snapshotMutex.Unlock()
+	if openCount >= getIntEnv(config.SnapshotMaxOpen, 32) {
+		return nil, newSyncError(http.StatusServiceUnavailable, "too_many_snapshots", "Too many snapshots in progress, retry shortly")
+	}
+
+	syncTx, err := e.beginSyncTransaction(authSession.TenantName)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &openSnapshot{
+		id:          uuid.New().String(),
+		tenantName:  authSession.TenantName,
+		tokenID:     authSession.TokenID,
+		table:       request.Table,
+		filter:      filter,
+		pageSize:    pageSize,
+		tx:          syncTx.tx,
+		seq:         syncTx.seq,
+		txSnapshot:  syncTx.txSnapshot,
+		lsn:         syncTx.lsn,
+		lastUsedAt:  time.Now(),
+		authSession: authSession,
+		grants:      grants,
+	}
+
+	e.snapshotMutex.Lock()
+	e.snapshots[snapshot.id] = snapshot
+	e.snapshotMutex.Unlock()
+
+	log.Printf("📸 Opened snapshot %s of %s.%s for user %d (seq %d, txid snapshot %s)",
+		snapshot.id, snapshot.tenantName, snapshot.table, authSession.UserID, snapshot.seq, snapshot.txSnapshot)
+	return snapshot, nil
+}
+
+// checkSyncTable validates the table, filter and page size of a sync request against the caller's grants
+func (e *RealtimeEngine) checkSyncTable(grants *UserGrants, table, filterText string, pageSize int) (*rowFilter, int, error) {
+	if !tableNamePattern.MatchString(table) || !isManagedTable(table) {
+		return nil, 0, newSyncError(http.StatusBadRequest, "invalid_table", "Table %q is not synchronized", table)
+	}
+	if grants == nil || !e.authorizer.CanReadTable(grants, table) {
+		return nil, 0, newSyncError(http.StatusForbidden, "forbidden", "Not allowed to read %s", table)
+	}
+
+	var filter *rowFilter
+	if filterText != "" {
+		parsed, err := parseRowFilter(filterText)
+		if err != nil {
+			return nil, 0, newSyncError(http.StatusBadRequest, "invalid_filter", "Invalid filter: %v", err)
+		}
+		filter = parsed
+	}
+
+	if pageSize <= 0 {
+		pageSize = getIntEnv(config.SnapshotPageSize, 500)
+	}
+	if pageSize > maxSnapshotPageSize {
+		pageSize = maxSnapshotPageSize
+	}
+	return filter, pageSize, nil
+}
+
+// syncTransaction is a read-only REPEATABLE READ transaction with its change-stream position
+type syncTransaction struct {
+	tx         *sql.Tx
+	seq        uint64
+	txSnapshot string
+	lsn        string
+}
+
+// cursor returns the snapshot cursor clients subscribe with to continue live from this transaction
+func (st *syncTransaction) cursor() string {
+	return formatSnapshotCursor(st.seq, st.txSnapshot)
+}
+
+// beginSyncTransaction starts a read transaction on a tenant database. The change-stream sequence is
+// read before the transaction snapshot is taken, so every change sequenced up to it is visible.
+func (e *RealtimeEngine) beginSyncTransaction(tenantName string) (*syncTransaction, error) {
+	e.mutex.RLock()
+	tenantDB, exists := e.tenantDBs[tenantName]
+	e.mutex.RUnlock()
+	if !exists {
+		return nil, newSyncError(http.StatusServiceUnavailable, "tenant_unavailable", "Tenant database %s is not connected", tenantName)
+	}
+
+	seq := e.historyFor(tenantName).lastSeq()
+
+	tx, err := tenantDB.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, newSyncError(http.StatusServiceUnavailable, "tenant_unavailable", "Failed to start snapshot: %v", err)
+	}
+
+	// The first statement of a REPEATABLE READ transaction takes its snapshot
+	syncTx := &syncTransaction{tx: tx, seq: seq}
+	if err := tx.QueryRow(`SELECT txid_current_snapshot()::text`).Scan(&syncTx.txSnapshot); err != nil {
+		tx.Rollback()
+		return nil, newSyncError(http.StatusServiceUnavailable, "tenant_unavailable", "Failed to start snapshot: %v", err)
+	}
+	if changeSourceForTenant(tenantName) == changeSourceReplication {
+		if err := tx.QueryRow(`SELECT pg_current_wal_lsn()::text`).Scan(&syncTx.lsn); err != nil {
+			log.Printf("⚠️  Failed to read WAL position for snapshot of tenant %s: %v", tenantName, err)
+		}
+	}
+	return syncTx, nil
+}
+
+// readSnapshotPage reads the next rows of an open snapshot in id order. The caller holds snapshot.mutex.
+func (e *RealtimeEngine) readSnapshotPage(snapshot *openSnapshot) (*SnapshotPage, error) {
+	query := fmt.Sprintf(`SELECT row_to_json(t)::text, t.id::text FROM %s t`, pq.QuoteIdentifier(snapshot.table))
+	args := []interface{}{snapshot.pageSize}
+	if snapshot.page > 0 {
+		query += ` WHERE t.id > $2`
+		args = append(args, snapshot.lastID)
+	}
+	query += ` ORDER BY t.id LIMIT $1`
+
+	rows, err := snapshot.tx.Query(query, args...)
+	if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code == "42P01" || pqErr.Code == "42703") {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_table", "Table %s does not exist or has no id column", snapshot.table)
+	} else if err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "snapshot_failed", "Failed to read snapshot: %v", err)
+	}
+	defer rows.Close()
+
+	redaction := e.redactionFor(snapshot.table)
+	page := &SnapshotPage{
+		SnapshotID: snapshot.id,
+		Table:      snapshot.table,
+		Seq:        snapshot.seq,
+		Cursor:     formatSnapshotCursor(snapshot.seq, snapshot.txSnapshot),
+		LSN:        snapshot.lsn,
+		Rows:       []json.RawMessage{},
+	}
+	read := 0
+	for rows.Next() {
+		var raw, id string
+		if err := rows.Scan(&raw, &id); err != nil {
+			return nil, newSyncError(http.StatusInternalServerError, "snapshot_failed", "Failed to read snapshot: %v", err)
+		}
+		read++
+		snapshot.lastID = id
+
+		if row, visible := e.syncRowForSession(snapshot.authSession, snapshot.grants, snapshot.table, redaction, snapshot.filter, json.RawMessage(raw)); visible {
+			page.Rows = append(page.Rows, row)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, newSyncError(http.StatusInternalServerError, "snapshot_failed", "Failed to read snapshot: %v", err)
+	}
+
+	snapshot.page++
+	page.Page = snapshot.page
+	page.HasMore = read == snapshot.pageSize
+	return page, nil
+}
+
+// syncRowForSession applies row authorization, column redaction and an optional filter to a row
+// read for a session, the same way a live change of that row would be handled
+func (e *RealtimeEngine) syncRowForSession(authSession *AuthenticatedSession, grants *UserGrants, table string, redaction *tableRedaction, filter *rowFilter, raw json.RawMessage) (json.RawMessage, bool) {
+	row := decodeRowImage(raw)
+	if row == nil || !e.authorizer.CanReadRow(grants, table, row) {
+		return nil, false
+	}
+
+	message := PublicationMessage{Table: table, NewData: raw}
+	if redaction != nil {
+		message.NewData = redactImage(raw, redaction.drop, redaction.mask)
+	}
+	variant := variantForSession(make(map[string]*messageVariant), message, redaction, authSession)
+	if filter != nil {
+		if newRow, _ := variant.images.rows(); newRow == nil || !filter.Matches(newRow) {
+			return nil, false
+		}
+	}
+	return variant.message.NewData, variant.message.NewData != nil
+}
+
+// closeSnapshot ends the snapshot transaction and forgets the snapshot. The caller holds snapshot.mutex.
+func (e *RealtimeEngine) closeSnapshot(snapshot *openSnapshot) {
+	if snapshot.tx != nil {
+		snapshot.tx.Rollback()
+		snapshot.tx = nil
+	}
+	e.snapshotMutex.Lock()
+	delete(e.snapshots, snapshot.id)
+	e.snapshotMutex.Unlock()
+}
+
+// expireSnapshots closes snapshots whose client stopped fetching pages
+func (e *RealtimeEngine) expireSnapshots() {
+	ttl := getDurationEnv(config.SnapshotTTL, time.Minute)
+
+	e.snapshotMutex.Lock()
+	snapshots := make([]*openSnapshot, 0, len(e.snapshots))
+	for _, snapshot := range e.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	e.snapshotMutex.Unlock()
+
+	for _, snapshot := range snapshots {
+		snapshot.mutex.Lock()
+		if time.Since(snapshot.lastUsedAt) > ttl {
+			log.Printf("🧹 Closing idle snapshot %s of %s.%s after page %d", snapshot.id, snapshot.tenantName, snapshot.table, snapshot.page)
+			e.closeSnapshot(snapshot)
+		}
+		snapshot.mutex.Unlock()
+	}
+}
+
+// authenticateSyncRequest authenticates a sync API call and loads the caller's grants
+func (e *RealtimeEngine) authenticateSyncRequest(authorization, token, domain string) (*AuthenticatedSession, *UserGrants, error) {
+	bearerToken := extractBearerToken(authorization, token)
+	if bearerToken == "" {
+		return nil, nil, newSyncError(http.StatusUnauthorized, "unauthorized", "Bearer token required")
+	}
+	if domain == "" {
+		return nil, nil, newSyncError(http.StatusBadRequest, "invalid_request", "Domain parameter required")
+	}
+
+	authSession, err := e.authenticateTokenForDomain(bearerToken, domain)
+	if err != nil {
+		log.Printf("❌ Sync authentication failed (domain: %s): %v", domain, err)
+		return nil, nil, newSyncError(http.StatusUnauthorized, "unauthorized", "Authentication failed for domain %s", domain)
+	}
+
+	// A sync answer built from empty grants would look complete, so the caller retries instead
+	grants, err := e.loadGrants(authSession)
+	if err != nil {
+		log.Printf("❌ Failed to load grants for user %d (tenant: %s): %v", authSession.UserID, authSession.TenantName, err)
+		return nil, nil, newSyncError(http.StatusServiceUnavailable, "grants_unavailable", "Permissions could not be loaded, retry later")
+	}
+	return authSession, grants, nil
+}
+
+// SyncSnapshot serves one page of a table snapshot over HTTP (implements SyncEngineInterface)
+func (e *RealtimeEngine) SyncSnapshot(authorization, token, domain string, body []byte) (interface{}, error) {
+	var request SnapshotRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, newSyncError(http.StatusBadRequest, "invalid_request", "Invalid JSON request body")
+	}
+
+	authSession, grants, err := e.authenticateSyncRequest(authorization, token, domain)
+	if err != nil {
+		return nil, err
+	}
+	return e.snapshotPage(authSession, grants, request)
+}
+
+// handleSnapshot serves one page of a table snapshot over the WebSocket
+func (e *RealtimeEngine) handleSnapshot(wsSession *WebSocketSession, message ClientMessage) {
+	e.mutex.RLock()
+	authSession, exists := e.authenticatedSessions[wsSession.ID]
+	e.mutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	page, err := e.snapshotPage(authSession, wsSession.sessionGrants(), SnapshotRequest{
+		RequestID:  message.RequestID,
+		Table:      message.Table,
+		Filter:     message.Filter,
+		PageSize:   message.PageSize,
+		SnapshotID: message.SnapshotID,
+	})
+	if err != nil {
+		code := "snapshot_failed"
+		if syncErr, ok := err.(*syncError); ok {
+			code = syncErr.code
+		}
+		e.sendClientError(wsSession, message.RequestID, code, err.Error())
+		return
+	}
+
+	e.sendMessage(wsSession, SystemMessage{
+		Type:      "system",
+		Operation: "snapshot",
+		Message:   fmt.Sprintf("Snapshot page %d of %s (%d rows)", page.Page, page.Table, len(page.Rows)),
+		Data:      page,
+		Timestamp: time.Now().Format(time.RFC3339),
+		SessionId: wsSession.ID,
+	})
+}
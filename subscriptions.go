@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxSubscriptionsPerSession caps the number of active subscriptions of a single session
+	maxSubscriptionsPerSession = 100
+
+	// subscribeAllTables subscribes to every table of the tenant
+	subscribeAllTables = "*"
+)
+
+var tableNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// Subscription is a client's interest in changes of a set of tables, optionally narrowed by a row filter
+type Subscription struct {
+	ID         string
+	Tables     map[string]bool
+	Excluded   map[string]bool // tables unsubscribed from a "*" subscription
+	Filter     *rowFilter
+	FilterText string
+	CreatedAt  time.Time
+	snapshot   *txSnapshot // changes already contained in the snapshot the client loaded are skipped
+}
+
+// matchesTable reports whether the subscription covers a table
+func (sub *Subscription) matchesTable(table string) bool {
+	return sub.Tables[table] || (sub.Tables[subscribeAllTables] && !sub.Excluded[table])
+}
+
+// removeTable drops a table from the subscription. A "*" subscription records it as excluded,
+// and unsubscribing "*" itself ends every exclusion.
+func (sub *Subscription) removeTable(table string) {
+	delete(sub.Tables, table)
+	switch {
+	case table == subscribeAllTables:
+		sub.Excluded = nil
+	case sub.Tables[subscribeAllTables]:
+		if sub.Excluded == nil {
+			sub.Excluded = make(map[string]bool)
+		}
+		sub.Excluded[table] = true
+	}
+}
+
+// tableList returns the subscribed tables in a stable order
+func (sub *Subscription) tableList() []string {
+	tables := make([]string, 0, len(sub.Tables))
+	for table := range sub.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// handleClientMessage dispatches a message received from a WebSocket client
+func (e *RealtimeEngine) handleClientMessage(wsSession *WebSocketSession, raw []byte) {
+	var message ClientMessage
+	if err := json.Unmarshal(raw, &message); err != nil {
+		e.sendClientError(wsSession, "", "invalid_message", "Message must be a JSON object with a type")
+		return
+	}
+
+	switch message.Type {
+	case "subscribe":
+		e.handleSubscribe(wsSession, message)
+	case "unsubscribe":
+		e.handleUnsubscribe(wsSession, message)
+	case "snapshot":
+		e.handleSnapshot(wsSession, message)
+	case "delta":
+		e.handleDelta(wsSession, message)
+	case "ack":
+		e.handleAck(wsSession, message)
+	case "ping":
+		e.sendMessage(wsSession, SystemMessage{
+			Type:      "system",
+			Operation: "pong",
+			Message:   "pong",
+			Data:      map[string]interface{}{"request_id": message.RequestID},
+			Timestamp: time.Now().Format(time.RFC3339),
+			SessionId: wsSession.ID,
+		})
+	default:
+		e.sendClientError(wsSession, message.RequestID, "unknown_type", fmt.Sprintf("Unknown message type %q", message.Type))
+	}
+}
+
+// handleSubscribe registers a new subscription and acknowledges it with its id
+func (e *RealtimeEngine) handleSubscribe(wsSession *WebSocketSession, message ClientMessage) {
+	if len(message.Tables) == 0 {
+		e.sendClientError(wsSession, message.RequestID, "invalid_subscription", "At least one table is required")
+		return
+	}
+
+	tables := make(map[string]bool, len(message.Tables))
+	for _, table := range message.Tables {
+		if table != subscribeAllTables && !tableNamePattern.MatchString(table) {
+			e.sendClientError(wsSession, message.RequestID, "invalid_subscription", fmt.Sprintf("Invalid table name %q", table))
+			return
+		}
+		tables[table] = true
+	}
+
+	var filter *rowFilter
+	if message.Filter != "" {
+		parsed, err := parseRowFilter(message.Filter)
+		if err != nil {
+			e.sendClientError(wsSession, message.RequestID, "invalid_filter", fmt.Sprintf("Invalid filter: %v", err))
+			return
+		}
+		filter = parsed
+	}
+
+	subscription := &Subscription{
+		ID:         uuid.New().String(),
+		Tables:     tables,
+		Filter:     filter,
+		FilterText: message.Filter,
+		CreatedAt:  time.Now(),
+	}
+
+	var snapshotSeq uint64
+	if message.SnapshotCursor != "" {
+		seq, snapshot, err := parseSnapshotCursor(message.SnapshotCursor)
+		if err != nil {
+			e.sendClientError(wsSession, message.RequestID, "invalid_snapshot_cursor", err.Error())
+			return
+		}
+		snapshotSeq, subscription.snapshot = seq, snapshot
+	}
+
+	// A resuming subscription is registered and replayed while live changes are held back,
+	// so nothing is missed or delivered out of order
+	wsSession.mutex.Lock()
+	resumeFrom, resuming := wsSession.resumeFrom, wsSession.resuming
+	wsSession.mutex.Unlock()
+	if message.ResumeFrom != nil {
+		resumeFrom, resuming = *message.ResumeFrom, true
+	}
+	if subscription.snapshot != nil {
+		resumeFrom, resuming = snapshotSeq, true
+	}
+	var history *tenantHistory
+	if resuming {
+		history = e.historyFor(wsSession.Tenant)
+		history.publish.Lock()
+		defer history.publish.Unlock()
+	}
+
+	wsSession.mutex.Lock()
+	if len(wsSession.subscriptions) >= maxSubscriptionsPerSession {
+		wsSession.mutex.Unlock()
+		e.sendClientError(wsSession, message.RequestID, "too_many_subscriptions",
+			fmt.Sprintf("A session can hold at most %d subscriptions", maxSubscriptionsPerSession))
+		return
+	}
+	wsSession.subscriptions[subscription.ID] = subscription
+	wsSession.mutex.Unlock()
+
+	if filter != nil {
+		log.Printf("📝 Session %s subscribed to %v where %s (subscription: %s)",
+			wsSession.ID, subscription.tableList(), subscription.FilterText, subscription.ID)
+	} else {
+		log.Printf("📝 Session %s subscribed to %v (subscription: %s)", wsSession.ID, subscription.tableList(), subscription.ID)
+	}
+
+	e.sendMessage(wsSession, SystemMessage{
+		Type:      "system",
+		Operation: "subscribed",
+		Message:   fmt.Sprintf("Subscribed to %d table(s)", len(tables)),
+		Data: map[string]interface{}{
+			"request_id":      message.RequestID,
+			"subscription_id": subscription.ID,
+			"tables":          subscription.tableList(),
+			"filter":          subscription.FilterText,
+		},
+		Timestamp: time.Now().Format(time.RFC3339),
+		SessionId: wsSession.ID,
+	})
+
+	if !resuming {
+		return
+	}
+	replayed, ok := e.replayHistory(history, wsSession, subscription, resumeFrom)
+	if !ok {
+		e.sendResyncRequired(wsSession, "history_gap")
+		return
+	}
+	log.Printf("⏪ Replayed %d change(s) after seq %d to session %s (subscription: %s)",
+		replayed, resumeFrom, wsSession.ID, subscription.ID)
+	e.sendMessage(wsSession, SystemMessage{
+		Type:      "system",
+		Operation: "replayed",
+		Message:   fmt.Sprintf("Replayed %d missed change(s)", replayed),
+		Data: map[string]interface{}{
+			"request_id":      message.RequestID,
+			"subscription_id": subscription.ID,
+			"from_seq":        resumeFrom,
+			"to_seq":          history.lastSeq(),
+			"count":           replayed,
+		},
+		Timestamp: time.Now().Format(time.RFC3339),
+		SessionId: wsSession.ID,
+	})
+}
+
+// handleUnsubscribe removes a subscription by id, or the listed tables from every subscription
+func (e *RealtimeEngine) handleUnsubscribe(wsSession *WebSocketSession, message ClientMessage) {
+	var removed []string
+
+	wsSession.mutex.Lock()
+	switch {
+	case message.SubscriptionID != "":
+		if _, exists := wsSession.subscriptions[message.SubscriptionID]; exists {
+			delete(wsSession.subscriptions, message.SubscriptionID)
+			removed = append(removed, message.SubscriptionID)
+		}
+	case len(message.Tables) > 0:
+		for id, subscription := range wsSession.subscriptions {
+			for _, table := range message.Tables {
+				subscription.removeTable(table)
+			}
+			if len(subscription.Tables) == 0 {
+				delete(wsSession.subscriptions, id)
+				removed = append(removed, id)
+			}
+		}
+	}
+	wsSession.mutex.Unlock()
+
+	if message.SubscriptionID != "" && len(removed) == 0 {
+		e.sendClientError(wsSession, message.RequestID, "unknown_subscription",
+			fmt.Sprintf("Subscription %s not found", message.SubscriptionID))
+		return
+	}
+
+	e.sendMessage(wsSession, SystemMessage{
+		Type:      "system",
+		Operation: "unsubscribed",
+		Message:   fmt.Sprintf("Removed %d subscription(s)", len(removed)),
+		Data: map[string]interface{}{
+			"request_id":       message.RequestID,
+			"subscription_ids": removed,
+			"tables":           message.Tables,
+		},
+		Timestamp: time.Now().Format(time.RFC3339),
+		SessionId: wsSession.ID,
+	})
+}
+
+// sendClientError reports a protocol error to a client
+func (e *RealtimeEngine) sendClientError(wsSession *WebSocketSession, requestID, code, detail string) {
+	e.sendMessage(wsSession, SystemMessage{
+		Type:      "system",
+		Operation: "error",
+		Message:   detail,
+		Data: map[string]interface{}{
+			"request_id": requestID,
+			"code":       code,
+		},
+		Timestamp: time.Now().Format(time.RFC3339),
+		SessionId: wsSession.ID,
+	})
+}
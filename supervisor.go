@@ -0,0 +1,250 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// listenerMinBackoff is the delay before the first restart of a failed tenant listener
+	listenerMinBackoff = time.Second
+
+	// listenerMaxBackoff caps the delay between restarts of a failing tenant listener
+	listenerMaxBackoff = time.Minute
+
+	// listenerHealthyRun resets the backoff when a listener stayed up at least this long
+	listenerHealthyRun = 2 * time.Minute
+)
+
+// Listener states reported through /api/health
+const (
+	listenerStateStarting   = "starting"
+	listenerStateRunning    = "running"
+	listenerStateRestarting = "restarting"
+)
+
+// tenantListener is the supervised change source of a single tenant
+type tenantListener struct {
+	stop        chan struct{}
+	tenantName  string
+	dbName      string
+	source      string
+	state       string
+	restarts    int
+	lastError   string
+	startedAt   time.Time
+	lastEventAt time.Time
+	position    string
+	channels    []string
+}
+
+// listenToTenantPublications starts a supervised change source for a tenant (no-op when already running)
+func (e *RealtimeEngine) listenToTenantPublications(tenantName, dbName string) {
+	e.listenerMutex.Lock()
+	if _, running := e.listeners[tenantName]; running {
+		e.listenerMutex.Unlock()
+		log.Printf("🔗 Publication listener for tenant %s already running", tenantName)
+		return
+	}
+	listener := &tenantListener{
+		stop:       make(chan struct{}),
+		tenantName: tenantName,
+		dbName:     dbName,
+		source:     changeSourceForTenant(tenantName),
+		state:      listenerStateStarting,
+	}
+	e.listeners[tenantName] = listener
+	e.listenerMutex.Unlock()
+
+	go e.superviseTenantListener(listener)
+}
+
+// stopTenantListener stops the supervised change source of a tenant (e.g. when the tenant is deleted)
+func (e *RealtimeEngine) stopTenantListener(tenantName string) {
+	e.listenerMutex.Lock()
+	listener, exists := e.listeners[tenantName]
+	if exists {
+		delete(e.listeners, tenantName)
+		close(listener.stop)
+	}
+	e.listenerMutex.Unlock()
+
+	if exists {
+		log.Printf("🛑 Stopped publication listener for tenant: %s", tenantName)
+	}
+}
+
+// superviseTenantListener runs a tenant change source and restarts it with exponential backoff when it dies
+func (e *RealtimeEngine) superviseTenantListener(listener *tenantListener) {
+	backoff := listenerMinBackoff
+
+	for {
+		source, err := e.newChangeSource(listener.tenantName, listener.dbName)
+		if err != nil {
+			log.Printf("❌ %v", err)
+			e.updateListenerState(listener, listenerStateRestarting, err)
+		} else {
+			log.Printf("🎧 Starting %s change source for tenant: %s (database: %s)",
+				source.Name(), listener.tenantName, listener.dbName)
+
+			startedAt := time.Now()
+			e.markListenerRunning(listener, source.Name(), startedAt)
+
+			err = source.Run(listener.stop)
+
+			select {
+			case <-listener.stop:
+				return
+			default:
+			}
+
+			if err != nil {
+				log.Printf("❌ %s change source died for tenant %s: %v", source.Name(), listener.tenantName, err)
+			} else {
+				log.Printf("⚠️  %s change source exited for tenant %s", source.Name(), listener.tenantName)
+			}
+			e.updateListenerState(listener, listenerStateRestarting, err)
+
+			// Sources without replay lose everything emitted while they were down
+			if !source.Resumable() {
+				e.requestTenantResync(listener.tenantName, "change_source_restarted")
+			}
+
+			if time.Since(startedAt) >= listenerHealthyRun {
+				backoff = listenerMinBackoff
+			}
+		}
+
+		log.Printf("⏱️  Restarting change source for tenant %s in %v", listener.tenantName, backoff)
+		select {
+		case <-listener.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > listenerMaxBackoff {
+			backoff = listenerMaxBackoff
+		}
+	}
+}
+
+// markListenerRunning records that a listener (re)started its change source
+func (e *RealtimeEngine) markListenerRunning(listener *tenantListener, source string, startedAt time.Time) {
+	e.listenerMutex.Lock()
+	defer e.listenerMutex.Unlock()
+
+	if listener.state == listenerStateRestarting {
+		listener.restarts++
+	}
+	listener.source = source
+	listener.state = listenerStateRunning
+	listener.startedAt = startedAt
+}
+
+// updateListenerState records a listener state transition and the error that caused it
+func (e *RealtimeEngine) updateListenerState(listener *tenantListener, state string, err error) {
+	e.listenerMutex.Lock()
+	defer e.listenerMutex.Unlock()
+
+	listener.state = state
+	if err != nil {
+		listener.lastError = err.Error()
+	}
+}
+
+// recordListenerEvent records the time of the last change delivered for a tenant
+func (e *RealtimeEngine) recordListenerEvent(tenantName string) {
+	e.listenerMutex.Lock()
+	defer e.listenerMutex.Unlock()
+
+	if listener, exists := e.listeners[tenantName]; exists {
+		listener.lastEventAt = time.Now()
+	}
+}
+
+// recordListenerPosition records the last checkpointed position for a tenant
+func (e *RealtimeEngine) recordListenerPosition(tenantName, position string) {
+	e.listenerMutex.Lock()
+	defer e.listenerMutex.Unlock()
+
+	if listener, exists := e.listeners[tenantName]; exists {
+		listener.position = position
+	}
+}
+
+// recordListenerChannels records the channels a tenant listener is currently subscribed to
+func (e *RealtimeEngine) recordListenerChannels(tenantName string, channels []string) {
+	e.listenerMutex.Lock()
+	defer e.listenerMutex.Unlock()
+
+	if listener, exists := e.listeners[tenantName]; exists {
+		listener.channels = channels
+	}
+}
+
+// GetTenantChannels returns the channel set of every tenant listener (implements RealtimeEngineInterface)
+func (e *RealtimeEngine) GetTenantChannels() map[string][]string {
+	e.listenerMutex.Lock()
+	defer e.listenerMutex.Unlock()
+
+	channels := make(map[string][]string, len(e.listeners))
+	for tenantName, listener := range e.listeners {
+		channels[tenantName] = append([]string{}, listener.channels...)
+	}
+	return channels
+}
+
+// requestTenantResync tells every session of a tenant that events may have been lost
+func (e *RealtimeEngine) requestTenantResync(tenantName, reason string) {
+	log.Printf("🔁 Requesting resync for tenant %s sessions (reason: %s)", tenantName, reason)
+
+	// Reconnecting clients must not resume across the gap either
+	e.historyFor(tenantName).breakContinuity()
+
+	e.BroadcastTenantSystemMessage(tenantName, SystemMessage{
+		Type:      "system",
+		Operation: "resync_required",
+		Message:   "Some changes may have been missed - reload data from the server",
+		Data: map[string]interface{}{
+			"tenant_name": tenantName,
+			"reason":      reason,
+		},
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// GetListenerStatuses returns the state of every supervised tenant listener (implements HealthEngineInterface)
+func (e *RealtimeEngine) GetListenerStatuses() []map[string]interface{} {
+	e.listenerMutex.Lock()
+	defer e.listenerMutex.Unlock()
+
+	statuses := make([]map[string]interface{}, 0, len(e.listeners))
+	for _, listener := range e.listeners {
+		status := map[string]interface{}{
+			"tenant":   listener.tenantName,
+			"database": listener.dbName,
+			"source":   listener.source,
+			"state":    listener.state,
+			"restarts": listener.restarts,
+			"position": listener.position,
+			"channels": len(listener.channels),
+		}
+		if listener.lastError != "" {
+			status["last_error"] = listener.lastError
+		}
+		if !listener.startedAt.IsZero() {
+			status["started_at"] = listener.startedAt.Format(time.RFC3339)
+		}
+		if !listener.lastEventAt.IsZero() {
+			status["last_event_at"] = listener.lastEventAt.Format(time.RFC3339)
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i]["tenant"].(string) < statuses[j]["tenant"].(string)
+	})
+	return statuses
+}
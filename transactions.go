@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// bufferedChange is a change held back until the rest of its transaction has arrived
+type bufferedChange struct {
+	message    PublicationMessage
+	unredacted PublicationMessage
+}
+
+// TransactionMessage carries the changes of one database transaction a session may see, in commit order
+type TransactionMessage struct {
+	Type       string               `json:"type"` // always "transaction"
+	TenantName string               `json:"tenant_name"`
+	TxID       uint64               `json:"txid"`
+	FirstSeq   uint64               `json:"first_seq"`
+	LastSeq    uint64               `json:"last_seq"`
+	Changes    []PublicationMessage `json:"changes"`
+	ClientTime string               `json:"client_timestamp"`
+}
+
+// flushTransaction delivers the transaction collected for a tenant. Change sources call it once a
+// transaction is complete, so it never waits for the next one: replication and outbox after each batch,
+// notify when the listener goes idle.
+func (e *RealtimeEngine) flushTransaction(tenantName string) {
+	history := e.historyFor(tenantName)
+	history.publish.Lock()
+	defer history.publish.Unlock()
+	e.flushTransactionLocked(history)
+}
+
+// flushTransactionLocked sequences the collected changes and broadcasts them together.
+// The caller holds history.publish.
+func (e *RealtimeEngine) flushTransactionLocked(history *tenantHistory) {
+	changes := history.transaction
+	history.transaction = nil
+	if len(changes) == 0 {
+		return
+	}
+
+	deliveries := make([]*changeDelivery, len(changes))
+	for i := range changes {
+		changes[i].message.Seq = history.append(changes[i].message, &changes[i].unredacted)
+		changes[i].unredacted.Seq = changes[i].message.Seq
+		deliveries[i] = e.newChangeDelivery(changes[i].message, &changeImages{message: &changes[i].unredacted})
+	}
+	if len(deliveries) == 1 {
+		e.broadcastChange(changes[0].message, deliveries[0].authImages)
+		return
+	}
+
+	receivers := e.broadcastGroup(deliveries, transactionEnvelope)
+	log.Printf("📦 Broadcasted transaction %d (%d changes) of tenant %s to %d sessions",
+		changes[0].message.TxID, len(changes), history.tenantName, receivers)
+}
+
+// transactionEnvelope wraps the changes of one transaction a session may see
+func transactionEnvelope(messages []PublicationMessage) interface{} {
+	return TransactionMessage{
+		Type:       "transaction",
+		TenantName: messages[0].TenantName,
+		TxID:       messages[0].TxID,
+		FirstSeq:   messages[0].Seq,
+		LastSeq:    messages[len(messages)-1].Seq,
+		Changes:    messages,
+		ClientTime: time.Now().Format(time.RFC3339),
+	}
+}
+
+// broadcastGroup delivers a group of sequenced changes to every session, wrapping the changes each
+// session may see with envelope. It returns the number of sessions that received any of them.
+func (e *RealtimeEngine) broadcastGroup(deliveries []*changeDelivery, envelope func([]PublicationMessage) interface{}) int {
+	e.mutex.RLock()
+	sessions := make(map[string]*WebSocketSession)
+	authSessions := make(map[string]*AuthenticatedSession)
+	for id, session := range e.sessions {
+		sessions[id] = session
+	}
+	for id, authSession := range e.authenticatedSessions {
+		authSessions[id] = authSession
+	}
+	e.mutex.RUnlock()
+
+	// Sessions seeing the same changes in the same format share the encoded envelope
+	envelopes := make(map[string]*sharedFrame)
+
+	receivers := 0
+	for sessionID, wsSession := range sessions {
+		authSession, isAuthenticated := authSessions[sessionID]
+		if !isAuthenticated {
+			continue
+		}
+
+		delivered, err := e.deliverGroup(deliveries, wsSession, authSession, nil, envelope, envelopes)
+		if err != nil {
+			log.Printf("❌ Failed to queue grouped changes for session %s: %v", sessionID, err)
+			continue
+		}
+		if delivered > 0 {
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// deliverGroup delivers the changes of a group a session may see, as one envelope unless the session
+// opted out of grouped messages. Encoded envelopes are shared through envelopes when it is not nil.
+// It returns the number of changes delivered.
+func (e *RealtimeEngine) deliverGroup(deliveries []*changeDelivery, wsSession *WebSocketSession, authSession *AuthenticatedSession, only *Subscription, envelope func([]PublicationMessage) interface{}, envelopes map[string]*sharedFrame) (int, error) {
+	var frames []*sessionFrame
+	var owners []int // index of each frame's change in deliveries
+	for i, delivery := range deliveries {
+		frame, err := e.sessionChange(delivery, wsSession, authSession, only)
+		if err != nil {
+			return len(frames), err
+		}
+		if frame != nil {
+			frames = append(frames, frame)
+			owners = append(owners, i)
+		}
+	}
+
+	// A single visible change needs no envelope
+	if len(frames) <= 1 || !wsSession.transactionEnvelopes {
+		for i, frame := range frames {
+			if err := e.queueChange(wsSession, deliveries[owners[i]], frame); err != nil {
+				return i, err
+			}
+		}
+		return len(frames), nil
+	}
+
+	// The envelope is identified by which frame of which change it holds
+	var key strings.Builder
+	if envelopes != nil {
+		key.WriteString(wsSession.format.protocol)
+		for i, frame := range frames {
+			fmt.Fprintf(&key, ";%d:%d", owners[i], deliveries[owners[i]].shape(frame.key))
+		}
+		if shared, exists := envelopes[key.String()]; exists {
+			return len(frames), e.queueShared(wsSession, shared, "")
+		}
+	}
+
+	messages := make([]PublicationMessage, len(frames))
+	for i, frame := range frames {
+		messages[i] = frame.message
+	}
+	data, err := wsSession.format.encode(envelope(messages))
+	if err != nil {
+		return 0, err
+	}
+	// The envelope covers several rows, so it is never coalesced with a single-row frame
+	if envelopes == nil {
+		return len(frames), e.queueFrame(wsSession, data, "")
+	}
+	shared := newSharedFrame(wsSession.format.messageType, data)
+	envelopes[key.String()] = shared
+	return len(frames), e.queueShared(wsSession, shared, "")
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// changeTriggerVersion is bumped whenever one of the engine-owned trigger functions changes.
+// Functions whose COMMENT does not carry the current version are replaced at the next sync.
+const changeTriggerVersion = 2
+
+// Engine-owned trigger functions installed in every tenant database
+const (
+	triggerFunctionFull      = "whagons_rte_notify_changes"
+	triggerFunctionReference = "notify_whagons_row_reference"
+	triggerFunctionOutbox    = "whagons_rte_outbox_capture"
+)
+
+// ddlChannel receives a notification whenever tables or triggers are created, altered or dropped
+const ddlChannel = "whagons_rte_ddl"
+
+// expectedTriggerType is pg_trigger.tgtype for FOR EACH ROW AFTER INSERT OR DELETE OR UPDATE
+const expectedTriggerType = 1 | 4 | 8 | 16
+
+// Trigger states reported by syncTenantTriggers
+const (
+	triggerStatusOK      = "ok"
+	triggerStatusMissing = "missing"
+	triggerStatusDrift   = "drift"
+)
+
+// triggerFunctionSQL holds the CREATE OR REPLACE statement of each engine-owned trigger function
+var triggerFunctionSQL = map[string]string{
+	triggerFunctionFull: `
+		CREATE OR REPLACE FUNCTION whagons_rte_notify_changes()
+		RETURNS TRIGGER AS $$
+		DECLARE
+			payload JSON;
+		BEGIN
+			-- Build notification payload
+			IF TG_OP = 'DELETE' THEN
+				payload = json_build_object(
+					'table', TG_TABLE_NAME,
+					'operation', TG_OP,
+					'old_data', row_to_json(OLD),
+					'timestamp', extract(epoch from now()),
+					'txid', txid_current()
+				);
+			ELSE
+				payload = json_build_object(
+					'table', TG_TABLE_NAME,
+					'operation', TG_OP,
+					'new_data', row_to_json(NEW),
+					'old_data', CASE WHEN TG_OP = 'UPDATE' THEN row_to_json(OLD) ELSE NULL END,
+					'timestamp', extract(epoch from now()),
+					'txid', txid_current()
+				);
+			END IF;
+
+			PERFORM pg_notify('whagons_' || TG_TABLE_NAME || '_changes', payload::text);
+
+			RETURN COALESCE(NEW, OLD);
+		END;
+		$$ LANGUAGE plpgsql;`,
+
+	triggerFunctionReference: `
+		CREATE OR REPLACE FUNCTION notify_whagons_row_reference()
+		RETURNS TRIGGER AS $$
+		DECLARE
+			payload JSON;
+		BEGIN
+			-- Only send the primary key, the engine fetches the row
+			payload = json_build_object(
+				'table', TG_TABLE_NAME,
+				'operation', TG_OP,
+				'id', CASE WHEN TG_OP = 'DELETE' THEN OLD.id ELSE NEW.id END,
+				'payload', 'reference',
+				'timestamp', extract(epoch from now()),
+				'txid', txid_current()
+			);
+
+			PERFORM pg_notify('whagons_' || TG_TABLE_NAME || '_changes', payload::text);
+
+			RETURN COALESCE(NEW, OLD);
+		END;
+		$$ LANGUAGE plpgsql;`,
+
+	triggerFunctionOutbox: `
+		CREATE OR REPLACE FUNCTION whagons_rte_outbox_capture()
+		RETURNS TRIGGER AS $$
+		BEGIN
+			INSERT INTO whagons_rte_outbox (table_name, op, pk, new_data, old_data)
+			VALUES (
+				TG_TABLE_NAME,
+				TG_OP,
+				to_jsonb(COALESCE(NEW, OLD))->>'id',
+				CASE WHEN TG_OP = 'DELETE' THEN NULL ELSE to_jsonb(NEW) END,
+				CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE to_jsonb(OLD) END
+			);
+
+			-- Wake-up signal only, delivered on commit and collapsed per transaction
+			PERFORM pg_notify('whagons_rte_outbox', '');
+
+			RETURN COALESCE(NEW, OLD);
+		END;
+		$$ LANGUAGE plpgsql;`,
+}
+
+// TableTriggerStatus describes the change trigger state of a single tenant table
+type TableTriggerStatus struct {
+	Table    string   `json:"table"`
+	Function string   `json:"function"`
+	Status   string   `json:"status"`
+	Problems []string `json:"problems,omitempty"`
+	Upgraded bool     `json:"upgraded,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// TenantTriggerReport is the result of inspecting (and optionally upgrading) a tenant's triggers
+type TenantTriggerReport struct {
+	Tenant    string               `json:"tenant"`
+	Source    string               `json:"source"`
+	Version   int                  `json:"version"`
+	Functions map[string]string    `json:"functions"`
+	Tables    []TableTriggerStatus `json:"tables"`
+}
+
+// setupTenantTriggers upgrades the engine-owned trigger functions and, when TRIGGER_AUTO_INSTALL
+// is enabled, installs the change trigger on every table matching TRIGGER_INCLUDE/TRIGGER_EXCLUDE
+func (e *RealtimeEngine) setupTenantTriggers(tenantName string, db *sql.DB) error {
+	if changeSourceForTenant(tenantName) == changeSourceNotify {
+		if err := setupDDLEventTrigger(db); err != nil {
+			// Event triggers require superuser - the listener falls back to periodic catalog diffs
+			log.Printf("⚠️  DDL event trigger unavailable for tenant %s (using periodic channel refresh): %v", tenantName, err)
+		}
+	}
+
+	if !getBoolEnv(config.TriggerAutoInstall, true) {
+		// Triggers are managed elsewhere, but keep the functions they may call up to date
+		if changeSourceForTenant(tenantName) == changeSourceReplication {
+			return nil
+		}
+		return syncTriggerFunctions(db, true, make(map[string]string))
+	}
+
+	report, err := e.syncTenantTriggers(tenantName, db, true)
+	if err != nil {
+		return err
+	}
+
+	upgraded := 0
+	for _, table := range report.Tables {
+		if table.Upgraded {
+			upgraded++
+		}
+	}
+	log.Printf("✅ Change triggers in sync for tenant %s (%d tables, %d upgraded)", tenantName, len(report.Tables), upgraded)
+	return nil
+}
+
+// syncTenantTriggers inspects the change triggers of every managed table of a tenant and reports
+// missing or drifted definitions. With apply set, functions and triggers are upgraded in place.
+func (e *RealtimeEngine) syncTenantTriggers(tenantName string, db *sql.DB, apply bool) (*TenantTriggerReport, error) {
+	source := changeSourceForTenant(tenantName)
+	report := &TenantTriggerReport{
+		Tenant:    tenantName,
+		Source:    source,
+		Version:   changeTriggerVersion,
+		Functions: make(map[string]string),
+		Tables:    []TableTriggerStatus{},
+	}
+
+	// Logical replication reads publications, triggers are not involved
+	if source == changeSourceReplication {
+		return report, nil
+	}
+
+	if source == changeSourceOutbox && apply {
+		// The capture function writes to the outbox, so it must exist before any trigger uses it
+		if err := e.setupTenantOutbox(tenantName, db); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := syncTriggerFunctions(db, apply, report.Functions); err != nil {
+		return nil, fmt.Errorf("failed to sync trigger functions for tenant %s: %w", tenantName, err)
+	}
+
+	tables, err := listTables(db, needsChangeTrigger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables for tenant %s: %w", tenantName, err)
+	}
+
+	for _, table := range tables {
+		status, err := inspectChangeTrigger(db, table, triggerFunctionForTable(source, table))
+		if err != nil {
+			report.Tables = append(report.Tables, TableTriggerStatus{Table: table, Status: triggerStatusDrift, Error: err.Error()})
+			continue
+		}
+
+		if apply && status.Status != triggerStatusOK {
+			if err := replaceChangeTrigger(db, table, status.Function); err != nil {
+				status.Error = err.Error()
+				log.Printf("⚠️  Failed to upgrade change trigger on %s for tenant %s: %v", table, tenantName, err)
+			} else {
+				status.Upgraded = true
+				status.Status = triggerStatusOK
+				log.Printf("🔧 Upgraded change trigger on %s for tenant %s (%s)", table, tenantName, strings.Join(status.Problems, ", "))
+			}
+		}
+
+		report.Tables = append(report.Tables, status)
+	}
+
+	return report, nil
+}
+
+// setupDDLEventTrigger installs an event trigger notifying ddlChannel after table and trigger DDL,
+// so listeners pick up new wh_* tables without a restart
+func setupDDLEventTrigger(db *sql.DB) error {
+	createFunctionSQL := `
+		CREATE OR REPLACE FUNCTION whagons_rte_notify_ddl()
+		RETURNS EVENT_TRIGGER AS $$
+		BEGIN
+			PERFORM pg_notify('whagons_rte_ddl', tg_tag);
+		END;
+		$$ LANGUAGE plpgsql;`
+
+	if _, err := db.Exec(createFunctionSQL); err != nil {
+		return fmt.Errorf("failed to create DDL notification function: %w", err)
+	}
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_event_trigger WHERE evtname = 'whagons_rte_ddl_trigger')`).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check DDL event trigger: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	createTriggerSQL := `
+		CREATE EVENT TRIGGER whagons_rte_ddl_trigger
+			ON ddl_command_end
+			WHEN TAG IN ('CREATE TABLE', 'CREATE TABLE AS', 'ALTER TABLE', 'DROP TABLE',
+				'CREATE TRIGGER', 'ALTER TRIGGER', 'DROP TRIGGER')
+			EXECUTE FUNCTION whagons_rte_notify_ddl();`
+
+	if _, err := db.Exec(createTriggerSQL); err != nil {
+		return fmt.Errorf("failed to create DDL event trigger: %w", err)
+	}
+
+	log.Println("✅ DDL event trigger created")
+	return nil
+}
+
+// triggerFunctionForTable returns the trigger function a table should use under a change source
+func triggerFunctionForTable(source, table string) string {
+	if source == changeSourceOutbox {
+		return triggerFunctionOutbox
+	}
+	for _, referenceTable := range referencePayloadTables() {
+		if referenceTable == table {
+			return triggerFunctionReference
+		}
+	}
+	return triggerFunctionFull
+}
+
+// triggerFunctionComment is the version marker stored on engine-owned functions
+func triggerFunctionComment() string {
+	return fmt.Sprintf("whagonsRTE change trigger v%d", changeTriggerVersion)
+}
+
+// syncTriggerFunctions checks the version marker and body of each engine-owned function and replaces
+// outdated or edited ones
+func syncTriggerFunctions(db *sql.DB, apply bool, statuses map[string]string) error {
+	names := make([]string, 0, len(triggerFunctionSQL))
+	for name := range triggerFunctionSQL {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		status, err := inspectFunction(db, name, triggerFunctionSQL[name], triggerFunctionComment())
+		if err != nil {
+			return err
+		}
+
+		if apply && status != triggerStatusOK {
+			if _, err := db.Exec(triggerFunctionSQL[name]); err != nil {
+				return fmt.Errorf("failed to create %s: %w", name, err)
+			}
+			if _, err := db.Exec(fmt.Sprintf("COMMENT ON FUNCTION %s() IS %s", pq.QuoteIdentifier(name), pq.QuoteLiteral(triggerFunctionComment()))); err != nil {
+				return fmt.Errorf("failed to version %s: %w", name, err)
+			}
+			log.Printf("🔧 Installed trigger function %s (v%d)", name, changeTriggerVersion)
+			status = triggerStatusOK
+		}
+		statuses[name] = status
+	}
+	return nil
+}
+
+// inspectFunction compares an engine-owned function with its CREATE statement and version marker. The
+// body is compared too, since hand edits and CREATE OR REPLACE keep the comment.
+func inspectFunction(db *sql.DB, name, createSQL, comment string) (string, error) {
+	var installedComment sql.NullString
+	var source string
+	err := db.QueryRow(`
+		SELECT obj_description(p.oid, 'pg_proc'), p.prosrc
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE p.proname = $1 AND n.nspname = current_schema()`, name).Scan(&installedComment, &source)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return triggerStatusMissing, nil
+	case err != nil:
+		return "", fmt.Errorf("failed to inspect %s: %w", name, err)
+	case installedComment.String != comment || source != functionBody(createSQL):
+		return triggerStatusDrift, nil
+	}
+	return triggerStatusOK, nil
+}
+
+// functionBody returns the dollar-quoted body of a CREATE FUNCTION statement, as pg_proc.prosrc stores it
+func functionBody(createSQL string) string {
+	start := strings.Index(createSQL, "$$")
+	end := strings.LastIndex(createSQL, "$$")
+	if start < 0 || end <= start {
+		return ""
+	}
+	return createSQL[start+2 : end]
+}
+
+// managedTables lists the tenant tables matching TRIGGER_INCLUDE and not matching TRIGGER_EXCLUDE
+func managedTables(db *sql.DB) ([]string, error) {
+	return listTables(db, isManagedTable)
+}
+
+// listTables lists the tenant tables accepted by match
+func listTables(db *sql.DB, match func(table string) bool) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p')
+		AND n.nspname = current_schema()
+		ORDER BY c.relname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		if match(table) {
+			tables = append(tables, table)
+		}
+	}
+	return tables, rows.Err()
+}
+
+// isManagedTable applies the include/exclude glob patterns to a table name
+func isManagedTable(table string) bool {
+	// Engine bookkeeping tables never get change triggers
+	if strings.HasPrefix(table, "whagons_rte_") || table == rowHashTable || table == rowHashBucketTable {
+		return false
+	}
+	return matchesAnyPattern(table, getEnvList(config.TriggerInclude)) &&
+		!matchesAnyPattern(table, getEnvList(config.TriggerExclude))
+}
+
+// needsChangeTrigger reports whether a table gets a change trigger. Grant tables always do, whatever
+// the include and exclude patterns, because their changes refresh the grants of connected users.
+func needsChangeTrigger(table string) bool {
+	return isManagedTable(table) || grantTables[table]
+}
+
+// matchesAnyPattern reports whether name matches one of the glob patterns
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectChangeTrigger compares the change triggers of a table with the expected definition
+func inspectChangeTrigger(db *sql.DB, table, function string) (TableTriggerStatus, error) {
+	status := TableTriggerStatus{Table: table, Function: function, Status: triggerStatusOK}
+	expectedName := table + "_changes_trigger"
+
+	rows, err := db.Query(`
+		SELECT t.tgname, p.proname, t.tgtype, t.tgenabled
+		FROM pg_trigger t
+		JOIN pg_proc p ON p.oid = t.tgfoid
+		WHERE t.tgrelid = to_regclass($1)
+		AND t.tgname LIKE '%_changes_trigger'
+		AND NOT t.tgisinternal`, pq.QuoteIdentifier(table))
+	if err != nil {
+		return status, err
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		var name, proname, enabled string
+		var tgtype int
+		if err := rows.Scan(&name, &proname, &tgtype, &enabled); err != nil {
+			return status, err
+		}
+
+		if name != expectedName {
+			status.Problems = append(status.Problems, fmt.Sprintf("unmanaged trigger %s", name))
+			continue
+		}
+		found = true
+		if proname != function {
+			status.Problems = append(status.Problems, fmt.Sprintf("calls %s instead of %s", proname, function))
+		}
+		if tgtype != expectedTriggerType {
+			status.Problems = append(status.Problems, fmt.Sprintf("unexpected trigger type %d", tgtype))
+		}
+		if enabled == "D" {
+			status.Problems = append(status.Problems, "trigger disabled")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return status, err
+	}
+
+	switch {
+	case !found:
+		status.Status = triggerStatusMissing
+		status.Problems = append(status.Problems, "trigger missing")
+	case len(status.Problems) > 0:
+		status.Status = triggerStatusDrift
+	}
+	return status, nil
+}
+
+// replaceChangeTrigger replaces the change triggers of a table with <table>_changes_trigger calling function
+func replaceChangeTrigger(db *sql.DB, table, function string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Drop every existing *_changes_trigger on the table so rows are not notified twice
+	rows, err := tx.Query(`
+		SELECT t.tgname
+		FROM pg_trigger t
+		WHERE t.tgrelid = to_regclass($1)
+		AND t.tgname LIKE '%_changes_trigger'
+		AND NOT t.tgisinternal`, pq.QuoteIdentifier(table))
+	if err != nil {
+		return fmt.Errorf("failed to query existing triggers: %w", err)
+	}
+	var existing []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing = append(existing, name)
+	}
+	rows.Close()
+
+	for _, name := range existing {
+		if _, err := tx.Exec(fmt.Sprintf("DROP TRIGGER %s ON %s", pq.QuoteIdentifier(name), pq.QuoteIdentifier(table))); err != nil {
+			return fmt.Errorf("failed to drop trigger %s: %w", name, err)
+		}
+	}
+
+	createTriggerSQL := fmt.Sprintf(`
+		CREATE TRIGGER %s
+			AFTER INSERT OR UPDATE OR DELETE
+			ON %s
+			FOR EACH ROW
+			EXECUTE FUNCTION %s();`,
+		pq.QuoteIdentifier(table+"_changes_trigger"), pq.QuoteIdentifier(table), pq.QuoteIdentifier(function))
+	if _, err := tx.Exec(createTriggerSQL); err != nil {
+		return fmt.Errorf("failed to create trigger: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// SyncTenantTriggers inspects or upgrades the change triggers of every connected tenant (implements TriggerEngineInterface)
+func (e *RealtimeEngine) SyncTenantTriggers(apply bool) ([]interface{}, error) {
+	e.mutex.RLock()
+	tenantDBs := make(map[string]*sql.DB)
+	for name, db := range e.tenantDBs {
+		tenantDBs[name] = db
+	}
+	e.mutex.RUnlock()
+
+	if len(tenantDBs) == 0 {
+		return nil, fmt.Errorf("no tenant databases connected")
+	}
+
+	names := make([]string, 0, len(tenantDBs))
+	for name := range tenantDBs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reports := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		report, err := e.syncTenantTriggers(name, tenantDBs[name], apply)
+		if err != nil {
+			reports = append(reports, map[string]interface{}{"tenant": name, "error": err.Error()})
+			continue
+		}
+		if apply {
+			if err := e.setupTenantRowHashes(name, tenantDBs[name]); err != nil {
+				log.Printf("⚠️  Failed to sync row hashes for tenant %s: %v", name, err)
+			}
+			if err := e.setupTenantTombstones(name, tenantDBs[name]); err != nil {
+				log.Printf("⚠️  Failed to sync tombstone triggers for tenant %s: %v", name, err)
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
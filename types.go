@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -24,6 +25,10 @@ type PostgreSQLNotification struct {
 	NewData   json.RawMessage `json:"new_data,omitempty"`
 	OldData   json.RawMessage `json:"old_data,omitempty"`
 	Timestamp float64         `json:"timestamp"`
+	ID        json.RawMessage `json:"id,omitempty"`      // Primary key of reference payloads
+	Payload   string          `json:"payload,omitempty"` // "reference" when the row must be fetched
+	TxID      uint64          `json:"txid,omitempty"`    // txid_current() of the writing transaction
+	Unchanged []string        `json:"-"`                 // unchanged TOASTed columns missing from NewData (replication)
 }
 
 // PublicationMessage represents a clean publication message for the frontend
@@ -37,7 +42,12 @@ type PublicationMessage struct {
 	Message     string          `json:"message"`
 	DBTimestamp float64         `json:"db_timestamp"`
 	ClientTime  string          `json:"client_timestamp"`
-	SessionId   string          `json:"sessionId"`
+	Synthetic   bool            `json:"synthetic,omitempty"`
+	Seq         uint64          `json:"seq,omitempty"`
+	TxID        uint64          `json:"txid,omitempty"`
+	AckRequired bool            `json:"ack_required,omitempty"`
+	RowHash     string          `json:"row_hash,omitempty"`
+	Compact     bool            `json:"compact,omitempty"` // new_data holds the id and changed columns only
 }
 
 // SystemMessage represents system messages (connection, echo, etc.)
@@ -50,6 +60,24 @@ type SystemMessage struct {
 	SessionId string      `json:"sessionId"`
 }
 
+// ClientMessage represents a message sent by a WebSocket client (subscribe, unsubscribe, snapshot, delta, ack, ping)
+type ClientMessage struct {
+	Type           string   `json:"type"`
+	RequestID      string   `json:"request_id,omitempty"`
+	SubscriptionID string   `json:"subscription_id,omitempty"`
+	Tables         []string `json:"tables,omitempty"`
+	Filter         string   `json:"filter,omitempty"`
+	ResumeFrom     *uint64  `json:"resume_from,omitempty"`
+	Seq            uint64   `json:"seq,omitempty"`     // ack: a single acknowledged change
+	Through        uint64   `json:"through,omitempty"` // ack: every change up to this sequence
+	Table          string   `json:"table,omitempty"`
+	PageSize       int      `json:"page_size,omitempty"`
+	SnapshotID     string   `json:"snapshot_id,omitempty"`
+	SnapshotCursor string   `json:"snapshot_cursor,omitempty"` // subscribe: start live delivery where a snapshot ends
+	SinceUpdatedAt string   `json:"since_updated_at,omitempty"`
+	SinceID        string   `json:"since_id,omitempty"`
+}
+
 // WebSocketSession wraps a WebSocket connection with session metadata
 type WebSocketSession struct {
 	Conn     *websocket.Conn
@@ -57,6 +85,30 @@ type WebSocketSession struct {
 	Tenant   string
 	UserID   int
 	LastPing time.Time
+
+	subscriptions map[string]*Subscription // subscriptionID -> tables the client wants
+	grants        *UserGrants              // roles, permissions and teams used for authorization
+	mutex         sync.Mutex
+
+	resumeFrom uint64    // last sequence the client saw before reconnecting
+	resuming   bool      // subscriptions replay history after resumeFrom
+	ackState   *ackState // at-least-once delivery state, nil unless the client connected with ack=true
+
+	compactUpdates       bool        // UPDATEs carry the primary key and changed columns instead of both images
+	transactionEnvelopes bool        // changes of one transaction arrive in a single transaction message
+	format               *wireFormat // negotiated subprotocol of the session's frames
+
+	compression      bool          // permessage-deflate negotiated
+	compressMin      int           // frames smaller than this are sent uncompressed
+	wire             *countingConn // bytes written to the connection, nil when not counted
+	frameBytes       atomic.Int64  // data frame bytes before compression
+	wireBytes        atomic.Int64  // the same frames as written to the connection
+	compressedFrames atomic.Int64
+
+	queue    *outboundQueue // bounded send queue drained only by writePump
+	pongs    chan string    // ping payloads for writePump to answer, so readPump never writes
+	done     chan struct{}  // closed when writePump must stop
+	doneOnce sync.Once
 }
 
 // RealtimeEngine is the main engine that manages database connections and WebSocket sessions
@@ -68,6 +120,31 @@ type RealtimeEngine struct {
 	tokenCache            map[string]*CachedToken          // tokenHash -> cached auth info
 	mutex                 sync.RWMutex
 	upgrader              websocket.Upgrader
+
+	listeners     map[string]*tenantListener // tenantName -> supervised change source
+	listenerMutex sync.Mutex
+
+	authorizer         ChangeAuthorizer
+	grantRefreshTimers map[string]*time.Timer // tenantName -> pending grant reload
+	grantMutex         sync.Mutex
+
+	redactionRules []RedactionRule
+	redactionMutex sync.RWMutex
+
+	deliveryStats map[string]*tenantDeliveryStats // tenantName -> slow-consumer counters
+	deliveryMutex sync.Mutex
+
+	histories    map[string]*tenantHistory // tenantName -> sequenced change history
+	historyMutex sync.Mutex
+
+	ackStates map[string]*ackState // tenant:token:client -> at-least-once delivery state
+	ackMutex  sync.Mutex
+
+	snapshots     map[string]*openSnapshot // snapshotID -> transaction kept open between pages
+	snapshotMutex sync.Mutex
+
+	debounceWindows map[string]*debounceWindow // tenant/table -> changes held back for coalescing
+	debounceMutex   sync.Mutex
 }
 
 // AuthenticatedSession represents an authenticated WebSocket session
@@ -75,6 +152,7 @@ type AuthenticatedSession struct {
 	SessionID  string
 	TenantName string
 	UserID     int
+	UserType   string
 	TokenID    int
 	Abilities  []string
 	ExpiresAt  *time.Time
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -25,6 +25,9 @@ const (
 
 	// Maximum message size allowed from peer
 	maxMessageSize = 512 * 1024 // 512KB
+
+	// Handshake response header carrying the session ID
+	sessionIDHeader = "X-Session-Id"
 )
 
 // websocketHandler handles WebSocket upgrade requests
@@ -38,6 +41,53 @@ func (e *RealtimeEngine) websocketHandler(c *fiber.Ctx) error {
 		)
 		domain := r.URL.Query().Get("domain")
 
+		// Reconnecting clients pass the last sequence number they received
+		var resumeFrom uint64
+		resuming := false
+		if value := r.URL.Query().Get("resume_from"); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid resume_from parameter", http.StatusBadRequest)
+				return
+			}
+			resumeFrom, resuming = parsed, true
+		}
+
+		// Clients opting into at-least-once delivery ack critical changes; client_id tells apart
+		// several connections sharing one token
+		ackMode := false
+		switch r.URL.Query().Get("ack") {
+		case "", "0", "false":
+		case "1", "true":
+			ackMode = true
+		default:
+			http.Error(w, "Invalid ack parameter", http.StatusBadRequest)
+			return
+		}
+		clientID := r.URL.Query().Get("client_id")
+
+		// Changes of one transaction are grouped unless the client prefers individual messages
+		transactionEnvelopes := getBoolEnv(config.TransactionEnvelopes, true)
+		switch r.URL.Query().Get("transactions") {
+		case "", "1", "true":
+		case "0", "false":
+			transactionEnvelopes = false
+		default:
+			http.Error(w, "Invalid transactions parameter", http.StatusBadRequest)
+			return
+		}
+
+		// Clients that merge partial rows ask for UPDATEs with the changed columns only
+		compactUpdates := false
+		switch r.URL.Query().Get("updates") {
+		case "", updatesFull:
+		case updatesCompact:
+			compactUpdates = true
+		default:
+			http.Error(w, "Invalid updates parameter", http.StatusBadRequest)
+			return
+		}
+
 		if token == "" {
 			log.Printf("❌ No bearer token provided")
 			http.Error(w, "Bearer token required", http.StatusUnauthorized)
@@ -58,23 +108,50 @@ func (e *RealtimeEngine) websocketHandler(c *fiber.Ctx) error {
 			return
 		}
 
-		// Upgrade HTTP connection to WebSocket
-		conn, err := e.upgrader.Upgrade(w, r, nil)
+		// Load the user's roles, permissions and teams for per-event authorization
+		grants := e.loadSessionGrants(authSession)
+
+		// Generate session ID - change frames do not repeat it, so it is part of the handshake
+		sessionID := uuid.New().String()
+
+		// Upgrade HTTP connection to WebSocket, counting the bytes written to it
+		counting := &countingResponseWriter{ResponseWriter: w}
+		conn, err := e.upgrader.Upgrade(counting, r, http.Header{sessionIDHeader: {sessionID}})
 		if err != nil {
 			log.Printf("❌ WebSocket upgrade failed: %v", err)
 			return
 		}
 
-		// Generate session ID
-		sessionID := uuid.New().String()
+		// The upgrader accepts permessage-deflate whenever the client offers it
+		compression := e.upgrader.EnableCompression && offersDeflate(r)
+		if compression {
+			level := getIntEnv(config.CompressionLevel, 1)
+			if err := conn.SetCompressionLevel(level); err != nil {
+				log.Printf("⚠️  Invalid compression level %d, using the default: %v", level, err)
+			}
+		}
 
 		// Create WebSocket session
 		wsSession := &WebSocketSession{
-			Conn:     conn,
-			ID:       sessionID,
-			Tenant:   authSession.TenantName,
-			UserID:   authSession.UserID,
-			LastPing: time.Now(),
+			Conn:          conn,
+			ID:            sessionID,
+			Tenant:        authSession.TenantName,
+			UserID:        authSession.UserID,
+			LastPing:      time.Now(),
+			subscriptions: make(map[string]*Subscription),
+			grants:        grants,
+
+			compactUpdates:       compactUpdates,
+			transactionEnvelopes: transactionEnvelopes,
+			format:               wireFormatFor(conn.Subprotocol()),
+
+			compression: compression,
+			compressMin: compressionMinBytesForTenant(authSession.TenantName),
+			wire:        counting.conn,
+		}
+		wsSession.newSessionQueue()
+		if ackMode {
+			wsSession.ackState = e.attachAckState(wsSession, authSession, clientID)
 		}
 
 		// Set the session ID in the auth session
@@ -96,16 +173,36 @@ func (e *RealtimeEngine) websocketHandler(c *fiber.Ctx) error {
 			Operation: "authenticated",
 			Message:   fmt.Sprintf("Authenticated for domain: %s (tenant: %s)", domain, authSession.TenantName),
 			Data: map[string]interface{}{
-				"domain":      domain,
-				"tenant_name": authSession.TenantName,
-				"user_id":     authSession.UserID,
-				"abilities":   authSession.Abilities,
+				"domain":       domain,
+				"tenant_name":  authSession.TenantName,
+				"user_id":      authSession.UserID,
+				"abilities":    authSession.Abilities,
+				"last_seq":     e.historyFor(authSession.TenantName).lastSeq(),
+				"ack_mode":     ackMode,
+				"updates":      updatesMode(compactUpdates),
+				"transactions": transactionEnvelopes,
+				"protocol":     wsSession.format.protocol,
+				"compression":  compression,
 			},
 			Timestamp: time.Now().Format(time.RFC3339),
 			SessionId: sessionID,
 		}
 		e.sendMessage(wsSession, welcomeMsg)
 
+		// Subscriptions replay what the client missed, unless the history no longer reaches back that far
+		if resuming {
+			if _, ok := e.historyFor(authSession.TenantName).since(resumeFrom); ok {
+				wsSession.resumeFrom, wsSession.resuming = resumeFrom, true
+			} else {
+				e.sendResyncRequired(wsSession, "history_gap")
+			}
+		}
+
+		// Reconnecting with the same token picks up the changes left unacknowledged
+		if wsSession.ackState != nil {
+			e.retransmitPending(wsSession.ackState, 0)
+		}
+
 		// Start goroutines for reading and writing
 		go e.writePump(wsSession)
 		go e.readPump(wsSession)
@@ -116,19 +213,32 @@ func (e *RealtimeEngine) websocketHandler(c *fiber.Ctx) error {
 func (e *RealtimeEngine) readPump(wsSession *WebSocketSession) {
 	defer func() {
 		e.cleanupSession(wsSession.ID, wsSession.Tenant)
+		e.detachAckState(wsSession)
+		wsSession.stop()
 		wsSession.Conn.Close()
 	}()
 
 	wsSession.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	wsSession.Conn.SetPongHandler(func(string) error {
 		wsSession.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		wsSession.mutex.Lock()
 		wsSession.LastPing = time.Now()
+		wsSession.mutex.Unlock()
+		return nil
+	})
+	// Client pings are answered by writePump; a newer ping replaces one still waiting for its pong
+	wsSession.Conn.SetPingHandler(func(appData string) error {
+		select {
+		case <-wsSession.pongs:
+		default:
+		}
+		wsSession.pongs <- appData
 		return nil
 	})
 	wsSession.Conn.SetReadLimit(maxMessageSize)
 
 	for {
-		_, message, err := wsSession.Conn.ReadMessage()
+		messageType, message, err := wsSession.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("❌ WebSocket read error for session %s: %v", wsSession.ID, err)
@@ -136,59 +246,24 @@ func (e *RealtimeEngine) readPump(wsSession *WebSocketSession) {
 			break
 		}
 
-		log.Printf("📥 WebSocket received message from session %s (tenant: %s): %s",
-			wsSession.ID, wsSession.Tenant, string(message))
-
-		// Echo the message back
-		var msgData interface{}
-		if err := json.Unmarshal(message, &msgData); err != nil {
-			msgData = string(message)
-		}
-
-		response := SystemMessage{
-			Type:      "echo",
-			Operation: "echo",
-			Message:   fmt.Sprintf("Echo from %s: %s", wsSession.Tenant, string(message)),
-			Data:      msgData,
-			Timestamp: time.Now().Format(time.RFC3339),
-			SessionId: wsSession.ID,
+		// Binary frames are in the negotiated format; the handlers work on JSON
+		if messageType == websocket.BinaryMessage {
+			if message, err = wsSession.format.decode(message); err != nil {
+				e.sendClientError(wsSession, "", "invalid_message", fmt.Sprintf("Invalid %s frame: %v", wsSession.format.protocol, err))
+				continue
+			}
 		}
 
-		e.sendMessage(wsSession, response)
-	}
-}
-
-// writePump handles writing messages to the WebSocket connection
-func (e *RealtimeEngine) writePump(wsSession *WebSocketSession) {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		wsSession.Conn.Close()
-	}()
+		log.Printf("📥 WebSocket received message from session %s (tenant: %s): %s",
+			wsSession.ID, wsSession.Tenant, string(message))
 
-	for {
-		select {
-		case <-ticker.C:
-			wsSession.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := wsSession.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("❌ WebSocket ping error for session %s: %v", wsSession.ID, err)
-				return
-			}
-		}
+		e.handleClientMessage(wsSession, message)
 	}
 }
 
-// sendMessage sends a message to a WebSocket session
+// sendMessage queues a system message for a WebSocket session
 func (e *RealtimeEngine) sendMessage(wsSession *WebSocketSession, message SystemMessage) error {
-	wsSession.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-
-	jsonMessage, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("❌ Failed to marshal message: %v", err)
-		return err
-	}
-
-	return wsSession.Conn.WriteMessage(websocket.TextMessage, jsonMessage)
+	return e.queueMessage(wsSession, message, "")
 }
 
 // BroadcastSystemMessage sends a system message to all connected sessions
@@ -207,11 +282,6 @@ func (e *RealtimeEngine) BroadcastSystemMessage(message SystemMessage) {
 
 		if err := e.sendMessage(wsSession, message); err != nil {
 			log.Printf("❌ Failed to send to session %s: %v", sessionID, err)
-			// Remove failed session
-			e.mutex.Lock()
-			delete(e.sessions, sessionID)
-			delete(e.authenticatedSessions, sessionID)
-			e.mutex.Unlock()
 		} else {
 			broadcastCount++
 		}
@@ -222,6 +292,25 @@ func (e *RealtimeEngine) BroadcastSystemMessage(message SystemMessage) {
 	}
 }
 
+// BroadcastTenantSystemMessage sends a system message to the connected sessions of a single tenant
+func (e *RealtimeEngine) BroadcastTenantSystemMessage(tenantName string, message SystemMessage) {
+	e.mutex.RLock()
+	sessions := make(map[string]*WebSocketSession)
+	for id, session := range e.sessions {
+		if session.Tenant == tenantName {
+			sessions[id] = session
+		}
+	}
+	e.mutex.RUnlock()
+
+	for sessionID, wsSession := range sessions {
+		message.SessionId = sessionID
+		if err := e.sendMessage(wsSession, message); err != nil {
+			log.Printf("❌ Failed to send to session %s: %v", sessionID, err)
+		}
+	}
+}
+
 // getConnectedSessionsCount returns the number of currently connected sessions
 func (e *RealtimeEngine) GetConnectedSessionsCount() int {
 	e.mutex.RLock()
@@ -258,12 +347,11 @@ func (e *RealtimeEngine) DisconnectAllSessions() {
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 
-	// Disconnect all sessions
+	// Disconnect all sessions (writePump sends the notification, then the close frame)
 	for sessionID, wsSession := range sessions {
 		disconnectMsg.SessionId = sessionID
 		e.sendMessage(wsSession, disconnectMsg)
-		wsSession.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutdown"))
-		wsSession.Conn.Close()
+		wsSession.close(websocket.CloseGoingAway, "Server shutdown")
 		log.Printf("📡 Disconnected session: %s", sessionID)
 	}
 
@@ -336,27 +424,19 @@ func (e *RealtimeEngine) cleanupSession(sessionID, tenantName string) {
 		sessionID, tenantName, remaining)
 }
 
-// cleanupZombieSessions removes sessions that are no longer active
+// cleanupZombieSessions removes sessions that stopped answering the pings sent by writePump
 func (e *RealtimeEngine) cleanupZombieSessions() {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
 	var zombieSessions []string
-
-	// Create a proper JSON ping message
-	pingMsg := SystemMessage{
-		Type:      "ping",
-		Operation: "health_check",
-		Message:   "Connection health check",
-		Timestamp: time.Now().Format(time.RFC3339),
-	}
-	pingJSON, _ := json.Marshal(pingMsg)
-
-	// Check sessions - if ping fails, mark as zombie
 	for sessionID, wsSession := range e.sessions {
-		wsSession.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-		if err := wsSession.Conn.WriteMessage(websocket.PingMessage, pingJSON); err != nil {
-			log.Printf("🧟 Found zombie session: %s (error: %v)", sessionID, err)
+		wsSession.mutex.Lock()
+		lastPing := wsSession.LastPing
+		wsSession.mutex.Unlock()
+
+		if time.Since(lastPing) > 2*pongWait {
+			log.Printf("🧟 Found zombie session: %s (last pong: %s ago)", sessionID, time.Since(lastPing).Round(time.Second))
 			zombieSessions = append(zombieSessions, sessionID)
 		}
 	}
@@ -364,6 +444,7 @@ func (e *RealtimeEngine) cleanupZombieSessions() {
 	// Clean up zombie sessions
 	for _, sessionID := range zombieSessions {
 		if wsSession, exists := e.sessions[sessionID]; exists {
+			wsSession.stop()
 			wsSession.Conn.Close()
 		}
 		delete(e.sessions, sessionID)
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket subprotocols naming the wire format of a session's frames
+const (
+	wireProtocolJSON    = "whagons.json.v1"
+	wireProtocolMsgPack = "whagons.msgpack.v1"
+	wireProtocolCBOR    = "whagons.cbor.v1"
+)
+
+// wireProtocols are offered in order of preference: the binary formats make smaller frames
+var wireProtocols = []string{wireProtocolMsgPack, wireProtocolCBOR, wireProtocolJSON}
+
+// maxWireDepth bounds the nesting of decoded binary client frames
+const maxWireDepth = 64
+
+var errWireTruncated = errors.New("truncated frame")
+
+// wireFormat encodes the frames sent to a session and decodes the binary frames it sends
+type wireFormat struct {
+	protocol    string
+	messageType int
+	encode      func(message interface{}) ([]byte, error)
+	decode      func(data []byte) ([]byte, error) // binary client frame -> JSON
+}
+
+var (
+	jsonWire = &wireFormat{
+		protocol:    wireProtocolJSON,
+		messageType: websocket.TextMessage,
+		encode:      json.Marshal,
+		decode:      func(data []byte) ([]byte, error) { return data, nil },
+	}
+	msgpackWire = &wireFormat{
+		protocol:    wireProtocolMsgPack,
+		messageType: websocket.BinaryMessage,
+		encode:      func(message interface{}) ([]byte, error) { return encodeBinary(message, &msgpackWriter{}) },
+		decode: func(data []byte) ([]byte, error) {
+			return decodeBinary(data, func(r *wireReader) (interface{}, error) { return r.msgpackValue(0) })
+		},
+	}
+	cborWire = &wireFormat{
+		protocol:    wireProtocolCBOR,
+		messageType: websocket.BinaryMessage,
+		encode:      func(message interface{}) ([]byte, error) { return encodeBinary(message, &cborWriter{}) },
+		decode: func(data []byte) ([]byte, error) {
+			return decodeBinary(data, func(r *wireReader) (interface{}, error) { return r.cborValue(0) })
+		},
+	}
+)
+
+// wireFormatFor returns the format of a negotiated subprotocol; clients negotiating none get JSON
+func wireFormatFor(protocol string) *wireFormat {
+	switch protocol {
+	case wireProtocolMsgPack:
+		return msgpackWire
+	case wireProtocolCBOR:
+		return cborWire
+	default:
+		return jsonWire
+	}
+}
+
+// jsonMember is an object member, kept in the order json.Marshal wrote it
+type jsonMember struct {
+	key   string
+	value interface{}
+}
+
+// wireWriter appends values in a binary format
+type wireWriter interface {
+	writeNil()
+	writeBool(value bool)
+	writeInt(value int64)
+	writeUint(value uint64)
+	writeString(value string)
+	writeArrayHeader(length int)
+	writeMapHeader(length int)
+	bytes() []byte
+}
+
+// encodeBinary encodes a message through its JSON form, so every message type and the
+// json.RawMessage row images it carries are transcoded the same way
+func encodeBinary(message interface{}, writer wireWriter) ([]byte, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	value, err := readJSONValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeWireValue(writer, value); err != nil {
+		return nil, err
+	}
+	return writer.bytes(), nil
+}
+
+// readJSONValue reads the next JSON value, objects as ordered members and numbers as json.Number
+func readJSONValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, isDelim := token.(json.Delim)
+	if !isDelim {
+		return token, nil
+	}
+
+	switch delim {
+	case '{':
+		members := []jsonMember{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, jsonMember{key: key.(string), value: value})
+		}
+		_, err = decoder.Token()
+		return members, err
+	case '[':
+		items := []interface{}{}
+		for decoder.More() {
+			value, err := readJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		_, err = decoder.Token()
+		return items, err
+	}
+	return nil, fmt.Errorf("unexpected %v", delim)
+}
+
+// writeWireValue writes a value read by readJSONValue
+func writeWireValue(writer wireWriter, value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		writer.writeNil()
+	case bool:
+		writer.writeBool(value)
+	case string:
+		writer.writeString(value)
+	case json.Number:
+		// 64-bit integers stay integers. Anything else (numeric columns, integers beyond 64 bits) is
+		// sent as its decimal text, since a double would round values JSON clients get exactly.
+		text := value.String()
+		if !strings.ContainsAny(text, ".eE") {
+			if number, err := strconv.ParseInt(text, 10, 64); err == nil {
+				writer.writeInt(number)
+				return nil
+			}
+			if number, err := strconv.ParseUint(text, 10, 64); err == nil {
+				writer.writeUint(number)
+				return nil
+			}
+		}
+		writer.writeString(text)
+	case []interface{}:
+		writer.writeArrayHeader(len(value))
+		for _, item := range value {
+			if err := writeWireValue(writer, item); err != nil {
+				return err
+			}
+		}
+	case []jsonMember:
+		writer.writeMapHeader(len(value))
+		for _, member := range value {
+			writer.writeString(member.key)
+			if err := writeWireValue(writer, member.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported value %T", value)
+	}
+	return nil
+}
+
+// msgpackWriter writes MessagePack, always using the shortest encoding
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) bytes() []byte { return w.buf }
+
+func (w *msgpackWriter) writeNil() { w.buf = append(w.buf, 0xc0) }
+
+func (w *msgpackWriter) writeBool(value bool) {
+	if value {
+		w.buf = append(w.buf, 0xc3)
+	} else {
+		w.buf = append(w.buf, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeInt(value int64) {
+	switch {
+	case value >= 0:
+		w.writeUint(uint64(value))
+	case value >= -32:
+		w.buf = append(w.buf, byte(value)) // negative fixint
+	case value >= math.MinInt8:
+		w.buf = append(w.buf, 0xd0, byte(value))
+	case value >= math.MinInt16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xd1), uint16(value))
+	case value >= math.MinInt32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xd2), uint32(value))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xd3), uint64(value))
+	}
+}
+
+func (w *msgpackWriter) writeUint(value uint64) {
+	switch {
+	case value <= 0x7f:
+		w.buf = append(w.buf, byte(value)) // positive fixint
+	case value <= math.MaxUint8:
+		w.buf = append(w.buf, 0xcc, byte(value))
+	case value <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xcd), uint16(value))
+	case value <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xce), uint32(value))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xcf), value)
+	}
+}
+
+func (w *msgpackWriter) writeString(value string) {
+	w.writeHeader(len(value), 0xa0, 32, 0xd9, 0xda, 0xdb)
+	w.buf = append(w.buf, value...)
+}
+
+func (w *msgpackWriter) writeArrayHeader(length int) {
+	w.writeHeader(length, 0x90, 16, 0, 0xdc, 0xdd)
+}
+
+func (w *msgpackWriter) writeMapHeader(length int) {
+	w.writeHeader(length, 0x80, 16, 0, 0xde, 0xdf)
+}
+
+// writeHeader writes a length as a fix format below fixLimit, else with the smallest sized format
+// (format8 is zero for types without a one byte length)
+func (w *msgpackWriter) writeHeader(length int, fix byte, fixLimit int, format8, format16, format32 byte) {
+	switch {
+	case length < fixLimit:
+		w.buf = append(w.buf, fix|byte(length))
+	case format8 != 0 && length <= math.MaxUint8:
+		w.buf = append(w.buf, format8, byte(length))
+	case length <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, format16), uint16(length))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, format32), uint32(length))
+	}
+}
+
+// CBOR major types
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+)
+
+// cborWriter writes CBOR with definite lengths and the shortest argument encoding
+type cborWriter struct {
+	buf []byte
+}
+
+func (w *cborWriter) bytes() []byte { return w.buf }
+
+func (w *cborWriter) writeHead(major byte, argument uint64) {
+	major <<= 5
+	switch {
+	case argument < 24:
+		w.buf = append(w.buf, major|byte(argument))
+	case argument <= math.MaxUint8:
+		w.buf = append(w.buf, major|24, byte(argument))
+	case argument <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, major|25), uint16(argument))
+	case argument <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, major|26), uint32(argument))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, major|27), argument)
+	}
+}
+
+func (w *cborWriter) writeNil() { w.buf = append(w.buf, 0xf6) }
+
+func (w *cborWriter) writeBool(value bool) {
+	if value {
+		w.buf = append(w.buf, 0xf5)
+	} else {
+		w.buf = append(w.buf, 0xf4)
+	}
+}
+
+func (w *cborWriter) writeInt(value int64) {
+	if value >= 0 {
+		w.writeHead(cborUnsigned, uint64(value))
+	} else {
+		w.writeHead(cborNegative, uint64(-1-value))
+	}
+}
+
+func (w *cborWriter) writeUint(value uint64) { w.writeHead(cborUnsigned, value) }
+
+func (w *cborWriter) writeString(value string) {
+	w.writeHead(cborText, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *cborWriter) writeArrayHeader(length int) { w.writeHead(cborArray, uint64(length)) }
+
+func (w *cborWriter) writeMapHeader(length int) { w.writeHead(cborMap, uint64(length)) }
+
+// decodeBinary decodes one binary client frame and returns it as JSON for the message handlers
+func decodeBinary(data []byte, read func(r *wireReader) (interface{}, error)) ([]byte, error) {
+	reader := &wireReader{data: data}
+	value, err := read(reader)
+	if err != nil {
+		return nil, err
+	}
+	if reader.pos != len(data) {
+		return nil, fmt.Errorf("%d trailing bytes", len(data)-reader.pos)
+	}
+	return json.Marshal(value)
+}
+
+// wireReader reads a binary client frame
+type wireReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *wireReader) take(length uint64) ([]byte, error) {
+	if length > uint64(len(r.data)-r.pos) {
+		return nil, errWireTruncated
+	}
+	chunk := r.data[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return chunk, nil
+}
+
+func (r *wireReader) readByte() (byte, error) {
+	chunk, err := r.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return chunk[0], nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes
+func (r *wireReader) uint(size int) (uint64, error) {
+	chunk, err := r.take(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, b := range chunk {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+// array reads length values; every value takes at least one byte, which bounds the allocation
+func (r *wireReader) array(length uint64, depth int, value func(depth int) (interface{}, error)) ([]interface{}, error) {
+	if length > uint64(len(r.data)-r.pos) {
+		return nil, errWireTruncated
+	}
+	items := make([]interface{}, 0, length)
+	for i := uint64(0); i < length; i++ {
+		item, err := value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// object reads length key/value pairs with string keys
+func (r *wireReader) object(length uint64, depth int, value func(depth int) (interface{}, error)) (map[string]interface{}, error) {
+	if length > uint64(len(r.data)-r.pos)/2 {
+		return nil, errWireTruncated
+	}
+	members := make(map[string]interface{}, length)
+	for i := uint64(0); i < length; i++ {
+		key, err := value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, isString := key.(string)
+		if !isString {
+			return nil, fmt.Errorf("map key must be a string, got %T", key)
+		}
+		if members[name], err = value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+// msgpackValue reads one MessagePack value
+func (r *wireReader) msgpackValue(depth int) (interface{}, error) {
+	if depth > maxWireDepth {
+		return nil, errors.New("frame nested too deeply")
+	}
+	b, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return r.msgpackString(uint64(b & 0x1f))
+	case b&0xf0 == 0x90:
+		return r.array(uint64(b&0x0f), depth, r.msgpackValue)
+	case b&0xf0 == 0x80:
+		return r.object(uint64(b&0x0f), depth, r.msgpackValue)
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8/16/32
+		length, err := r.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return r.take(length)
+	case 0xca:
+		bits, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := r.uint(8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8/16/32/64
+		return r.uint(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8/16/32/64
+		size := 1 << (b - 0xd0)
+		value, err := r.uint(size)
+		// Sign-extend from size bytes
+		shift := 64 - 8*size
+		return int64(value<<shift) >> shift, err
+	case 0xd9, 0xda, 0xdb: // str 8/16/32
+		length, err := r.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackString(length)
+	case 0xdc, 0xdd: // array 16/32
+		length, err := r.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.array(length, depth, r.msgpackValue)
+	case 0xde, 0xdf: // map 16/32
+		length, err := r.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.object(length, depth, r.msgpackValue)
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%02x", b)
+}
+
+func (r *wireReader) msgpackString(length uint64) (interface{}, error) {
+	chunk, err := r.take(length)
+	return string(chunk), err
+}
+
+// cborValue reads one CBOR data item; indefinite lengths are not supported
+func (r *wireReader) cborValue(depth int) (interface{}, error) {
+	if depth > maxWireDepth {
+		return nil, errors.New("frame nested too deeply")
+	}
+	b, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := b>>5, b&0x1f
+
+	if major == cborSimple {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23: // null, undefined
+			return nil, nil
+		case 25:
+			bits, err := r.uint(2)
+			return float16ToFloat64(uint16(bits)), err
+		case 26:
+			bits, err := r.uint(4)
+			return float64(math.Float32frombits(uint32(bits))), err
+		case 27:
+			bits, err := r.uint(8)
+			return math.Float64frombits(bits), err
+		}
+		return nil, fmt.Errorf("unsupported CBOR simple value %d", info)
+	}
+
+	var argument uint64
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info <= 27:
+		if argument, err = r.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported CBOR additional information %d", info)
+	}
+
+	switch major {
+	case cborUnsigned:
+		if argument <= math.MaxInt64 {
+			return int64(argument), nil
+		}
+		return argument, nil
+	case cborNegative:
+		if argument <= math.MaxInt64 {
+			return -1 - int64(argument), nil
+		}
+		return -1 - float64(argument), nil
+	case cborBytes:
+		return r.take(argument)
+	case cborText:
+		chunk, err := r.take(argument)
+		return string(chunk), err
+	case cborArray:
+		return r.array(argument, depth, r.cborValue)
+	case cborMap:
+		return r.object(argument, depth, r.cborValue)
+	default: // cborTag: the tagged value is used as is
+		return r.cborValue(depth + 1)
+	}
+}
+
+// float16ToFloat64 widens an IEEE 754 half-precision float
+func float16ToFloat64(bits uint16) float64 {
+	sign := 1.0
+	if bits&0x8000 != 0 {
+		sign = -1
+	}
+	exponent, fraction := int(bits>>10&0x1f), float64(bits&0x3ff)
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(fraction, -24)
+	case 0x1f:
+		if fraction == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(fraction+1024, exponent-25)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var binaryWires = []*wireFormat{msgpackWire, cborWire}
+
+// normalizeJSON decodes JSON for comparison, keeping numbers as their text
+func normalizeJSON(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("invalid JSON %.200s: %v", data, err)
+	}
+	return value
+}
+
+// repeatedList returns length copies of item
+func repeatedList(length int, item interface{}) []interface{} {
+	list := make([]interface{}, length)
+	for i := range list {
+		list[i] = item
+	}
+	return list
+}
+
+// numberedMap returns a map with length distinct keys
+func numberedMap(length int) map[string]int {
+	members := make(map[string]int, length)
+	for i := 0; i < length; i++ {
+		members[fmt.Sprintf("k%d", i)] = i
+	}
+	return members
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       interface{}
+		wantMsgpack []byte // leading bytes of the MessagePack encoding
+		wantCBOR    []byte // leading bytes of the CBOR encoding
+	}{
+		{name: "nil", value: nil, wantMsgpack: []byte{0xc0}, wantCBOR: []byte{0xf6}},
+		{name: "true", value: true, wantMsgpack: []byte{0xc3}, wantCBOR: []byte{0xf5}},
+		{name: "false", value: false, wantMsgpack: []byte{0xc2}, wantCBOR: []byte{0xf4}},
+
+		{name: "zero", value: 0, wantMsgpack: []byte{0x00}, wantCBOR: []byte{0x00}},
+		{name: "fixint limit", value: 127, wantMsgpack: []byte{0x7f}, wantCBOR: []byte{0x18, 0x7f}},
+		{name: "uint8", value: 255, wantMsgpack: []byte{0xcc, 0xff}, wantCBOR: []byte{0x18, 0xff}},
+		{name: "uint16", value: 65535, wantMsgpack: []byte{0xcd, 0xff, 0xff}, wantCBOR: []byte{0x19, 0xff, 0xff}},
+		{name: "uint32", value: uint32(math.MaxUint32), wantMsgpack: []byte{0xce}, wantCBOR: []byte{0x1a}},
+		{name: "max int64", value: int64(math.MaxInt64), wantMsgpack: []byte{0xcf}, wantCBOR: []byte{0x1b}},
+		{name: "max uint64", value: uint64(math.MaxUint64), wantMsgpack: []byte{0xcf, 0xff}, wantCBOR: []byte{0x1b, 0xff}},
+
+		{name: "minus one", value: -1, wantMsgpack: []byte{0xff}, wantCBOR: []byte{0x20}},
+		{name: "negative fixint limit", value: -32, wantMsgpack: []byte{0xe0}, wantCBOR: []byte{0x38, 0x1f}},
+		{name: "int8", value: -33, wantMsgpack: []byte{0xd0, 0xdf}, wantCBOR: []byte{0x38, 0x20}},
+		{name: "int8 limit", value: -128, wantMsgpack: []byte{0xd0, 0x80}, wantCBOR: []byte{0x38, 0x7f}},
+		{name: "int16", value: -129, wantMsgpack: []byte{0xd1, 0xff, 0x7f}, wantCBOR: []byte{0x38, 0x80}},
+		{name: "int32", value: -32769, wantMsgpack: []byte{0xd2}, wantCBOR: []byte{0x39, 0x80, 0x00}},
+		{name: "int64", value: int64(math.MinInt32) - 1, wantMsgpack: []byte{0xd3}, wantCBOR: []byte{0x3a, 0x80, 0x00, 0x00, 0x00}},
+		{name: "min int64", value: int64(math.MinInt64), wantMsgpack: []byte{0xd3, 0x80}, wantCBOR: []byte{0x3b, 0x7f, 0xff}},
+
+		{name: "empty string", value: "", wantMsgpack: []byte{0xa0}, wantCBOR: []byte{0x60}},
+		{name: "string 23", value: strings.Repeat("a", 23), wantMsgpack: []byte{0xb7}, wantCBOR: []byte{0x77}},
+		{name: "string 24", value: strings.Repeat("a", 24), wantMsgpack: []byte{0xb8}, wantCBOR: []byte{0x78, 24}},
+		{name: "string 31", value: strings.Repeat("a", 31), wantMsgpack: []byte{0xbf}, wantCBOR: []byte{0x78, 31}},
+		{name: "string 32", value: strings.Repeat("a", 32), wantMsgpack: []byte{0xd9, 32}, wantCBOR: []byte{0x78, 32}},
+		{name: "string 255", value: strings.Repeat("a", 255), wantMsgpack: []byte{0xd9, 0xff}, wantCBOR: []byte{0x78, 0xff}},
+		{name: "string 256", value: strings.Repeat("a", 256), wantMsgpack: []byte{0xda, 0x01, 0x00}, wantCBOR: []byte{0x79, 0x01, 0x00}},
+		{name: "string 65535", value: strings.Repeat("a", 65535), wantMsgpack: []byte{0xda, 0xff, 0xff}, wantCBOR: []byte{0x79, 0xff, 0xff}},
+		{name: "string 65536", value: strings.Repeat("a", 65536), wantMsgpack: []byte{0xdb, 0x00, 0x01, 0x00, 0x00}, wantCBOR: []byte{0x7a, 0x00, 0x01, 0x00, 0x00}},
+		{name: "multibyte string", value: "Grüße, 世界", wantMsgpack: []byte{0xaf}, wantCBOR: []byte{0x6f}},
+
+		{name: "empty array", value: []int{}, wantMsgpack: []byte{0x90}, wantCBOR: []byte{0x80}},
+		{name: "array 15", value: repeatedList(15, 1), wantMsgpack: []byte{0x9f}, wantCBOR: []byte{0x8f}},
+		{name: "array 16", value: repeatedList(16, 1), wantMsgpack: []byte{0xdc, 0x00, 0x10}, wantCBOR: []byte{0x90}},
+		{name: "array 24", value: repeatedList(24, nil), wantMsgpack: []byte{0xdc, 0x00, 24}, wantCBOR: []byte{0x98, 24}},
+		{name: "array 65535", value: repeatedList(65535, nil), wantMsgpack: []byte{0xdc, 0xff, 0xff}, wantCBOR: []byte{0x99, 0xff, 0xff}},
+		{name: "array 65536", value: repeatedList(65536, nil), wantMsgpack: []byte{0xdd, 0x00, 0x01, 0x00, 0x00}, wantCBOR: []byte{0x9a, 0x00, 0x01, 0x00, 0x00}},
+
+		{name: "empty map", value: map[string]int{}, wantMsgpack: []byte{0x80}, wantCBOR: []byte{0xa0}},
+		{name: "map 15", value: numberedMap(15), wantMsgpack: []byte{0x8f}, wantCBOR: []byte{0xaf}},
+		{name: "map 16", value: numberedMap(16), wantMsgpack: []byte{0xde, 0x00, 0x10}, wantCBOR: []byte{0xb0}},
+		{name: "map 65536", value: numberedMap(65536), wantMsgpack: []byte{0xdf, 0x00, 0x01, 0x00, 0x00}, wantCBOR: []byte{0xba, 0x00, 0x01, 0x00, 0x00}},
+
+		{
+			name: "change with nested row images",
+			value: PublicationMessage{
+				Type:       "database",
+				TenantName: "acme",
+				Table:      "wh_tasks",
+				Operation:  "UPDATE",
+				NewData:    json.RawMessage(`{"id":7,"name":"Inspect","user_ids":[12,-15],"meta":{"tags":["a",{"b":null}],"done":true},"deleted_at":null}`),
+				OldData:    json.RawMessage(`{"id":7,"name":"Check","user_ids":[],"meta":{}}`),
+				Seq:        42,
+				TxID:       uint64(math.MaxUint32) + 1,
+			},
+			wantMsgpack: []byte{0x8b},
+			wantCBOR:    []byte{0xab},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, wire := range binaryWires {
+				encoded, err := wire.encode(tt.value)
+				if err != nil {
+					t.Fatalf("%s: encode: %v", wire.protocol, err)
+				}
+
+				prefix := tt.wantMsgpack
+				if wire == cborWire {
+					prefix = tt.wantCBOR
+				}
+				if !bytes.HasPrefix(encoded, prefix) {
+					t.Errorf("%s: encoding starts with % x, want % x", wire.protocol, encoded[:min(len(encoded), len(prefix))], prefix)
+				}
+
+				decoded, err := wire.decode(encoded)
+				if err != nil {
+					t.Fatalf("%s: decode: %v", wire.protocol, err)
+				}
+				if got, want := normalizeJSON(t, decoded), normalizeJSON(t, want); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: round trip = %.200s, want %.200s", wire.protocol, decoded, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWireNonIntegerNumbers(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "numeric keeps trailing zeros", value: `{"price":12.50}`, want: `{"price":"12.50"}`},
+		{name: "numeric beyond double precision", value: `{"amount":1234567890123456789.123456789}`, want: `{"amount":"1234567890123456789.123456789"}`},
+		{name: "integer beyond uint64", value: `{"big":123456789012345678901234567890}`, want: `{"big":"123456789012345678901234567890"}`},
+		{name: "integer below int64", value: `{"small":-9223372036854775809}`, want: `{"small":"-9223372036854775809"}`},
+		{name: "exponent", value: `[1e+21,-2.5e-7]`, want: `["1e+21","-2.5e-7"]`},
+		{name: "integers stay numbers", value: `[0,-1,9223372036854775807,18446744073709551615]`, want: `[0,-1,9223372036854775807,18446744073709551615]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, wire := range binaryWires {
+				encoded, err := wire.encode(json.RawMessage(tt.value))
+				if err != nil {
+					t.Fatalf("%s: encode: %v", wire.protocol, err)
+				}
+				decoded, err := wire.decode(encoded)
+				if err != nil {
+					t.Fatalf("%s: decode: %v", wire.protocol, err)
+				}
+				if got, want := normalizeJSON(t, decoded), normalizeJSON(t, []byte(tt.want)); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: round trip = %s, want %s", wire.protocol, decoded, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWireDecodeFloats(t *testing.T) {
+	tests := []struct {
+		name string
+		wire *wireFormat
+		data []byte
+		want string
+	}{
+		{name: "msgpack float32", wire: msgpackWire, data: []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, want: `1.5`},
+		{name: "msgpack float64", wire: msgpackWire, data: []byte{0xcb, 0xc0, 0x04, 0, 0, 0, 0, 0, 0}, want: `-2.5`},
+		{name: "cbor float16", wire: cborWire, data: []byte{0xf9, 0x3e, 0x00}, want: `1.5`},
+		{name: "cbor float32", wire: cborWire, data: []byte{0xfa, 0x47, 0xc3, 0x50, 0x00}, want: `100000`},
+		{name: "cbor float64", wire: cborWire, data: []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}, want: `1.1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := tt.wire.decode(tt.data)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if string(decoded) != tt.want {
+				t.Errorf("decoded %s, want %s", decoded, tt.want)
+			}
+		})
+	}
+}
+
+func TestFloat16ToFloat64(t *testing.T) {
+	tests := []struct {
+		bits uint16
+		want float64
+	}{
+		{0x0000, 0},
+		{0x3c00, 1},
+		{0x3e00, 1.5},
+		{0xc000, -2},
+		{0x7bff, 65504},              // largest normal
+		{0x0400, math.Ldexp(1, -14)}, // smallest normal
+		{0x0001, math.Ldexp(1, -24)}, // smallest subnormal
+		{0x83ff, -math.Ldexp(1023, -24)},
+		{0x7c00, math.Inf(1)},
+		{0xfc00, math.Inf(-1)},
+	}
+
+	for _, tt := range tests {
+		if got := float16ToFloat64(tt.bits); got != tt.want {
+			t.Errorf("float16ToFloat64(0x%04x) = %v, want %v", tt.bits, got, tt.want)
+		}
+	}
+	if got := float16ToFloat64(0x7e00); !math.IsNaN(got) {
+		t.Errorf("float16ToFloat64(0x7e00) = %v, want NaN", got)
+	}
+}
+
+func TestWireDecodeTruncated(t *testing.T) {
+	frame := map[string]interface{}{
+		"type":  "subscribe",
+		"id":    strings.Repeat("s", 40),
+		"count": 70000,
+		"since": -300,
+		"tables": []interface{}{
+			"wh_tasks", map[string]interface{}{"filter": []interface{}{nil, true, 1, "x"}},
+		},
+	}
+
+	for _, wire := range binaryWires {
+		encoded, err := wire.encode(frame)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", wire.protocol, err)
+		}
+		for length := 0; length < len(encoded); length++ {
+			if _, err := wire.decode(encoded[:length]); err == nil {
+				t.Errorf("%s: decoding the first %d of %d bytes succeeded", wire.protocol, length, len(encoded))
+			}
+		}
+		if _, err := wire.decode(append(encoded, 0x00)); err == nil {
+			t.Errorf("%s: decoding with a trailing byte succeeded", wire.protocol)
+		}
+	}
+
+	// Lengths larger than the remaining frame fail before anything is allocated
+	for _, tt := range []struct {
+		name string
+		wire *wireFormat
+		data []byte
+	}{
+		{"msgpack array 32", msgpackWire, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{"msgpack map 32", msgpackWire, []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xc0}},
+		{"msgpack str 32", msgpackWire, []byte{0xdb, 0x7f, 0xff, 0xff, 0xff, 'a'}},
+		{"cbor array 64", cborWire, []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor map 32", cborWire, []byte{0xba, 0xff, 0xff, 0xff, 0xff, 0xf6}},
+		{"cbor text 64", cborWire, []byte{0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'a'}},
+	} {
+		if _, err := tt.wire.decode(tt.data); !errors.Is(err, errWireTruncated) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, errWireTruncated)
+		}
+	}
+}